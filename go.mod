@@ -3,20 +3,19 @@ module github.com/signalfx/signalfx-cloudfoundry-bridge
 go 1.17
 
 require (
-	github.com/caarlos0/env v0.0.0-20170203211707-9474f19b515f
 	github.com/cloudfoundry-community/go-cfclient v0.0.0-20170530205557-b0a4f6655a0c
-	github.com/cloudfoundry/bosh-hm-forwarder v0.0.0-20170322175224-91a55a61aa44
 	github.com/cloudfoundry/noaa v2.0.1-0.20170403205344-dd6ec6bd0a01+incompatible
 	github.com/cloudfoundry/sonde-go v0.0.0-20170118225207-78019103037a
 	github.com/gogo/protobuf v1.3.2
 	github.com/gorilla/websocket v1.4.2
 	github.com/onsi/ginkgo v1.16.5
 	github.com/onsi/gomega v1.10.4
+	github.com/pkg/errors v0.9.1
 	github.com/signalfx/com_signalfx_metrics_protobuf v0.0.2
 	github.com/signalfx/golib/v3 v3.3.41
 	github.com/signalfx/uaago v0.0.0-20170527154842-4812d61e49d5
-	golang.org/x/net v0.0.0-20210917221730-978cfadd31cf
 	golang.org/x/oauth2 v0.0.0-20210514164344-f6687ab2804c
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -40,15 +39,14 @@ require (
 	github.com/nxadm/tail v1.4.8 // indirect
 	github.com/opentracing/opentracing-go v1.2.0 // indirect
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c // indirect
-	github.com/pkg/errors v0.9.1 // indirect
 	github.com/signalfx/gohistogram v0.0.0-20160107210732-1ccfd2ff5083 // indirect
 	github.com/signalfx/sapm-proto v0.7.2 // indirect
 	github.com/smartystreets/goconvey v1.7.2 // indirect
+	golang.org/x/net v0.0.0-20210917221730-978cfadd31cf // indirect
 	golang.org/x/sys v0.0.0-20210917161153-d61c044b1678 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
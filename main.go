@@ -1,13 +1,17 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
 	"syscall"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfclient"
 	"github.com/signalfx/golib/v3/sfxclient"
@@ -15,13 +19,38 @@ import (
 	. "github.com/signalfx/signalfx-cloudfoundry-bridge/metrics"
 )
 
+// The CF API client can't be given a context per request, so its requests are
+// bounded by a timeout, and canceled on shutdown by shutdownTransport
+const cfAPITimeout = 30 * time.Second
+
+// Gives requests that are made without a context one that is canceled on
+// shutdown
+type shutdownTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *shutdownTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
-	config, err := GetConfigFromEnv()
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"),
+		"Path to a YAML config file, environment variables override its settings")
+	flag.Parse()
+
+	config, err := GetConfig(*configFile)
 	if err != nil {
 		log.Fatalf("Error in config: %s", err)
 	}
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid config: %s", err)
+	}
+
+	// Tell the logs of instances sharing a Firehose subscription apart
+	log.SetPrefix(fmt.Sprintf("[%s] ", config.InstanceID))
 
 	log.Printf("Using configuration values: %s", config.ScrubbedString())
 
@@ -36,15 +65,25 @@ func main() {
 		SSLSkipVerify: config.InsecureSSLSkipVerify,
 	}
 
-	cloudfoundry, err := cfclient.NewClient(&cfclient.Config{
+	// Canceled once a shutdown signal is received
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfConfig := &cfclient.Config{
 		ApiAddress:        config.CloudFoundryApiURL,
 		ClientID:          config.CFUsername,
 		ClientSecret:      config.CFPassword,
 		SkipSslValidation: config.InsecureSSLSkipVerify,
-	})
+		HttpClient:        &http.Client{Timeout: cfAPITimeout},
+	}
+	cloudfoundry, err := cfclient.NewClient(cfConfig)
 	if err != nil {
 		log.Fatal("Error initializing with the Cloud Foundry API: ", err)
 	}
+	// NewClient replaces the HTTP client with an authenticated one, which the
+	// client it returns shares.  Its transport has to be a *http.Transport
+	// until then.
+	cfConfig.HttpClient.Transport = &shutdownTransport{ctx: ctx, base: cfConfig.HttpClient.Transport}
 
 	if config.TrafficControllerURL == "" {
 		config.TrafficControllerURL = cloudfoundry.Endpoint.DopplerEndpoint
@@ -56,19 +95,58 @@ func main() {
 		sfxClient.DatapointEndpoint = config.SignalFxIngestURL
 	}
 
-	metricFilter := NewMetricFilter(config)
+	// The bridge's own metrics go straight to SignalFx so that they don't
+	// end up in the spool.
+	selfMetrics := NewSelfMetricsScheduler(sfxClient, config.SelfMetricsIntervalSeconds, config.InstanceID)
+
+	// Every component runs until this is canceled, which it is on SIGTERM
+	// or as soon as any of them fails
+	supervisor := NewSupervisor()
+
+	var client SignalFxClient = sfxClient
+	if config.SpoolDir != "" {
+		spool, err := NewDatapointSpool(config.SpoolDir,
+			int64(config.SpoolMaxMegabytes)*1024*1024,
+			time.Duration(config.SpoolMaxAgeSeconds)*time.Second)
+		if err != nil {
+			log.Fatal("Error opening datapoint spool: ", err)
+		}
+		selfMetrics.AddCallback(spool)
 
-	errChan := make(chan error)
+		spoolingClient := NewSpoolingClient(sfxClient, spool)
+		supervisor.Add("spool replayer", spoolingClient)
+		client = spoolingClient
+	}
 
-	go func() {
-		metadataFetcher := NewAppMetadataFetcher(cloudfoundry)
-		metadataFetcher.CacheExpirySeconds = config.AppMetadataCacheExpirySeconds
+	rewriter := NewDatapointRewriter(config)
 
-		nozzle := NewSignalFxFirehoseNozzle(config, cfTokenFetcher, sfxClient, metadataFetcher, metricFilter)
-		nozzle.Start()
-		errChan <- errors.New("Firehose Nozzle quit unexpectedly")
-	}()
+	withLabels := len(config.AppLabelsToInclude) > 0 || len(config.AppAnnotationsToInclude) > 0
+	metadataSource, err := NewAppMetadataSource(cloudfoundry, config.CFAPIVersion, withLabels)
+	if err != nil {
+		log.Fatal("Error initializing the app metadata source: ", err)
+	}
 
+	metadataFetcher := NewAppMetadataFetcher(metadataSource)
+	metadataFetcher.CacheExpirySeconds = config.AppMetadataCacheExpirySeconds
+	metadataFetcher.Workers = config.AppMetadataLookupWorkers
+	metadataFetcher.RefreshIntervalSeconds = config.AppMetadataRefreshIntervalSeconds
+	metadataFetcher.SetMaxCacheSize(config.AppMetadataCacheMaxSize)
+	metadataFetcher.Labels = LabelExtractor{
+		Labels:      config.AppLabelsToInclude,
+		Annotations: config.AppAnnotationsToInclude,
+		Prefix:      config.AppLabelPrefix,
+	}
+	if config.AppMetadataAsProperties {
+		propertiesUpdater := NewDimensionPropertiesUpdater(config.SignalFxAPIURL, config.SignalFxAccessToken)
+		propertiesUpdater.Labels = metadataFetcher.Labels
+		metadataFetcher.AddUpdateListener(propertiesUpdater)
+		supervisor.Add("dimension properties updater", propertiesUpdater)
+		selfMetrics.AddCallback(propertiesUpdater)
+	}
+	supervisor.Add("app metadata fetcher", metadataFetcher)
+	selfMetrics.AddCallback(metadataFetcher)
+
+	var bosh *BoshMetadataFetcher
 	if config.EnableTSDBServer {
 		boshUAAUrl := GetBoshUAAUrl(config.BoshDirectorURL, config.InsecureSSLSkipVerify)
 		boshTokenFetcher := &UAATokenFetcher{
@@ -80,17 +158,57 @@ func main() {
 		boshClient := NewBoshClient(config.BoshDirectorURL,
 			boshTokenFetcher,
 			config.InsecureSSLSkipVerify)
-		bosh := NewBoshMetadataFetcher(boshClient)
+		bosh = NewBoshMetadataFetcher(boshClient)
+		selfMetrics.AddCallback(bosh)
+	}
 
-		go func() {
-			tsdbErr := NewTSDBServer(sfxClient, config.FlushIntervalSeconds, 0, bosh, metricFilter).Start()
+	enrichers, err := NewEnricherChain(config.Enrichers, EnricherSources{
+		AppMetadata:   metadataFetcher,
+		AppDimensions: !config.AppMetadataAsProperties,
+		BoshMetadata:  bosh,
+		CSVFile:       config.CSVEnrichmentFile,
+	})
+	if err != nil {
+		log.Fatal("Error setting up enrichers: ", err)
+	}
 
-			errChan <- tsdbErr
-		}()
+	metricFilter, err := NewMetricFilter(config, enrichers)
+	if err != nil {
+		log.Fatal("Error setting up the metric filter: ", err)
 	}
 
-	err = <-errChan
-	log.Fatal(err)
+	nozzle := NewSignalFxFirehoseNozzle(config, cfTokenFetcher, client, enrichers, metricFilter, rewriter)
+	supervisor.Add("Firehose nozzle", nozzle)
+	selfMetrics.AddCallback(nozzle)
+
+	if config.EnableTSDBServer {
+		tsdbServer := NewTSDBServer(config, client, enrichers, metricFilter, rewriter)
+		supervisor.Add("TSDB server", tsdbServer)
+		selfMetrics.AddCallback(tsdbServer)
+	}
+
+	if config.SelfMetricsIntervalSeconds > 0 {
+		supervisor.Add("self-metrics scheduler", ComponentFunc(func(ctx context.Context) error {
+			// It returns the reason ctx was canceled, which isn't a failure
+			if err := selfMetrics.Schedule(ctx); ctx.Err() == nil {
+				return err
+			}
+			return nil
+		}))
+	}
+
+	shutdownChan := make(chan os.Signal, 1)
+	signal.Notify(shutdownChan, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-shutdownChan
+		log.Printf("Received %s, sending buffered datapoints before exiting", sig)
+		cancel()
+	}()
+
+	if err := supervisor.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+	log.Print("Shut down")
 }
 
 func registerGoRoutineDumpSignalChannel() chan os.Signal {
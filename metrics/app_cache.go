@@ -0,0 +1,145 @@
+package metrics
+
+import (
+    "container/list"
+    "sync"
+    "time"
+)
+
+// A cache of app metadata that is safe to use from multiple goroutines.  If
+// it has more than `maxSize` entries, the least recently used ones are
+// evicted.  A `maxSize` of 0 means no limit.
+type appCache struct {
+    lock      sync.Mutex
+    maxSize   int
+    entries   map[string]*list.Element
+    // Most recently used at the front
+    lru       *list.List
+    evictions int64
+    // Called with the lock held for every app that is removed, however it
+    // is removed, so it must not use the cache
+    onRemove  func(guid string)
+}
+
+type appCacheItem struct {
+    guid     string
+    entry    *CacheEntry
+    lastUsed time.Time
+}
+
+func newAppCache(maxSize int) *appCache {
+    return &appCache{
+        maxSize: maxSize,
+        entries: make(map[string]*list.Element),
+        lru: list.New(),
+    }
+}
+
+// Returns the entry for the app, or nil if it isn't cached, and marks it as
+// recently used
+func (c *appCache) get(guid string) *CacheEntry {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    elem := c.entries[guid]
+    if elem == nil {
+        return nil
+    }
+    c.lru.MoveToFront(elem)
+    item := elem.Value.(*appCacheItem)
+    item.lastUsed = time.Now()
+    return item.entry
+}
+
+func (c *appCache) set(guid string, entry *CacheEntry) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    if elem := c.entries[guid]; elem != nil {
+        elem.Value.(*appCacheItem).entry = entry
+        c.lru.MoveToFront(elem)
+        return
+    }
+    c.entries[guid] = c.lru.PushFront(&appCacheItem{guid, entry, time.Now()})
+    c.evict()
+}
+
+// Replaces every entry with `newEntries`, except for ones inserted after
+// `since`, which are kept.  Apps that were already cached keep their place in
+// the LRU order, and new ones are added as the least recently used.
+func (c *appCache) replaceAll(newEntries map[string]*CacheEntry, since time.Time) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    for guid, elem := range c.entries {
+        item := elem.Value.(*appCacheItem)
+        if entry := newEntries[guid]; entry != nil {
+            item.entry = entry
+        } else if !item.entry.InsertTime.After(since) {
+            c.remove(elem)
+        }
+    }
+
+    for guid, entry := range newEntries {
+        if c.entries[guid] == nil {
+            c.entries[guid] = c.lru.PushBack(&appCacheItem{guid, entry, time.Time{}})
+        }
+    }
+    c.evict()
+}
+
+// Removes entries that expired and haven't been used since, which are most
+// likely for apps that were deleted.  Returns how many were removed.
+func (c *appCache) sweep(expiry time.Duration) int {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+
+    now := time.Now()
+    removed := 0
+    for _, elem := range c.entries {
+        item := elem.Value.(*appCacheItem)
+        expiryTime := item.entry.InsertTime.Add(expiry)
+        if expiryTime.Before(now) && item.lastUsed.Before(expiryTime) {
+            c.remove(elem)
+            removed++
+        }
+    }
+    return removed
+}
+
+// Must be called with the lock held
+func (c *appCache) evict() {
+    for c.maxSize > 0 && c.lru.Len() > c.maxSize {
+        c.remove(c.lru.Back())
+        c.evictions++
+    }
+}
+
+// Must be called with the lock held
+func (c *appCache) remove(elem *list.Element) {
+    guid := elem.Value.(*appCacheItem).guid
+    c.lru.Remove(elem)
+    delete(c.entries, guid)
+    if c.onRemove != nil {
+        c.onRemove(guid)
+    }
+}
+
+func (c *appCache) setMaxSize(maxSize int) {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    c.maxSize = maxSize
+    c.evict()
+}
+
+func (c *appCache) size() int {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return len(c.entries)
+}
+
+func (c *appCache) evictionCount() int64 {
+    c.lock.Lock()
+    defer c.lock.Unlock()
+    return c.evictions
+}
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net/url"
+    "regexp"
+
+    "github.com/cloudfoundry-community/go-cfclient"
+)
+
+// App teams can put metadata labels and annotations on their apps, spaces and
+// orgs with the CF v3 API, e.g. `team` or `cost-center`.  The allowlisted
+// ones are sent along with the app name, space and org, prefixed with
+// `Prefix`.  If an app, its space and its org have the same label, the app's
+// value wins, then the space's.
+
+// The v3 source gets metadata along with each app.  The go-cfclient library
+// only knows about the v2 API, so the v2 source looks metadata up from the v3
+// endpoints through its generic request methods, as does the v3 source.
+
+type LabelExtractor struct {
+    Labels      []string
+    Annotations []string
+    Prefix      string
+}
+
+type v3Metadata struct {
+    Labels      map[string]string `json:"labels"`
+    Annotations map[string]string `json:"annotations"`
+}
+
+type v3Resource struct {
+    Guid     string     `json:"guid"`
+    Metadata v3Metadata `json:"metadata"`
+}
+
+type v3Pagination struct {
+    Next *struct {
+        Href string `json:"href"`
+    } `json:"next"`
+}
+
+type v3ListResponse struct {
+    Pagination v3Pagination `json:"pagination"`
+    Resources  []v3Resource `json:"resources"`
+}
+
+func (e *LabelExtractor) enabled() bool {
+    return len(e.Labels) > 0 || len(e.Annotations) > 0
+}
+
+// The dimensions that the bridge sets itself, which labels and annotations
+// must not be sent as.  The last three are only sent as properties of the
+// app_id dimension.
+var reservedDimensionNames = map[string]bool{
+    "job":                true,
+    "deployment":         true,
+    "host":               true,
+    "bosh_id":            true,
+    "metric_source":      true,
+    "app_id":             true,
+    "app_instance_index": true,
+    "app_name":           true,
+    "app_space":          true,
+    "app_org":            true,
+    "method":             true,
+    "status_class":       true,
+    "app_buildpack":      true,
+    "app_stack":          true,
+    "app_state":          true,
+}
+
+// SignalFx dimension names can only contain letters, numbers, _ and -,
+// whereas label keys can have a DNS prefix, e.g. example.com/team
+var invalidDimensionCharsRegexp = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+func (e *LabelExtractor) dimensionName(key string) string {
+    return invalidDimensionCharsRegexp.ReplaceAllString(e.Prefix+key, "_")
+}
+
+// The names of the dimensions the allowlisted labels and annotations are sent
+// as
+func (e *LabelExtractor) dimensionNames() []string {
+    names := make([]string, 0, len(e.Labels)+len(e.Annotations))
+    for _, key := range e.Labels {
+        names = append(names, e.dimensionName(key))
+    }
+    for _, key := range e.Annotations {
+        names = append(names, e.dimensionName(key))
+    }
+    return names
+}
+
+// Returns the allowlisted labels and annotations as dimensions.  The
+// metadata is given from the least to the most specific, i.e. org, space and
+// then app.
+func (e *LabelExtractor) extract(levels ...v3Metadata) map[string]string {
+    dims := map[string]string{}
+    for _, level := range levels {
+        for _, key := range e.Labels {
+            if value, ok := level.Labels[key]; ok {
+                dims[e.dimensionName(key)] = value
+            }
+        }
+        for _, key := range e.Annotations {
+            if value, ok := level.Annotations[key]; ok {
+                dims[e.dimensionName(key)] = value
+            }
+        }
+    }
+    return dims
+}
+
+func getV3Resource(client *cfclient.Client, path string) (v3Resource, error) {
+    var resource v3Resource
+    err := doV3Request(client, path, &resource)
+    return resource, err
+}
+
+// Follows every page of the list, with as many results per page as the CF
+// API allows
+func listV3Resources(client *cfclient.Client, path string) ([]v3Resource, error) {
+    var resources []v3Resource
+    requestURL := path + "?per_page=5000"
+    for requestURL != "" {
+        var page v3ListResponse
+        if err := doV3Request(client, requestURL, &page); err != nil {
+            return nil, err
+        }
+        resources = append(resources, page.Resources...)
+
+        var err error
+        if requestURL, err = page.Pagination.nextPage(); err != nil {
+            return nil, err
+        }
+    }
+    return resources, nil
+}
+
+// Returns the path and query of the next page, or "" if this is the last one.
+// The next link is absolute but requests are made relative to the API
+// address.
+func (p v3Pagination) nextPage() (string, error) {
+    if p.Next == nil || p.Next.Href == "" {
+        return "", nil
+    }
+    next, err := url.Parse(p.Next.Href)
+    if err != nil {
+        return "", err
+    }
+    return next.RequestURI(), nil
+}
+
+func doV3Request(client *cfclient.Client, path string, result interface{}) error {
+    resp, err := client.DoRequest(client.NewRequest("GET", path))
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    body, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return err
+    }
+    return json.Unmarshal(body, result)
+}
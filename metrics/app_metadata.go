@@ -1,10 +1,15 @@
 package metrics
 
 import (
+    "context"
     "log"
+    "sync"
+    "sync/atomic"
     "time"
 
-    "github.com/cloudfoundry-community/go-cfclient"
+    "github.com/pkg/errors"
+    "github.com/signalfx/golib/v3/datapoint"
+    "github.com/signalfx/golib/v3/sfxclient"
 )
 
 // The AppMetadataFetcher is used to get the human names for applications to
@@ -12,53 +17,439 @@ import (
 // out of the Firehose only includes an app GUID.
 
 // The data is cached for `CacheExpirySeconds`, after which it is refetched
-// from the CF API.  The CF API requires the scope/authority of
+// from the CF API by an `AppMetadataSource`, which uses either the v2 or the
+// v3 API.  The CF API requires the scope/authority of
 // `cloud_controller.admin_read_only` to pull this information.
 
+// So that a slow CF API doesn't hold up the Firehose nozzle, `CachedApp`
+// never blocks.  Apps that aren't cached, or whose cache entry has expired,
+// are looked up in the background by a pool of `Workers` goroutines, and only
+// one lookup at a time is made for each app.
+
+// If `RefreshIntervalSeconds` is set, all apps, spaces and orgs are also
+// listed from the CF API in bulk at that interval and the cache is replaced
+// with the result.  Cache entries then only expire individually if they
+// haven't been refreshed for `staleRefreshIntervals` intervals, e.g. because
+// listing keeps failing, and otherwise only apps created since the last
+// refresh are looked up one at a time.
+
+// The cache holds at most `SetMaxCacheSize` apps, evicting the least recently
+// used ones, and every `SweepInterval` entries that have expired without being
+// used since are removed, so that deleted apps don't linger.
+
+// Listeners added with `AddUpdateListener` are told about every app that is
+// looked up or refreshed, whether or not it changed.
+
+// Apps that fail to be looked up aren't looked up again for `RetryBackoff`,
+// which doubles each time they fail up to `MaxRetryBackoff`, so that deleted
+// apps or a CF API outage don't cause a lookup for every metric.  If
+// `CircuitBreakerThreshold` lookups in a row fail for reasons other than the
+// app not existing, no lookups are made at all for `CircuitBreakerCooldown`.
+
 type CacheEntry struct {
-    App *cfclient.App
+    App *CFApp
     InsertTime time.Time
+    // The allowlisted labels and annotations as dimensions, see `Labels`
+    Labels map[string]string
+}
+
+type failedLookup struct {
+    backoff time.Duration
+    retryAt time.Time
+}
+
+type AppUpdateListener interface {
+    // Called from the goroutine that looked the app up, so it must not block
+    AppUpdated(cacheEntry *CacheEntry)
+}
+
+// Listeners that keep state for each app can implement this to be told when
+// an app leaves the cache, e.g. because it was deleted or evicted
+type appRemovalListener interface {
+    // Called while the cache is locked, so it must not block or use the
+    // fetcher
+    AppRemoved(guid string)
 }
 
 type AppMetadataFetcher struct {
-    appCache            map[string]*CacheEntry
-    client              *cfclient.Client
+    lock                sync.Mutex
+    appCache            *appCache
+    // Apps whose lookup is queued or in progress
+    inFlight            map[string]bool
+    lookups             chan string
+    source              AppMetadataSource
     CacheExpirySeconds  int
+    Workers             int
+    RefreshIntervalSeconds int
+
+    failures                map[string]*failedLookup
+    consecutiveFailures     int
+    // Zero while the circuit is closed.  Once it has passed, the circuit is
+    // half-open and lets a single probe lookup through.
+    circuitOpenUntil        time.Time
+    probing                 bool
+    RetryBackoff            time.Duration
+    MaxRetryBackoff         time.Duration
+    CircuitBreakerThreshold int
+    CircuitBreakerCooldown  time.Duration
+    SweepInterval           time.Duration
+
+    listeners []AppUpdateListener
+
+    // Which labels and annotations to send, see app_labels.go.  The source
+    // must have been created with `withLabels` for the v2 API.
+    Labels LabelExtractor
+
+    // Self-metrics, see `Datapoints`
+    cacheHits           int64
+    cacheMisses         int64
+    lookupFailures      int64
+    bulkRefreshes       int64
+    bulkRefreshFailures int64
+    lookupsSkipped      int64
 }
 
 const defaultCacheExpirySeconds = 5 * 60
+const defaultLookupWorkers = 4
+// Lookups beyond this are dropped until the queue drains, and retried the
+// next time the app is seen
+const lookupQueueSize = 10000
+const defaultRetryBackoff = 10 * time.Second
+const defaultMaxRetryBackoff = 10 * time.Minute
+const defaultCircuitBreakerThreshold = 5
+const defaultCircuitBreakerCooldown = 30 * time.Second
+const defaultMaxCacheSize = 50000
+const defaultSweepInterval = time.Minute
+// How many bulk refreshes can fail in a row before apps are looked up one at
+// a time again
+const staleRefreshIntervals = 3
 
+var errLookupPaused = errors.New("app metadata lookups are paused after failing")
 
-func NewAppMetadataFetcher(client *cfclient.Client) *AppMetadataFetcher {
-    return &AppMetadataFetcher{
-        appCache: make(map[string]*CacheEntry),
-        client: client,
+func NewAppMetadataFetcher(source AppMetadataSource) *AppMetadataFetcher {
+    fetcher := &AppMetadataFetcher{
+        appCache: newAppCache(defaultMaxCacheSize),
+        inFlight: make(map[string]bool),
+        lookups: make(chan string, lookupQueueSize),
+        source: source,
         CacheExpirySeconds: defaultCacheExpirySeconds,
+        Workers: defaultLookupWorkers,
+        failures: make(map[string]*failedLookup),
+        RetryBackoff: defaultRetryBackoff,
+        MaxRetryBackoff: defaultMaxRetryBackoff,
+        CircuitBreakerThreshold: defaultCircuitBreakerThreshold,
+        CircuitBreakerCooldown: defaultCircuitBreakerCooldown,
+        SweepInterval: defaultSweepInterval,
+    }
+    fetcher.appCache.onRemove = fetcher.notifyRemoved
+    return fetcher
+}
+
+// Must be called before `Run`
+func (a *AppMetadataFetcher) AddUpdateListener(listener AppUpdateListener) {
+    a.listeners = append(a.listeners, listener)
+}
+
+func (a *AppMetadataFetcher) notifyListeners(cacheEntry *CacheEntry) {
+    for _, listener := range a.listeners {
+        listener.AppUpdated(cacheEntry)
+    }
+}
+
+func (a *AppMetadataFetcher) notifyRemoved(guid string) {
+    for _, listener := range a.listeners {
+        if l, ok := listener.(appRemovalListener); ok {
+            l.AppRemoved(guid)
+        }
+    }
+}
+
+// Sets how many apps to cache at most, evicting the least recently used ones
+// if there are more.  0 means no limit.
+func (a *AppMetadataFetcher) SetMaxCacheSize(size int) {
+    a.appCache.setMaxSize(size)
+}
+
+// Runs the lookup workers, the sweeper and the bulk refresher if enabled
+// until ctx is canceled.  Lookups in progress then aren't waited for, the CF
+// API client that main sets up cancels their requests on shutdown.
+func (a *AppMetadataFetcher) Run(ctx context.Context) error {
+    for i := 0; i < a.Workers; i++ {
+        go a.lookupWorker(ctx)
+    }
+    go a.sweepPeriodically(ctx)
+    if a.RefreshIntervalSeconds > 0 {
+        go a.refreshPeriodically(ctx)
+    }
+    <-ctx.Done()
+    return nil
+}
+
+func (a *AppMetadataFetcher) sweepPeriodically(ctx context.Context) {
+    ticker := time.NewTicker(a.SweepInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            a.sweep()
+        }
+    }
+}
+
+// Forgets about apps that are no longer seen, both cached ones and ones
+// whose lookup failed
+func (a *AppMetadataFetcher) sweep() {
+    if removed := a.appCache.sweep(a.cacheExpiry()); removed > 0 {
+        log.Printf("Removed %d expired apps from the metadata cache", removed)
+    }
+
+    now := time.Now()
+    a.lock.Lock()
+    defer a.lock.Unlock()
+    for guid, failure := range a.failures {
+        if failure.retryAt.Add(a.MaxRetryBackoff).Before(now) {
+            delete(a.failures, guid)
+        }
+    }
+}
+
+func (a *AppMetadataFetcher) refreshPeriodically(ctx context.Context) {
+    ticker := time.NewTicker(time.Duration(a.RefreshIntervalSeconds) * time.Second)
+    defer ticker.Stop()
+
+    for {
+        if err := a.refreshAll(); err != nil {
+            log.Printf("Error refreshing app metadata: %v", err)
+            atomic.AddInt64(&a.bulkRefreshFailures, 1)
+            a.lock.Lock()
+            a.recordCFAPIFailure(time.Now())
+            a.lock.Unlock()
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// Lists every app with its space and org and swaps them in as the new cache
+func (a *AppMetadataFetcher) refreshAll() error {
+    start := time.Now()
+
+    apps, err := a.source.ListApps()
+    if err != nil {
+        return err
+    }
+
+    newCache := make(map[string]*CacheEntry, len(apps))
+    for _, app := range apps {
+        newCache[app.Guid] = &CacheEntry{app, start, a.appLabels(app)}
+    }
+
+    // Keep apps that were looked up individually while listing, since they
+    // may have been created after they would have been listed
+    a.appCache.replaceAll(newCache, start)
+
+    a.lock.Lock()
+    // The CF API is evidently working again
+    a.closeCircuit()
+    a.lock.Unlock()
+
+    for _, cacheEntry := range newCache {
+        a.notifyListeners(cacheEntry)
     }
+
+    log.Printf("Refreshed metadata for %d apps in %s", len(apps), time.Since(start))
+    atomic.AddInt64(&a.bulkRefreshes, 1)
+    return nil
+}
+
+func (a *AppMetadataFetcher) appLabels(app *CFApp) map[string]string {
+    if !a.Labels.enabled() {
+        return nil
+    }
+    return a.Labels.extract(app.OrgMetadata, app.SpaceMetadata, app.Metadata)
 }
 
-func (a *AppMetadataFetcher) fetchApp(guid string) (*cfclient.App, error) {
-    cacheEntry := a.appCache[guid]
-    if cacheEntry != nil {
-        expiryTime := cacheEntry.InsertTime.Add(time.Duration(a.CacheExpirySeconds) * time.Second)
-        if expiryTime.Before(time.Now()) {
-            log.Print("Expiring app metadata cache for ", guid)
-            delete(a.appCache, guid)
-            return a.fetchApp(guid)
+func (a *AppMetadataFetcher) lookupWorker(ctx context.Context) {
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case guid := <-a.lookups:
+            a.lookupApp(guid)
+            a.lock.Lock()
+            delete(a.inFlight, guid)
+            a.lock.Unlock()
         }
+    }
+}
+
+func (a *AppMetadataFetcher) lookupApp(guid string) (*CFApp, error) {
+    now := time.Now()
+    a.lock.Lock()
+    canLookUp := a.canLookUp(guid, now)
+    if canLookUp && !a.circuitOpenUntil.IsZero() {
+        a.probing = true
+    }
+    a.lock.Unlock()
+    if !canLookUp {
+        atomic.AddInt64(&a.lookupsSkipped, 1)
+        return nil, errLookupPaused
+    }
+
+    log.Print("Fetching app metadata for ", guid)
+    app, err := a.source.GetApp(guid)
+    if err != nil {
+        log.Printf("Error fetching app %s: %v", guid, err)
+        atomic.AddInt64(&a.lookupFailures, 1)
+        a.recordFailure(guid, err)
+        return nil, err
+    }
+
+    cacheEntry := &CacheEntry{app, time.Now(), a.appLabels(app)}
+    a.appCache.set(guid, cacheEntry)
+
+    a.lock.Lock()
+    delete(a.failures, guid)
+    a.closeCircuit()
+    a.lock.Unlock()
+
+    a.notifyListeners(cacheEntry)
+    return app, nil
+}
+
+// Whether the app can be looked up now, i.e. it isn't backing off after a
+// failed lookup, and the circuit breaker is closed or half-open without a
+// probe in progress.  The lock must be held.
+func (a *AppMetadataFetcher) canLookUp(guid string, now time.Time) bool {
+    if now.Before(a.circuitOpenUntil) || a.probing {
+        return false
+    }
+    failure := a.failures[guid]
+    return failure == nil || !now.Before(failure.retryAt)
+}
+
+// The lock must be held
+func (a *AppMetadataFetcher) closeCircuit() {
+    a.consecutiveFailures = 0
+    a.circuitOpenUntil = time.Time{}
+    a.probing = false
+}
+
+func (a *AppMetadataFetcher) recordFailure(guid string, err error) {
+    now := time.Now()
+
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    failure := a.failures[guid]
+    if failure == nil {
+        failure = &failedLookup{backoff: a.RetryBackoff}
+        a.failures[guid] = failure
     } else {
-        log.Print("Fetching app metadata for ", guid)
-        app, err := a.client.AppByGuid(guid)
-        if err != nil {
-            log.Printf("Error fetching app %s: %v", guid, err)
-            return nil, err
+        failure.backoff *= 2
+        if failure.backoff > a.MaxRetryBackoff {
+            failure.backoff = a.MaxRetryBackoff
         }
+    }
+    failure.retryAt = now.Add(failure.backoff)
 
-        cacheEntry = &CacheEntry{&app, time.Now()}
-        a.appCache[guid] = cacheEntry
+    // The CF API is working fine if it says the app doesn't exist
+    if errors.Cause(err) == ErrAppNotFound {
+        a.closeCircuit()
+        return
     }
+    a.recordCFAPIFailure(now)
+}
 
-    return cacheEntry.App, nil
+// Counts a failed lookup or bulk refresh towards opening the circuit.  The
+// lock must be held.
+func (a *AppMetadataFetcher) recordCFAPIFailure(now time.Time) {
+    a.probing = false
+    a.consecutiveFailures++
+    // Once open, a failed probe after the cooldown opens it again
+    if a.CircuitBreakerThreshold > 0 && a.consecutiveFailures >= a.CircuitBreakerThreshold {
+        if !now.Before(a.circuitOpenUntil) {
+            log.Printf("%d app metadata lookups or refreshes failed in a row, pausing lookups for %s",
+                a.consecutiveFailures, a.CircuitBreakerCooldown)
+        }
+        a.circuitOpenUntil = now.Add(a.CircuitBreakerCooldown)
+    }
+}
+
+// Entries that are refreshed in bulk are only expired once they have missed
+// several refreshes
+func (a *AppMetadataFetcher) cacheExpiry() time.Duration {
+    if a.RefreshIntervalSeconds > 0 {
+        return staleRefreshIntervals * time.Duration(a.RefreshIntervalSeconds) * time.Second
+    }
+    return time.Duration(a.CacheExpirySeconds) * time.Second
+}
+
+func (a *AppMetadataFetcher) isExpired(cacheEntry *CacheEntry) bool {
+    return cacheEntry.InsertTime.Add(a.cacheExpiry()).Before(time.Now())
+}
+
+// Returns the cached app without blocking, even if its cache entry has
+// expired, and queues a lookup if it isn't cached or has expired, unless
+// lookups of it are backing off after failing.  Returns
+// false if the app isn't cached yet.
+func (a *AppMetadataFetcher) CachedApp(guid string) (*CFApp, bool) {
+    cacheEntry, ok := a.cachedEntry(guid)
+    if !ok {
+        return nil, false
+    }
+    return cacheEntry.App, true
+}
+
+// Like `CachedApp`, but also returns the app's labels
+func (a *AppMetadataFetcher) cachedEntry(guid string) (*CacheEntry, bool) {
+    a.lock.Lock()
+    defer a.lock.Unlock()
+
+    cacheEntry := a.appCache.get(guid)
+    if cacheEntry != nil && !a.isExpired(cacheEntry) {
+        atomic.AddInt64(&a.cacheHits, 1)
+        return cacheEntry, true
+    }
+
+    atomic.AddInt64(&a.cacheMisses, 1)
+    if !a.inFlight[guid] {
+        if !a.canLookUp(guid, time.Now()) {
+            atomic.AddInt64(&a.lookupsSkipped, 1)
+        } else {
+            select {
+            case a.lookups <- guid:
+                a.inFlight[guid] = true
+            default:
+                log.Printf("App metadata lookup queue is full, not looking up %s", guid)
+            }
+        }
+    }
+
+    if cacheEntry == nil {
+        return nil, false
+    }
+    return cacheEntry, true
+}
+
+// Looks the app up synchronously if it isn't cached or has expired
+func (a *AppMetadataFetcher) fetchApp(guid string) (*CFApp, error) {
+    cacheEntry := a.appCache.get(guid)
+
+    if cacheEntry != nil && !a.isExpired(cacheEntry) {
+        atomic.AddInt64(&a.cacheHits, 1)
+        return cacheEntry.App, nil
+    }
+
+    atomic.AddInt64(&a.cacheMisses, 1)
+    return a.lookupApp(guid)
 }
 
 func (a *AppMetadataFetcher) GetAppNameForGUID(guid string) string {
@@ -76,7 +467,7 @@ func (a *AppMetadataFetcher) GetSpaceNameForGUID(guid string) string {
         return ""
     }
 
-    return app.SpaceData.Entity.Name
+    return app.SpaceName
 }
 
 func (a *AppMetadataFetcher) GetOrgNameForGUID(guid string) string {
@@ -85,5 +476,49 @@ func (a *AppMetadataFetcher) GetOrgNameForGUID(guid string) string {
         return ""
     }
 
-    return app.SpaceData.Entity.OrgData.Entity.Name
+    return app.OrgName
+}
+
+// Sets the app_name, app_space and app_org dimensions, which are empty if the
+// app isn't known, and the app's labels
+func setAppDimensions(dimensions map[string]string, cacheEntry *CacheEntry) {
+    if cacheEntry == nil {
+        dimensions["app_name"] = ""
+        dimensions["app_space"] = ""
+        dimensions["app_org"] = ""
+        return
+    }
+    app := cacheEntry.App
+    dimensions["app_name"] = app.Name
+    dimensions["app_space"] = app.SpaceName
+    dimensions["app_org"] = app.OrgName
+    for k, v := range cacheEntry.Labels {
+        dimensions[k] = v
+    }
+}
+
+// Satisfies the sfxclient.Collector interface
+func (a *AppMetadataFetcher) Datapoints() []*datapoint.Datapoint {
+    a.lock.Lock()
+    pending := len(a.inFlight)
+    backingOff := len(a.failures)
+    circuitOpen := int64(0)
+    if !a.circuitOpenUntil.IsZero() {
+        circuitOpen = 1
+    }
+    a.lock.Unlock()
+
+    return []*datapoint.Datapoint{
+        sfxclient.Gauge("app_metadata.lookups_pending", nil, int64(pending)),
+        sfxclient.Gauge("app_metadata.cache_size", nil, int64(a.appCache.size())),
+        sfxclient.Cumulative("app_metadata.cache_evictions", nil, a.appCache.evictionCount()),
+        sfxclient.CumulativeP("app_metadata.bulk_refreshes", nil, &a.bulkRefreshes),
+        sfxclient.CumulativeP("app_metadata.bulk_refresh_failures", nil, &a.bulkRefreshFailures),
+        sfxclient.CumulativeP("app_metadata.cache_hits", nil, &a.cacheHits),
+        sfxclient.CumulativeP("app_metadata.cache_misses", nil, &a.cacheMisses),
+        sfxclient.CumulativeP("app_metadata.lookup_failures", nil, &a.lookupFailures),
+        sfxclient.CumulativeP("app_metadata.lookups_skipped", nil, &a.lookupsSkipped),
+        sfxclient.Gauge("app_metadata.apps_backing_off", nil, int64(backingOff)),
+        sfxclient.Gauge("app_metadata.circuit_open", nil, circuitOpen),
+    }
 }
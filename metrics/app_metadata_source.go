@@ -0,0 +1,429 @@
+package metrics
+
+import (
+    "fmt"
+    "log"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/cloudfoundry-community/go-cfclient"
+    "github.com/pkg/errors"
+)
+
+// An AppMetadataSource gets apps along with their space and org from the CF
+// API.  CF foundations are removing the v2 API, so the v3 API is used if the
+// Cloud Controller has it, unless a version is chosen with `CF_API_VERSION`.
+
+// An app with the names of its space and org, whichever API it came from
+type CFApp struct {
+    Guid      string
+    Name      string
+    State     string
+    Buildpack string
+    Stack     string
+    SpaceGuid string
+    SpaceName string
+    OrgGuid   string
+    OrgName   string
+
+    // The v3 metadata of the app, its space and its org, only set by the v2
+    // source if it was asked for labels
+    Metadata      v3Metadata
+    SpaceMetadata v3Metadata
+    OrgMetadata   v3Metadata
+}
+
+type AppMetadataSource interface {
+    // Returns ErrAppNotFound if the app doesn't exist
+    GetApp(guid string) (*CFApp, error)
+    // Lists every app along with its space and org
+    ListApps() ([]*CFApp, error)
+}
+
+var ErrAppNotFound = errors.New("app not found")
+
+// Space and org metadata is shared by many apps, so the v2 source caches it
+// for this long
+const v3MetadataCacheExpiry = 5 * time.Minute
+
+// Returns the source for the given API version, which is "v2", "v3" or
+// "auto" to use v3 if the Cloud Controller has it.  If `withLabels` is set,
+// the v2 source also looks up the v3 metadata of apps, spaces and orgs.
+func NewAppMetadataSource(client *cfclient.Client, apiVersion string, withLabels bool) (AppMetadataSource, error) {
+    if apiVersion == "auto" {
+        hasV3, err := hasV3API(client)
+        if err != nil {
+            return nil, errors.Wrap(err, "detecting the CF API version")
+        }
+        apiVersion = "v2"
+        if hasV3 {
+            apiVersion = "v3"
+        }
+        log.Printf("Using the CF %s API for app metadata", apiVersion)
+    }
+
+    switch apiVersion {
+    case "v2":
+        return &v2AppMetadataSource{
+            client: client,
+            withLabels: withLabels,
+            stackNames: make(map[string]string),
+            metadataCache: make(map[string]*v3MetadataCacheEntry),
+        }, nil
+    case "v3":
+        return &v3AppMetadataSource{client: client}, nil
+    }
+    return nil, fmt.Errorf("unknown CF API version %q", apiVersion)
+}
+
+// The Cloud Controller's root lists the APIs it has, with a null link for
+// ones that are disabled
+func hasV3API(client *cfclient.Client) (bool, error) {
+    var root struct {
+        Links map[string]*struct {
+            Href string `json:"href"`
+        } `json:"links"`
+    }
+    if err := doV3Request(client, "/", &root); err != nil {
+        return false, err
+    }
+    return root.Links["cloud_controller_v3"] != nil, nil
+}
+
+type v2AppMetadataSource struct {
+    client     *cfclient.Client
+    withLabels bool
+
+    lock sync.Mutex
+    // Stacks are looked up separately since there are only a few of them
+    stackNames       map[string]string
+    lastStackRefresh time.Time
+    metadataCache    map[string]*v3MetadataCacheEntry
+}
+
+// A space's or org's metadata, which is shared by many apps
+type v3MetadataCacheEntry struct {
+    metadata   v3Metadata
+    insertTime time.Time
+}
+
+// The CF v2 API allows up to 100 results per page
+var bulkListQuery = url.Values{"results-per-page": []string{"100"}}
+
+// Apps with an unknown stack only cause the stacks to be listed this often
+const stackRefreshInterval = time.Minute
+
+func (s *v2AppMetadataSource) GetApp(guid string) (*CFApp, error) {
+    app, err := s.client.AppByGuid(guid)
+    if err != nil {
+        if cfErr, ok := errors.Cause(err).(cfclient.CloudFoundryError); ok && cfErr.ErrorCode == "CF-AppNotFound" {
+            return nil, ErrAppNotFound
+        }
+        return nil, err
+    }
+
+    s.ensureStackKnown(app.StackGuid)
+    cfApp := s.convert(&app, &app.SpaceData.Entity, &app.SpaceData.Entity.OrgData.Entity)
+    if s.withLabels {
+        s.lookupLabels(cfApp)
+    }
+    return cfApp, nil
+}
+
+// Lists every app, space and org and joins them together.  Listing apps
+// without inlining their relations keeps the responses small, since there are
+// far fewer spaces and orgs than apps.
+func (s *v2AppMetadataSource) ListApps() ([]*CFApp, error) {
+    orgs, err := s.client.ListOrgsByQuery(bulkListQuery)
+    if err != nil {
+        return nil, err
+    }
+    spaces, err := s.client.ListSpacesByQuery(bulkListQuery)
+    if err != nil {
+        return nil, err
+    }
+    apps, err := s.client.ListAppsByQuery(bulkListQuery)
+    if err != nil {
+        return nil, err
+    }
+    if err := s.refreshStacks(); err != nil {
+        return nil, err
+    }
+
+    orgsByGUID := make(map[string]*cfclient.Org, len(orgs))
+    for i := range orgs {
+        orgsByGUID[orgs[i].Guid] = &orgs[i]
+    }
+    spacesByGUID := make(map[string]*cfclient.Space, len(spaces))
+    for i := range spaces {
+        spacesByGUID[spaces[i].Guid] = &spaces[i]
+    }
+
+    cfApps := make([]*CFApp, 0, len(apps))
+    for i := range apps {
+        space := spacesByGUID[apps[i].SpaceGuid]
+        if space == nil {
+            space = &cfclient.Space{Guid: apps[i].SpaceGuid}
+        }
+        org := orgsByGUID[space.OrganizationGuid]
+        if org == nil {
+            org = &cfclient.Org{Guid: space.OrganizationGuid}
+        }
+        cfApps = append(cfApps, s.convert(&apps[i], space, org))
+    }
+
+    if s.withLabels {
+        if err := s.listLabels(cfApps); err != nil {
+            return nil, err
+        }
+    }
+    return cfApps, nil
+}
+
+func (s *v2AppMetadataSource) convert(app *cfclient.App, space *cfclient.Space, org *cfclient.Org) *CFApp {
+    buildpack := app.Buildpack
+    if buildpack == "" {
+        buildpack = app.DetectedBuildpack
+    }
+
+    s.lock.Lock()
+    stack := s.stackNames[app.StackGuid]
+    s.lock.Unlock()
+
+    return &CFApp{
+        Guid: app.Guid,
+        Name: app.Name,
+        State: app.State,
+        Buildpack: buildpack,
+        Stack: stack,
+        SpaceGuid: app.SpaceGuid,
+        SpaceName: space.Name,
+        OrgGuid: space.OrganizationGuid,
+        OrgName: org.Name,
+    }
+}
+
+func (s *v2AppMetadataSource) refreshStacks() error {
+    stacks, err := s.client.ListStacksByQuery(bulkListQuery)
+    if err != nil {
+        return err
+    }
+
+    stackNames := make(map[string]string, len(stacks))
+    for _, stack := range stacks {
+        stackNames[stack.Guid] = stack.Name
+    }
+
+    s.lock.Lock()
+    s.stackNames = stackNames
+    s.lastStackRefresh = time.Now()
+    s.lock.Unlock()
+    return nil
+}
+
+// Lists the stacks again if the app uses one that isn't known, e.g. because
+// it was added since they were last listed
+func (s *v2AppMetadataSource) ensureStackKnown(stackGUID string) {
+    s.lock.Lock()
+    _, known := s.stackNames[stackGUID]
+    recentlyRefreshed := time.Since(s.lastStackRefresh) < stackRefreshInterval
+    s.lock.Unlock()
+
+    if stackGUID == "" || known || recentlyRefreshed {
+        return
+    }
+    if err := s.refreshStacks(); err != nil {
+        log.Printf("Error listing stacks: %v", err)
+    }
+}
+
+// Looks up the metadata of the app, its space and its org from the v3 API.
+// Errors are logged and leave the metadata out, so that a CF API without v3
+// doesn't stop apps from being looked up.
+func (s *v2AppMetadataSource) lookupLabels(app *CFApp) {
+    appResource, err := getV3Resource(s.client, "/v3/apps/"+app.Guid)
+    if err != nil {
+        log.Printf("Error fetching labels of app %s: %v", app.Guid, err)
+        return
+    }
+    orgMetadata, err := s.cachedV3Metadata("/v3/organizations/" + app.OrgGuid)
+    if err != nil {
+        log.Printf("Error fetching labels of org %s: %v", app.OrgGuid, err)
+        return
+    }
+    spaceMetadata, err := s.cachedV3Metadata("/v3/spaces/" + app.SpaceGuid)
+    if err != nil {
+        log.Printf("Error fetching labels of space %s: %v", app.SpaceGuid, err)
+        return
+    }
+
+    app.Metadata = appResource.Metadata
+    app.SpaceMetadata = spaceMetadata
+    app.OrgMetadata = orgMetadata
+}
+
+func (s *v2AppMetadataSource) cachedV3Metadata(path string) (v3Metadata, error) {
+    s.lock.Lock()
+    cacheEntry := s.metadataCache[path]
+    s.lock.Unlock()
+
+    if cacheEntry != nil && time.Since(cacheEntry.insertTime) < v3MetadataCacheExpiry {
+        return cacheEntry.metadata, nil
+    }
+
+    resource, err := getV3Resource(s.client, path)
+    if err != nil {
+        return v3Metadata{}, err
+    }
+
+    s.lock.Lock()
+    s.metadataCache[path] = &v3MetadataCacheEntry{resource.Metadata, time.Now()}
+    s.lock.Unlock()
+    return resource.Metadata, nil
+}
+
+// Lists the metadata of every app, space and org for the bulk refresh
+func (s *v2AppMetadataSource) listLabels(apps []*CFApp) error {
+    metadataByGUID := map[string]v3Metadata{}
+    for _, path := range []string{"/v3/organizations", "/v3/spaces", "/v3/apps"} {
+        resources, err := listV3Resources(s.client, path)
+        if err != nil {
+            return err
+        }
+        for _, resource := range resources {
+            metadataByGUID[resource.Guid] = resource.Metadata
+        }
+    }
+
+    for _, app := range apps {
+        app.Metadata = metadataByGUID[app.Guid]
+        app.SpaceMetadata = metadataByGUID[app.SpaceGuid]
+        app.OrgMetadata = metadataByGUID[app.OrgGuid]
+    }
+    return nil
+}
+
+// The v3 API has everything the v2 API has, including metadata, and includes
+// each app's space and org in the same response
+type v3AppMetadataSource struct {
+    client *cfclient.Client
+}
+
+type v3App struct {
+    Guid      string `json:"guid"`
+    Name      string `json:"name"`
+    State     string `json:"state"`
+    Lifecycle struct {
+        Data struct {
+            Buildpacks []string `json:"buildpacks"`
+            Stack      string   `json:"stack"`
+        } `json:"data"`
+    } `json:"lifecycle"`
+    Relationships struct {
+        Space v3Relationship `json:"space"`
+    } `json:"relationships"`
+    Metadata v3Metadata `json:"metadata"`
+}
+
+type v3Space struct {
+    Guid          string `json:"guid"`
+    Name          string `json:"name"`
+    Relationships struct {
+        Organization v3Relationship `json:"organization"`
+    } `json:"relationships"`
+    Metadata v3Metadata `json:"metadata"`
+}
+
+type v3Org struct {
+    Guid     string     `json:"guid"`
+    Name     string     `json:"name"`
+    Metadata v3Metadata `json:"metadata"`
+}
+
+type v3Relationship struct {
+    Data struct {
+        Guid string `json:"guid"`
+    } `json:"data"`
+}
+
+type v3AppList struct {
+    Pagination v3Pagination `json:"pagination"`
+    Resources  []v3App      `json:"resources"`
+    Included   struct {
+        Spaces        []v3Space `json:"spaces"`
+        Organizations []v3Org   `json:"organizations"`
+    } `json:"included"`
+}
+
+const v3AppsPath = "/v3/apps?include=space.organization&per_page=5000"
+
+// Apps are looked up through the list endpoint, which returns no apps rather
+// than a 404 if the app doesn't exist.  go-cfclient can only decode v2
+// errors, so a v3 404 couldn't be told apart from the CF API failing.
+func (s *v3AppMetadataSource) GetApp(guid string) (*CFApp, error) {
+    var page v3AppList
+    if err := doV3Request(s.client, v3AppsPath+"&guids="+url.QueryEscape(guid), &page); err != nil {
+        return nil, err
+    }
+    apps := page.apps()
+    if len(apps) == 0 {
+        return nil, ErrAppNotFound
+    }
+    return apps[0], nil
+}
+
+func (s *v3AppMetadataSource) ListApps() ([]*CFApp, error) {
+    var apps []*CFApp
+    requestURL := v3AppsPath
+    for requestURL != "" {
+        var page v3AppList
+        if err := doV3Request(s.client, requestURL, &page); err != nil {
+            return nil, err
+        }
+        apps = append(apps, page.apps()...)
+
+        var err error
+        if requestURL, err = page.Pagination.nextPage(); err != nil {
+            return nil, err
+        }
+    }
+    return apps, nil
+}
+
+// Joins the apps on the page with their included spaces and orgs
+func (l *v3AppList) apps() []*CFApp {
+    spacesByGUID := make(map[string]*v3Space, len(l.Included.Spaces))
+    for i := range l.Included.Spaces {
+        spacesByGUID[l.Included.Spaces[i].Guid] = &l.Included.Spaces[i]
+    }
+    orgsByGUID := make(map[string]*v3Org, len(l.Included.Organizations))
+    for i := range l.Included.Organizations {
+        orgsByGUID[l.Included.Organizations[i].Guid] = &l.Included.Organizations[i]
+    }
+
+    apps := make([]*CFApp, 0, len(l.Resources))
+    for _, resource := range l.Resources {
+        app := &CFApp{
+            Guid: resource.Guid,
+            Name: resource.Name,
+            State: resource.State,
+            Buildpack: strings.Join(resource.Lifecycle.Data.Buildpacks, ","),
+            Stack: resource.Lifecycle.Data.Stack,
+            SpaceGuid: resource.Relationships.Space.Data.Guid,
+            Metadata: resource.Metadata,
+        }
+        if space := spacesByGUID[app.SpaceGuid]; space != nil {
+            app.SpaceName = space.Name
+            app.SpaceMetadata = space.Metadata
+            app.OrgGuid = space.Relationships.Organization.Data.Guid
+        }
+        if org := orgsByGUID[app.OrgGuid]; org != nil {
+            app.OrgName = org.Name
+            app.OrgMetadata = org.Metadata
+        }
+        apps = append(apps, app)
+    }
+    return apps
+}
@@ -0,0 +1,166 @@
+package metrics_test
+
+
+import (
+    "github.com/cloudfoundry-community/go-cfclient"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+    . "github.com/signalfx/signalfx-cloudfoundry-bridge/testhelpers"
+
+	"github.com/signalfx/signalfx-cloudfoundry-bridge/metrics"
+)
+
+
+var _ = Describe("AppMetadataSource", func() {
+    var fakeCloudController *FakeCloudController
+    var cloudfoundryClient *cfclient.Client
+
+    BeforeEach(func() {
+        fakeCloudController = NewFakeCloudController()
+        fakeCloudController.Start()
+
+        var err error
+        cloudfoundryClient, err = cfclient.NewClient(&cfclient.Config{
+            ApiAddress: fakeCloudController.URL(),
+            Token: "testing",
+            SkipSslValidation: true,
+        })
+        if err != nil {
+            Fail("Could not setup CF client!")
+        }
+
+        fakeCloudController.AddOrg("org-1", "myorg")
+        fakeCloudController.AddSpace("space-1", "myspace", "org-1")
+        fakeCloudController.AddStack("stack-1", "cflinuxfs3")
+        fakeCloudController.AddApp("app-1", "myapp", "space-1")
+        fakeCloudController.SetAppField("app-1", "buildpack", "java_buildpack")
+        fakeCloudController.SetAppField("app-1", "stack_guid", "stack-1")
+        fakeCloudController.SetLabels("app-1", map[string]string{"team": "payments"}, nil)
+        fakeCloudController.SetLabels("space-1", map[string]string{"tier": "prod"}, nil)
+        fakeCloudController.SetLabels("org-1", nil, map[string]string{"contact": "ops@example.com"})
+    })
+
+    AfterEach(func() {
+        fakeCloudController.Close()
+    })
+
+    expectMyApp := func(app *metrics.CFApp) {
+        Expect(app.Guid).To(Equal("app-1"))
+        Expect(app.Name).To(Equal("myapp"))
+        Expect(app.State).To(Equal("STARTED"))
+        Expect(app.Buildpack).To(Equal("java_buildpack"))
+        Expect(app.Stack).To(Equal("cflinuxfs3"))
+        Expect(app.SpaceGuid).To(Equal("space-1"))
+        Expect(app.SpaceName).To(Equal("myspace"))
+        Expect(app.OrgGuid).To(Equal("org-1"))
+        Expect(app.OrgName).To(Equal("myorg"))
+    }
+
+    Context("with the v3 API", func() {
+        var source metrics.AppMetadataSource
+
+        BeforeEach(func() {
+            var err error
+            source, err = metrics.NewAppMetadataSource(cloudfoundryClient, "v3", false)
+            Expect(err).NotTo(HaveOccurred())
+        })
+
+        It("gets the app with its space and org in one request", func() {
+            app, err := source.GetApp("app-1")
+            Expect(err).NotTo(HaveOccurred())
+            expectMyApp(app)
+            Expect(app.Metadata.Labels).To(Equal(map[string]string{"team": "payments"}))
+            Expect(app.SpaceMetadata.Labels).To(Equal(map[string]string{"tier": "prod"}))
+            Expect(app.OrgMetadata.Annotations).To(Equal(map[string]string{"contact": "ops@example.com"}))
+
+            Expect(fakeCloudController.ListRequestCount("/v3/apps")).To(Equal(1))
+            Expect(fakeCloudController.ListRequestCount("/v3/spaces/space-1")).To(Equal(0))
+            Expect(fakeCloudController.ListRequestCount("/v3/organizations/org-1")).To(Equal(0))
+        })
+
+        It("returns ErrAppNotFound for apps that don't exist", func() {
+            fakeCloudController.SetAppMissing("deleted-app")
+            _, err := source.GetApp("deleted-app")
+            Expect(err).To(Equal(metrics.ErrAppNotFound))
+        })
+
+        It("returns other errors when the CF API fails", func() {
+            fakeCloudController.SetErrorStatus(500)
+            _, err := source.GetApp("app-1")
+            Expect(err).To(HaveOccurred())
+            Expect(err).NotTo(Equal(metrics.ErrAppNotFound))
+        })
+
+        It("lists every app with its space and org", func() {
+            fakeCloudController.AddOrg("org-2", "otherorg")
+            fakeCloudController.AddSpace("space-2", "otherspace", "org-2")
+            fakeCloudController.AddApp("app-2", "otherapp", "space-2")
+
+            apps, err := source.ListApps()
+            Expect(err).NotTo(HaveOccurred())
+            Expect(apps).To(HaveLen(2))
+            expectMyApp(apps[0])
+            Expect(apps[1].Name).To(Equal("otherapp"))
+            Expect(apps[1].SpaceName).To(Equal("otherspace"))
+            Expect(apps[1].OrgName).To(Equal("otherorg"))
+
+            Expect(fakeCloudController.ListRequestCount("/v2/apps")).To(Equal(0))
+        })
+    })
+
+    Context("with the v2 API", func() {
+        var source metrics.AppMetadataSource
+
+        BeforeEach(func() {
+            var err error
+            source, err = metrics.NewAppMetadataSource(cloudfoundryClient, "v2", false)
+            Expect(err).NotTo(HaveOccurred())
+        })
+
+        It("gets the same app as the v3 API", func() {
+            app, err := source.GetApp("app-1")
+            Expect(err).NotTo(HaveOccurred())
+            expectMyApp(app)
+
+            apps, err := source.ListApps()
+            Expect(err).NotTo(HaveOccurred())
+            Expect(apps).To(HaveLen(1))
+            expectMyApp(apps[0])
+        })
+
+        It("returns ErrAppNotFound for apps that don't exist", func() {
+            fakeCloudController.SetAppMissing("deleted-app")
+            _, err := source.GetApp("deleted-app")
+            Expect(err).To(Equal(metrics.ErrAppNotFound))
+        })
+    })
+
+    Context("when detecting the API version", func() {
+        It("uses the v3 API if the Cloud Controller has it", func() {
+            source, err := metrics.NewAppMetadataSource(cloudfoundryClient, "auto", false)
+            Expect(err).NotTo(HaveOccurred())
+
+            _, err = source.GetApp("app-1")
+            Expect(err).NotTo(HaveOccurred())
+            Expect(fakeCloudController.ListRequestCount("/v3/apps")).To(Equal(1))
+        })
+
+        It("uses the v2 API otherwise", func() {
+            fakeCloudController.SetV3Available(false)
+            source, err := metrics.NewAppMetadataSource(cloudfoundryClient, "auto", false)
+            Expect(err).NotTo(HaveOccurred())
+
+            app, err := source.GetApp("app-1")
+            Expect(err).NotTo(HaveOccurred())
+            expectMyApp(app)
+            Expect(fakeCloudController.AppRequestCount("app-1")).To(Equal(1))
+            Expect(fakeCloudController.ListRequestCount("/v3/apps")).To(Equal(0))
+        })
+
+        It("rejects unknown versions", func() {
+            _, err := metrics.NewAppMetadataSource(cloudfoundryClient, "v4", false)
+            Expect(err).To(HaveOccurred())
+        })
+    })
+})
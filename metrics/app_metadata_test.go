@@ -2,7 +2,12 @@ package metrics_test
 
 
 import (
+    "fmt"
+    "sync"
+    "time"
+
     "github.com/cloudfoundry-community/go-cfclient"
+    "github.com/signalfx/golib/v3/datapoint"
 
     . "github.com/onsi/ginkgo"
     . "github.com/onsi/gomega"
@@ -14,13 +19,31 @@ import (
 
 var _ = Describe("AppMetadataFetcher", func() {
     var fakeCloudController *FakeCloudController
+    var cloudfoundryClient *cfclient.Client
     var metadataFetcher *metrics.AppMetadataFetcher
+    var stopMetadataFetcher func() error
+
+    newFetcher := func(apiVersion string, withLabels bool) *metrics.AppMetadataFetcher {
+        source, err := metrics.NewAppMetadataSource(cloudfoundryClient, apiVersion, withLabels)
+        Expect(err).NotTo(HaveOccurred())
+        return metrics.NewAppMetadataFetcher(source)
+    }
+
+    selfMetric := func(name string) int64 {
+        for _, dp := range metadataFetcher.Datapoints() {
+            if dp.Metric == name {
+                return dp.Value.(datapoint.IntValue).Int()
+            }
+        }
+        return -1
+    }
 
     BeforeEach(func() {
         fakeCloudController = NewFakeCloudController()
         fakeCloudController.Start()
 
-        cloudfoundryClient, err := cfclient.NewClient(&cfclient.Config{
+        var err error
+        cloudfoundryClient, err = cfclient.NewClient(&cfclient.Config{
             ApiAddress: fakeCloudController.URL(),
             Token: "testing",
             SkipSslValidation: true,
@@ -29,13 +52,428 @@ var _ = Describe("AppMetadataFetcher", func() {
             Fail("Could not setup CF client!")
         }
 
-        metadataFetcher = metrics.NewAppMetadataFetcher(cloudfoundryClient)
+        metadataFetcher = newFetcher("v2", false)
     })
 
     AfterEach(func() {
         fakeCloudController.Close()
     })
 
+    Context("when looking up apps in the background", func() {
+        BeforeEach(func() {
+            stopMetadataFetcher = RunInBackground(metadataFetcher)
+        })
+
+        AfterEach(func() {
+            stopMetadataFetcher()
+        })
+
+        It("doesn't wait for the Cloud Controller", func() {
+            fakeCloudController.SetResponseDelay(500 * time.Millisecond)
+            guid := "1234-abcd"
+
+            start := time.Now()
+            app, ok := metadataFetcher.CachedApp(guid)
+            Expect(time.Since(start)).To(BeNumerically("<", 100 * time.Millisecond))
+            Expect(ok).To(BeFalse())
+            Expect(app).To(BeNil())
+
+            Eventually(func() string {
+                app, _ := metadataFetcher.CachedApp(guid)
+                if app == nil {
+                    return ""
+                }
+                return app.Name
+            }).Should(Equal("app-1234-abcd"))
+        })
+
+        It("only looks up an app once at a time", func() {
+            fakeCloudController.SetResponseDelay(200 * time.Millisecond)
+            guid := "1234-abcd"
+
+            var wg sync.WaitGroup
+            for i := 0; i < 20; i++ {
+                wg.Add(1)
+                go func() {
+                    defer wg.Done()
+                    metadataFetcher.CachedApp(guid)
+                }()
+            }
+            wg.Wait()
+
+            Eventually(func() bool {
+                _, ok := metadataFetcher.CachedApp(guid)
+                return ok
+            }).Should(BeTrue())
+            Expect(fakeCloudController.AppRequestCount(guid)).To(Equal(1))
+        })
+
+        It("keeps using expired entries while they are looked up again", func() {
+            guid := "1234-abcd"
+            Eventually(func() bool {
+                _, ok := metadataFetcher.CachedApp(guid)
+                return ok
+            }).Should(BeTrue())
+
+            metadataFetcher.CacheExpirySeconds = 0
+            fakeCloudController.SetResponseDelay(500 * time.Millisecond)
+
+            app, ok := metadataFetcher.CachedApp(guid)
+            Expect(ok).To(BeTrue())
+            Expect(app.Name).To(Equal("app-1234-abcd"))
+            Eventually(func() int { return fakeCloudController.AppRequestCount(guid) }).Should(Equal(2))
+        })
+    })
+
+    Context("when refreshing all apps in bulk", func() {
+        BeforeEach(func() {
+            fakeCloudController.AddOrg("org-1", "myorg")
+            fakeCloudController.AddOrg("org-2", "otherorg")
+            fakeCloudController.AddSpace("space-1", "myspace", "org-1")
+            fakeCloudController.AddSpace("space-2", "otherspace", "org-2")
+            for i := 0; i < 250; i++ {
+                spaceGUID := "space-1"
+                if i % 2 == 1 {
+                    spaceGUID = "space-2"
+                }
+                fakeCloudController.AddApp(fmt.Sprintf("app-guid-%d", i), fmt.Sprintf("myapp%d", i), spaceGUID)
+            }
+
+            metadataFetcher.RefreshIntervalSeconds = 1
+            stopMetadataFetcher = RunInBackground(metadataFetcher)
+        })
+
+        AfterEach(func() {
+            stopMetadataFetcher()
+        })
+
+        It("fills the cache without looking up each app", func() {
+            Eventually(func() int64 {
+                return selfMetric("app_metadata.bulk_refreshes")
+            }).Should(BeNumerically(">=", 1))
+
+            app, ok := metadataFetcher.CachedApp("app-guid-3")
+            Expect(ok).To(BeTrue())
+            Expect(app.Name).To(Equal("myapp3"))
+            Expect(app.SpaceName).To(Equal("otherspace"))
+            Expect(app.OrgName).To(Equal("otherorg"))
+
+            Expect(metadataFetcher.GetAppNameForGUID("app-guid-0")).To(Equal("myapp0"))
+            Expect(metadataFetcher.GetSpaceNameForGUID("app-guid-0")).To(Equal("myspace"))
+            Expect(metadataFetcher.GetOrgNameForGUID("app-guid-0")).To(Equal("myorg"))
+
+            Expect(fakeCloudController.AppRequestCount("app-guid-3")).To(Equal(0))
+            Expect(fakeCloudController.AppRequestCount("app-guid-0")).To(Equal(0))
+        })
+
+        It("follows every page of results", func() {
+            Eventually(func() int {
+                return fakeCloudController.ListRequestCount("/v2/apps")
+            }).Should(BeNumerically(">=", 3))
+            Expect(fakeCloudController.ListRequestCount("/v2/spaces")).To(BeNumerically(">=", 1))
+            Expect(fakeCloudController.ListRequestCount("/v2/organizations")).To(BeNumerically(">=", 1))
+        })
+
+        It("picks up new apps on the next refresh", func() {
+            Eventually(func() int64 {
+                return selfMetric("app_metadata.bulk_refreshes")
+            }).Should(BeNumerically(">=", 1))
+
+            fakeCloudController.AddApp("new-app", "mynewapp", "space-1")
+            Eventually(func() int64 {
+                return selfMetric("app_metadata.bulk_refreshes")
+            }, 3).Should(BeNumerically(">=", 2))
+
+            Eventually(func() bool {
+                _, ok := metadataFetcher.CachedApp("new-app")
+                return ok
+            }).Should(BeTrue())
+            Expect(fakeCloudController.AppRequestCount("new-app")).To(Equal(0))
+        })
+
+        It("looks apps up one at a time again once refreshes keep failing", func() {
+            Eventually(func() int64 {
+                return selfMetric("app_metadata.bulk_refreshes")
+            }).Should(BeNumerically(">=", 1))
+
+            fakeCloudController.SetListErrorStatus(500)
+            fakeCloudController.SetAppField("app-guid-3", "name", "renamed")
+
+            Eventually(func() string {
+                app, _ := metadataFetcher.CachedApp("app-guid-3")
+                return app.Name
+            }, 6).Should(Equal("renamed"))
+            Expect(selfMetric("app_metadata.bulk_refresh_failures")).To(BeNumerically(">=", 2))
+            Expect(fakeCloudController.AppRequestCount("app-guid-3")).To(BeNumerically(">=", 1))
+        })
+
+        It("still looks up apps that aren't listed yet", func() {
+            Eventually(func() string {
+                app, _ := metadataFetcher.CachedApp("unlisted")
+                if app == nil {
+                    return ""
+                }
+                return app.Name
+            }).Should(Equal("app-unlisted"))
+            Expect(fakeCloudController.AppRequestCount("unlisted")).To(Equal(1))
+        })
+    })
+
+    Context("when lookups fail", func() {
+        BeforeEach(func() {
+            metadataFetcher.RetryBackoff = 200 * time.Millisecond
+            metadataFetcher.MaxRetryBackoff = time.Second
+            metadataFetcher.CircuitBreakerThreshold = 3
+            metadataFetcher.CircuitBreakerCooldown = 300 * time.Millisecond
+        })
+
+        It("backs off looking up apps that don't exist", func() {
+            guid := "deleted-app"
+            fakeCloudController.SetAppMissing(guid)
+
+            for i := 0; i < 3; i++ {
+                Expect(metadataFetcher.GetAppNameForGUID(guid)).To(Equal(""))
+            }
+            Expect(fakeCloudController.AppRequestCount(guid)).To(Equal(1))
+
+            time.Sleep(250 * time.Millisecond)
+            metadataFetcher.GetAppNameForGUID(guid)
+            metadataFetcher.GetAppNameForGUID(guid)
+            Expect(fakeCloudController.AppRequestCount(guid)).To(Equal(2))
+
+            By("Doubling the backoff each time")
+            time.Sleep(250 * time.Millisecond)
+            metadataFetcher.GetAppNameForGUID(guid)
+            Expect(fakeCloudController.AppRequestCount(guid)).To(Equal(2))
+            time.Sleep(200 * time.Millisecond)
+            metadataFetcher.GetAppNameForGUID(guid)
+            Expect(fakeCloudController.AppRequestCount(guid)).To(Equal(3))
+        })
+
+        It("doesn't treat apps that don't exist as the CF API failing", func() {
+            for i := 0; i < 10; i++ {
+                guid := fmt.Sprintf("deleted-app-%d", i)
+                fakeCloudController.SetAppMissing(guid)
+                metadataFetcher.GetAppNameForGUID(guid)
+                Expect(fakeCloudController.AppRequestCount(guid)).To(Equal(1))
+            }
+        })
+
+        It("stops looking up apps while the CF API is failing", func() {
+            fakeCloudController.SetErrorStatus(500)
+            for i := 0; i < 5; i++ {
+                metadataFetcher.GetAppNameForGUID(fmt.Sprintf("app-%d", i))
+            }
+            Expect(fakeCloudController.AppRequestCount("app-2")).To(Equal(1))
+            Expect(fakeCloudController.AppRequestCount("app-3")).To(Equal(0))
+            Expect(fakeCloudController.AppRequestCount("app-4")).To(Equal(0))
+            Expect(selfMetric("app_metadata.lookup_failures")).To(Equal(int64(3)))
+            Expect(selfMetric("app_metadata.lookups_skipped")).To(Equal(int64(2)))
+            Expect(selfMetric("app_metadata.circuit_open")).To(Equal(int64(1)))
+
+            By("Trying again after the cooldown")
+            fakeCloudController.SetErrorStatus(0)
+            time.Sleep(350 * time.Millisecond)
+            Expect(metadataFetcher.GetAppNameForGUID("app-3")).To(Equal("app-app-3"))
+            Expect(metadataFetcher.GetAppNameForGUID("app-4")).To(Equal("app-app-4"))
+            Expect(selfMetric("app_metadata.circuit_open")).To(Equal(int64(0)))
+        })
+
+        It("lets a single lookup through to probe the CF API after the cooldown", func() {
+            defer RunInBackground(metadataFetcher)()
+
+            fakeCloudController.SetErrorStatus(500)
+            for i := 0; i < 3; i++ {
+                metadataFetcher.GetAppNameForGUID(fmt.Sprintf("app-%d", i))
+            }
+            Expect(selfMetric("app_metadata.circuit_open")).To(Equal(int64(1)))
+
+            fakeCloudController.SetErrorStatus(0)
+            fakeCloudController.SetResponseDelay(300 * time.Millisecond)
+            time.Sleep(350 * time.Millisecond)
+
+            guids := []string{"app-3", "app-4", "app-5", "app-6", "app-7"}
+            requests := func() int {
+                total := 0
+                for _, guid := range guids {
+                    total += fakeCloudController.AppRequestCount(guid)
+                }
+                return total
+            }
+            for _, guid := range guids {
+                metadataFetcher.CachedApp(guid)
+            }
+            Eventually(requests).Should(Equal(1))
+            Consistently(requests, 0.2).Should(Equal(1))
+
+            By("Closing the circuit once the probe succeeds")
+            Eventually(func() int64 { return selfMetric("app_metadata.circuit_open") }).Should(Equal(int64(0)))
+            Eventually(func() int {
+                cached := 0
+                for _, guid := range guids {
+                    if _, ok := metadataFetcher.CachedApp(guid); ok {
+                        cached++
+                    }
+                }
+                return cached
+            }, 5).Should(Equal(len(guids)))
+        })
+
+        It("counts failed bulk refreshes towards opening the circuit", func() {
+            metadataFetcher.RefreshIntervalSeconds = 60
+            metadataFetcher.CircuitBreakerThreshold = 1
+            fakeCloudController.SetListErrorStatus(500)
+
+            defer RunInBackground(metadataFetcher)()
+
+            Eventually(func() int64 { return selfMetric("app_metadata.bulk_refresh_failures") }).Should(Equal(int64(1)))
+            Expect(selfMetric("app_metadata.circuit_open")).To(Equal(int64(1)))
+            metadataFetcher.CachedApp("app-0")
+            Consistently(func() int { return fakeCloudController.AppRequestCount("app-0") }, 0.2).Should(Equal(0))
+        })
+
+        It("doesn't queue background lookups while backing off", func() {
+            defer RunInBackground(metadataFetcher)()
+
+            guid := "deleted-app"
+            fakeCloudController.SetAppMissing(guid)
+            metadataFetcher.CachedApp(guid)
+            Eventually(func() int { return fakeCloudController.AppRequestCount(guid) }).Should(Equal(1))
+
+            for i := 0; i < 10; i++ {
+                _, ok := metadataFetcher.CachedApp(guid)
+                Expect(ok).To(BeFalse())
+            }
+            Consistently(func() int { return fakeCloudController.AppRequestCount(guid) }, 0.1).Should(Equal(1))
+        })
+    })
+
+    Context("when there are lots of apps", func() {
+        cacheSize := func() int64 {
+            return selfMetric("app_metadata.cache_size")
+        }
+
+        It("evicts the least recently used apps", func() {
+            metadataFetcher.SetMaxCacheSize(3)
+
+            metadataFetcher.GetAppNameForGUID("app-a")
+            metadataFetcher.GetAppNameForGUID("app-b")
+            metadataFetcher.GetAppNameForGUID("app-c")
+            metadataFetcher.GetAppNameForGUID("app-a")
+            metadataFetcher.GetAppNameForGUID("app-d")
+            Expect(cacheSize()).To(Equal(int64(3)))
+
+            metadataFetcher.GetAppNameForGUID("app-a")
+            Expect(fakeCloudController.AppRequestCount("app-a")).To(Equal(1))
+            metadataFetcher.GetAppNameForGUID("app-b")
+            Expect(fakeCloudController.AppRequestCount("app-b")).To(Equal(2))
+        })
+
+        It("removes apps that expired without being used", func() {
+            metadataFetcher.CacheExpirySeconds = 1
+            metadataFetcher.SweepInterval = 100 * time.Millisecond
+            defer RunInBackground(metadataFetcher)()
+
+            for i := 0; i < 10; i++ {
+                metadataFetcher.GetAppNameForGUID(fmt.Sprintf("app-%d", i))
+            }
+            Expect(cacheSize()).To(Equal(int64(10)))
+
+            // Keep one app in use after it expires, as if its metrics still
+            // came in
+            time.Sleep(1100 * time.Millisecond)
+            metadataFetcher.CachedApp("app-0")
+            Eventually(cacheSize, 2).Should(Equal(int64(1)))
+            Consistently(cacheSize, 0.3).Should(Equal(int64(1)))
+        })
+    })
+
+    Context("when including labels", func() {
+        var updates chan *metrics.CacheEntry
+
+        BeforeEach(func() {
+            fakeCloudController.AddOrg("org-1", "myorg")
+            fakeCloudController.AddSpace("space-1", "myspace", "org-1")
+            fakeCloudController.AddApp("app-1", "myapp", "space-1")
+            fakeCloudController.SetLabels("org-1", map[string]string{"cost-center": "cc-42", "team": "org-team"}, nil)
+            fakeCloudController.SetLabels("space-1", map[string]string{"tier": "prod", "team": "space-team"}, nil)
+            fakeCloudController.SetLabels("app-1",
+                map[string]string{"team": "payments", "example.com/owner": "alice", "unlisted": "x"},
+                map[string]string{"contact": "payments@example.com"})
+
+            metadataFetcher = newFetcher("v2", true)
+            metadataFetcher.Labels = metrics.LabelExtractor{
+                Labels: []string{"team", "tier", "cost-center", "example.com/owner", "missing"},
+                Annotations: []string{"contact"},
+                Prefix: "label_",
+            }
+
+            updates = make(chan *metrics.CacheEntry, 10)
+            metadataFetcher.AddUpdateListener(listenerFunc(func(cacheEntry *metrics.CacheEntry) {
+                updates <- cacheEntry
+            }))
+        })
+
+        expectedLabels := map[string]string{
+            "label_team": "payments",
+            "label_tier": "prod",
+            "label_cost-center": "cc-42",
+            "label_example_com_owner": "alice",
+            "label_contact": "payments@example.com",
+        }
+
+        It("looks up the labels of the app, its space and its org", func() {
+            Expect(metadataFetcher.GetAppNameForGUID("app-1")).To(Equal("myapp"))
+
+            var cacheEntry *metrics.CacheEntry
+            Eventually(updates).Should(Receive(&cacheEntry))
+            Expect(cacheEntry.Labels).To(Equal(expectedLabels))
+
+            By("Caching the space and org labels")
+            metadataFetcher.CacheExpirySeconds = 100
+            fakeCloudController.AddApp("app-2", "myotherapp", "space-1")
+            metadataFetcher.GetAppNameForGUID("app-2")
+            Eventually(updates).Should(Receive(&cacheEntry))
+            Expect(cacheEntry.Labels).To(Equal(map[string]string{
+                "label_team": "space-team",
+                "label_tier": "prod",
+                "label_cost-center": "cc-42",
+            }))
+            Expect(fakeCloudController.ListRequestCount("/v3/spaces/space-1")).To(Equal(1))
+            Expect(fakeCloudController.ListRequestCount("/v3/organizations/org-1")).To(Equal(1))
+        })
+
+        It("lists the labels of every app in bulk", func() {
+            metadataFetcher.RefreshIntervalSeconds = 60
+            defer RunInBackground(metadataFetcher)()
+
+            var cacheEntry *metrics.CacheEntry
+            Eventually(updates).Should(Receive(&cacheEntry))
+            Expect(cacheEntry.App.Name).To(Equal("myapp"))
+            Expect(cacheEntry.Labels).To(Equal(expectedLabels))
+
+            Expect(fakeCloudController.ListRequestCount("/v3/apps")).To(Equal(1))
+            Expect(fakeCloudController.ListRequestCount("/v3/apps/app-1")).To(Equal(0))
+        })
+
+        It("gets the labels along with the app from the v3 API", func() {
+            labels := metadataFetcher.Labels
+            metadataFetcher = newFetcher("v3", false)
+            metadataFetcher.Labels = labels
+            metadataFetcher.AddUpdateListener(listenerFunc(func(cacheEntry *metrics.CacheEntry) {
+                updates <- cacheEntry
+            }))
+
+            Expect(metadataFetcher.GetAppNameForGUID("app-1")).To(Equal("myapp"))
+
+            var cacheEntry *metrics.CacheEntry
+            Eventually(updates).Should(Receive(&cacheEntry))
+            Expect(cacheEntry.Labels).To(Equal(expectedLabels))
+            Expect(fakeCloudController.ListRequestCount("/v3/apps")).To(Equal(1))
+            Expect(fakeCloudController.ListRequestCount("/v3/spaces/space-1")).To(Equal(0))
+        })
+    })
+
     It("Caches data until expiry", func() {
         metadataFetcher.CacheExpirySeconds = 100
         guid := "1234-abcd"
@@ -54,3 +492,9 @@ var _ = Describe("AppMetadataFetcher", func() {
         Expect(fakeCloudController.AppReqCounts[guid]).To(Equal(3))
     })
 })
+
+type listenerFunc func(cacheEntry *metrics.CacheEntry)
+
+func (f listenerFunc) AppUpdated(cacheEntry *metrics.CacheEntry) {
+    f(cacheEntry)
+}
@@ -1,6 +1,7 @@
 package metrics
 
 import (
+    "context"
     "crypto/tls"
     "io/ioutil"
     "encoding/json"
@@ -104,8 +105,8 @@ func GetBoshUAAUrl(boshUrl string, skipSSLVerify bool) string {
     return info.UserAuthentication.Options.URL
 }
 
-func (o *BoshClient) NewGetRequest(path string) *http.Request {
-    req, err := http.NewRequest("GET", o.baseURL + path, nil)
+func (o *BoshClient) NewGetRequest(ctx context.Context, path string) *http.Request {
+    req, err := http.NewRequestWithContext(ctx, "GET", o.baseURL + path, nil)
     if err != nil {
         log.Panic("Something is wrong with the BOSHClient config: ", err)
     }
@@ -158,8 +159,8 @@ func (o *BoshClient) doRequest(req *http.Request, expectedStatus int) ([]byte, *
     return bodyText, resp
 }
 
-func (o *BoshClient) fetchDeployments() []Deployment {
-    respText, _ := o.doRequest(o.NewGetRequest("/deployments"), 200)
+func (o *BoshClient) fetchDeployments(ctx context.Context) []Deployment {
+    respText, _ := o.doRequest(o.NewGetRequest(ctx, "/deployments"), 200)
 
     if len(respText) == 0 {
         // Errors would have been logged in the doRequest method
@@ -178,15 +179,19 @@ func (o *BoshClient) fetchDeployments() []Deployment {
 
 // This is a long-running task so it's a bit more complex to handle.  The
 // polling method seems simplest even if not very efficient.
-func (o *BoshClient) fetchVMs(deploymentName string) []BoshVM {
-    _, resp := o.doRequest(o.NewGetRequest("/deployments/" + deploymentName + "/vms?format=full"), 302)
+func (o *BoshClient) fetchVMs(ctx context.Context, deploymentName string) []BoshVM {
+    _, resp := o.doRequest(o.NewGetRequest(ctx, "/deployments/" + deploymentName + "/vms?format=full"), 302)
+    if resp == nil {
+        // The error was logged in doRequest, e.g. if ctx was canceled
+        return nil
+    }
 
     taskUrlStr := resp.Header.Get("Location")
     if len(taskUrlStr) == 0 {
         return nil
     }
 
-    taskOutput := o.waitForTask(taskUrlStr)
+    taskOutput := o.waitForTask(ctx, taskUrlStr)
 
     vms := make([]BoshVM, 0, 10)
     for _, vmJson := range strings.Split(string(taskOutput), "\n") {
@@ -206,7 +211,7 @@ func (o *BoshClient) fetchVMs(deploymentName string) []BoshVM {
 }
 
 // taskUrlStr is like "https://bosh.dev/tasks/1234"
-func (o *BoshClient) waitForTask(taskUrlStr string) []byte {
+func (o *BoshClient) waitForTask(ctx context.Context, taskUrlStr string) []byte {
     waitStart := time.Now()
     for {
         taskUrl, err := url.Parse(taskUrlStr)
@@ -215,7 +220,7 @@ func (o *BoshClient) waitForTask(taskUrlStr string) []byte {
             return nil
         }
 
-        taskText, _ := o.doRequest(o.NewGetRequest(taskUrl.Path), 200)
+        taskText, _ := o.doRequest(o.NewGetRequest(ctx, taskUrl.Path), 200)
 
         task := BoshTask{}
         err = json.Unmarshal(taskText, &task)
@@ -225,14 +230,19 @@ func (o *BoshClient) waitForTask(taskUrlStr string) []byte {
         }
 
         if task.State == "done" {
-            outputText, _ := o.doRequest(o.NewGetRequest(taskUrl.Path + "/output?type=result"), 200)
+            outputText, _ := o.doRequest(o.NewGetRequest(ctx, taskUrl.Path + "/output?type=result"), 200)
             return outputText
         } else if waitStart.Add(time.Duration(o.VMFetchTaskTimeoutSeconds) * time.Second).Before(time.Now()) {
             log.Printf("Could not fetch VM stats from BOSH within %d seconds, try increasing timeout",
                        o.VMFetchTaskTimeoutSeconds)
             return nil
-        } else {
-            time.Sleep(500 * time.Millisecond)
+        }
+
+        select {
+        case <-ctx.Done():
+            log.Printf("Gave up waiting for BOSH task %s: %v", taskUrlStr, ctx.Err())
+            return nil
+        case <-time.After(500 * time.Millisecond):
         }
     }
 }
@@ -1,9 +1,14 @@
 package metrics
 
 import (
+    "context"
     "log"
+    "sync/atomic"
     "time"
     //"github.com/davecgh/go-spew/spew"
+
+    "github.com/signalfx/golib/v3/datapoint"
+    "github.com/signalfx/golib/v3/sfxclient"
 )
 
 
@@ -15,6 +20,8 @@ type BoshMetadataFetcher struct {
     CacheExpirySeconds  int
     // Golang's version of a set
     vmsNotFound         map[string]bool
+    // Self-metric, see `Datapoints`
+    vmCacheRefreshes    int64
 }
 
 const defaultBoshCacheExpirySeconds = 180
@@ -30,8 +37,8 @@ func NewBoshMetadataFetcher(boshClient *BoshClient) *BoshMetadataFetcher {
 }
 
 // This just returns the first ip address given by BOSH
-func (o *BoshMetadataFetcher) GetVMIPAddress(deploymentName, vmId string) string {
-    vm := o.getVM(deploymentName, vmId)
+func (o *BoshMetadataFetcher) GetVMIPAddress(ctx context.Context, deploymentName, vmId string) string {
+    vm := o.getVM(ctx, deploymentName, vmId)
     if vm == nil || len(vm.Ips) == 0 {
         return ""
     }
@@ -39,26 +46,34 @@ func (o *BoshMetadataFetcher) GetVMIPAddress(deploymentName, vmId string) string
     return vm.Ips[0]
 }
 
-func (o *BoshMetadataFetcher) refreshVMCacheFor(deploymentName string) {
+func (o *BoshMetadataFetcher) refreshVMCacheFor(ctx context.Context, deploymentName string) {
     log.Print("Refreshing BOSH VM cache for ", deploymentName)
-    vms := o.client.fetchVMs(deploymentName)
+    vms := o.client.fetchVMs(ctx, deploymentName)
     // Use index since the value will be a copy of the pointed value and not
     // the value via the original pointer
     for i := range vms {
         o.vmCache[vms[i].Id] = &vms[i]
     }
     o.vmCacheLastUpdate[deploymentName] = time.Now()
+    atomic.AddInt64(&o.vmCacheRefreshes, 1)
+}
+
+// Satisfies the sfxclient.Collector interface
+func (o *BoshMetadataFetcher) Datapoints() []*datapoint.Datapoint {
+    return []*datapoint.Datapoint{
+        sfxclient.CumulativeP("bosh.vm_cache_refreshes", nil, &o.vmCacheRefreshes),
+    }
 }
 
-func (o *BoshMetadataFetcher) getVM(deploymentName, vmId string) *BoshVM {
+func (o *BoshMetadataFetcher) getVM(ctx context.Context, deploymentName, vmId string) *BoshVM {
     lastUpdate := o.vmCacheLastUpdate[deploymentName]
     if lastUpdate.IsZero() {
-        o.refreshVMCacheFor(deploymentName)
+        o.refreshVMCacheFor(ctx, deploymentName)
     } else {
         expiryTime := lastUpdate.Add(time.Duration(o.CacheExpirySeconds) * time.Second)
         if expiryTime.Before(time.Now()) {
             log.Print("Expiring BOSH vm cache for deployment: ", deploymentName)
-            o.refreshVMCacheFor(deploymentName)
+            o.refreshVMCacheFor(ctx, deploymentName)
         }
     }
 
@@ -72,8 +87,8 @@ func (o *BoshMetadataFetcher) getVM(deploymentName, vmId string) *BoshVM {
             log.Printf("VM '%s' not found in cache, refetching...", vmId)
             o.vmsNotFound[vmId] = true
 
-            o.refreshVMCacheFor(deploymentName)
-            return o.getVM(deploymentName, vmId)
+            o.refreshVMCacheFor(ctx, deploymentName)
+            return o.getVM(ctx, deploymentName, vmId)
         }
     } else {
         delete(o.vmsNotFound, vmId)
@@ -2,12 +2,25 @@ package metrics
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/caarlos0/env"
+	"github.com/cloudfoundry/sonde-go/events"
+	"gopkg.in/yaml.v2"
 )
 
+// Settings are read from environment variables named by the `env` tags, and
+// optionally from a YAML config file.  The keys in the file are the lowercase
+// names of the environment variables, unless there is a `yaml` tag, and lists
+// can be given as YAML sequences instead of separated strings.  Environment
+// variables take precedence over the file, which takes precedence over the
+// `envDefault` tags.
+
 type Config struct {
 	CloudFoundryApiURL    string `env:"CLOUDFOUNDRY_API_URL,required"`
 	CFUAAURL              string `env:"CF_UAA_URL,required"`
@@ -16,9 +29,21 @@ type Config struct {
 	InsecureSSLSkipVerify bool   `env:"INSECURE_SSL_SKIP_VERIFY" envDefault:"false"`
 	EnableTSDBServer      bool   `env:"ENABLE_TSDB_SERVER" envDefault:"true"`
 
-	BoshDirectorURL string `env:"BOSH_DIRECTOR_URL,required"`
-	BoshUsername    string `env:"BOSH_CLIENT_ID,required"`
-	BoshPassword    string `env:"BOSH_CLIENT_SECRET,required"`
+	// Only needed for the TSDB server, see Validate
+	BoshDirectorURL string `env:"BOSH_DIRECTOR_URL"`
+	BoshUsername    string `env:"BOSH_CLIENT_ID"`
+	BoshPassword    string `env:"BOSH_CLIENT_SECRET"`
+
+	// Where the TSDB server listens.  All interfaces if the address is empty.
+	TSDBListenAddress string `env:"TSDB_LISTEN_ADDRESS" envDefault:""`
+	TSDBPort          int    `env:"TSDB_PORT" envDefault:"13321"`
+	// The port of the TSDB server's HTTP /api/put endpoint, disabled if 0
+	TSDBHTTPPort int `env:"TSDB_HTTP_PORT" envDefault:"0"`
+	// Both ports use TLS if a cert and key are given, and require client
+	// certs signed by the CA if one is given too
+	TSDBTLSCertFile     string `env:"TSDB_TLS_CERT_FILE"`
+	TSDBTLSKeyFile      string `env:"TSDB_TLS_KEY_FILE"`
+	TSDBTLSClientCAFile string `env:"TSDB_TLS_CLIENT_CA_FILE"`
 
 	// This will be populated automatically in the main package if not supplied
 	TrafficControllerURL          string   `env:"TRAFFIC_CONTROLLER_URL" envDefault:""`
@@ -29,25 +54,403 @@ type Config struct {
 	DeploymentsToInclude          []string `env:"DEPLOYMENTS_TO_INCLUDE" envDefault:"" envSeparator:";"`
 	MetricsToExclude              []string `env:"METRICS_TO_EXCLUDE" envDefault:"" envSeparator:";"`
 
+	// Firehose event types to drop before they are turned into datapoints,
+	// e.g. LogMessage or HttpStartStop
+	EventTypesToExclude []string `env:"EVENT_TYPES_TO_EXCLUDE" envDefault:"" envSeparator:";"`
+
+	// Ordered include/exclude rules applied after the above, which can only
+	// be given in the config file
+	MetricRules []MetricRule `yaml:"metric_rules"`
+
+	// Ordered rules that rewrite metric names, which can only be given in the
+	// config file.  Defaults to stripping the bosh-hm-forwarder. prefix.
+	MetricNameRules []MetricNameRule `yaml:"metric_name_rules"`
+
+	// Whether to reconnect when the Firehose says we are falling behind, at
+	// most once per interval, which is unlimited if 0
+	FirehoseReconnectOnSlowConsumer              bool `env:"FIREHOSE_RECONNECT_ON_SLOW_CONSUMER" envDefault:"false"`
+	FirehoseSlowConsumerReconnectIntervalSeconds int  `env:"FIREHOSE_SLOW_CONSUMER_RECONNECT_INTERVAL_SECONDS" envDefault:"300"`
+
+	// Which CF API to get app metadata from, v2, v3 or auto to use v3 if the
+	// Cloud Controller has it
+	CFAPIVersion string `env:"CF_API_VERSION" envDefault:"auto"`
+
 	AppMetadataCacheExpirySeconds int `env:"APP_METADATA_CACHE_EXPIRY_SECONDS" envDefault:"300"`
+	AppMetadataLookupWorkers      int `env:"APP_METADATA_LOOKUP_WORKERS" envDefault:"4"`
+
+	// How often to list all apps from the CF API, 0 to only look them up
+	// one at a time
+	AppMetadataRefreshIntervalSeconds int `env:"APP_METADATA_REFRESH_INTERVAL_SECONDS" envDefault:"300"`
+
+	// The most apps to cache metadata for, 0 for no limit
+	AppMetadataCacheMaxSize int `env:"APP_METADATA_CACHE_MAX_SIZE" envDefault:"50000"`
+
+	// Send the app name, space, org etc. as properties of the app_id
+	// dimension instead of as dimensions of every datapoint
+	AppMetadataAsProperties bool `env:"APP_METADATA_AS_PROPERTIES" envDefault:"false"`
+
+	// CF v3 metadata labels and annotations of apps, spaces and orgs to send
+	// along with the app name, e.g. team, with the given prefix
+	AppLabelsToInclude      []string `env:"APP_LABELS_TO_INCLUDE" envDefault:"" envSeparator:";"`
+	AppAnnotationsToInclude []string `env:"APP_ANNOTATIONS_TO_INCLUDE" envDefault:"" envSeparator:";"`
+	AppLabelPrefix          string   `env:"APP_LABEL_PREFIX" envDefault:""`
+
+	// The enrichers that add dimensions to datapoints, in the order they run,
+	// see enrichment.go
+	Enrichers []string `env:"ENRICHERS" envDefault:"app_metadata;bosh_vm" envSeparator:";"`
+	// The file the csv enricher reads, see csv_enricher.go
+	CSVEnrichmentFile string `env:"CSV_ENRICHMENT_FILE" envDefault:""`
+
+	// Dimensions added to every datapoint, e.g. "foundation=prod-east;env=prod"
+	ExtraDimensions []string `env:"EXTRA_DIMENSIONS" envDefault:"" envSeparator:";"`
+	// Dimensions to rename, e.g. "host=ip", and to remove from every datapoint
+	DimensionsToRename []string `env:"DIMENSIONS_TO_RENAME" envDefault:"" envSeparator:";"`
+	DimensionsToDrop   []string `env:"DIMENSIONS_TO_DROP" envDefault:"" envSeparator:";"`
 
 	SignalFxIngestURL   string `env:"SIGNALFX_INGEST_URL"`
 	SignalFxAccessToken string `env:"SIGNALFX_ACCESS_TOKEN,required"`
+
+	// Where dimension properties are sent, defaults to https://api.signalfx.com
+	SignalFxAPIURL string `env:"SIGNALFX_API_URL"`
+
+	// Datapoints that fail to send are spooled here and retried if set
+	SpoolDir           string `env:"SPOOL_DIR" envDefault:""`
+	SpoolMaxMegabytes  int    `env:"SPOOL_MAX_MEGABYTES" envDefault:"100"`
+	SpoolMaxAgeSeconds int    `env:"SPOOL_MAX_AGE_SECONDS" envDefault:"3600"`
+
+	// How often to report the bridge's own metrics, 0 to disable
+	SelfMetricsIntervalSeconds int `env:"SELF_METRICS_INTERVAL_SECONDS" envDefault:"10"`
+
+	// How long to wait for buffered datapoints to be sent on SIGTERM
+	ShutdownTimeoutSeconds int `env:"SHUTDOWN_TIMEOUT_SECONDS" envDefault:"10"`
+
+	// Identifies this instance of the bridge when several of them share a
+	// Firehose subscription.  Defaults to the CF instance index or hostname.
+	InstanceID string `env:"BRIDGE_INSTANCE_ID"`
 }
 
 func GetConfigFromEnv() (*Config, error) {
+	return GetConfig("")
+}
+
+// Loads the config from the YAML file at path, if not empty, and the
+// environment
+func GetConfig(path string) (*Config, error) {
+	fileValues := make(map[string]interface{})
+	if path != "" {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read config file: %v", err)
+		}
+		if err := yaml.Unmarshal(contents, &fileValues); err != nil {
+			return nil, fmt.Errorf("could not parse config file %s: %v", path, err)
+		}
+	}
+
 	cfg := Config{}
-	err := env.Parse(&cfg)
+	v := reflect.ValueOf(&cfg).Elem()
+
+	var missing []string
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		envName, required := parseEnvTag(field.Tag.Get("env"))
+		key := configFileKey(field, envName)
+		if envName == "" && key == "" {
+			continue
+		}
+
+		var err error
+		fileValue, inFile := fileValues[key]
+		delete(fileValues, key)
+
+		envValue, inEnv := "", false
+		if envName != "" {
+			envValue, inEnv = os.LookupEnv(envName)
+		}
+
+		// A variable that is set but empty still overrides the file,
+		// resetting the setting to its default, e.g. to clear a list
+		if envValue != "" {
+			err = setFromString(v.Field(i), field, envValue)
+		} else if inFile && !inEnv {
+			err = setFromYAML(v.Field(i), fileValue)
+		} else if defaultValue := field.Tag.Get("envDefault"); defaultValue != "" {
+			err = setFromString(v.Field(i), field, defaultValue)
+		}
+		if err != nil {
+			return &cfg, fmt.Errorf("invalid value for %s: %v", settingName(envName, key), err)
+		}
+
+		if required && isZero(v.Field(i)) {
+			missing = append(missing, settingName(envName, key))
+		}
+	}
+
+	// Catch typos in the file rather than silently using the default
+	for key := range fileValues {
+		return &cfg, fmt.Errorf("unknown setting %q in config file %s", key, path)
+	}
+
+	if len(missing) > 0 {
+		return &cfg, fmt.Errorf("required settings are not set: %s", strings.Join(missing, ", "))
+	}
+
+	if cfg.InstanceID == "" {
+		cfg.InstanceID = defaultInstanceID()
+	}
+
+	return &cfg, nil
+}
+
+// Problems found by Validate, reported together so that they can all be fixed
+// at once
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return fmt.Sprintf("%d problem(s) with the config:\n  - %s", len(e), strings.Join(e, "\n  - "))
+}
+
+// Checks for values that would otherwise only fail once the bridge is
+// running, such as a zero flush interval or a malformed URL.  Settings that
+// are only used when another is enabled are only checked in that case.
+func (cfg *Config) Validate() error {
+	var problems ConfigErrors
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	checkURL := func(name, value string, schemes ...string) {
+		u, err := url.Parse(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s is not a valid URL: %v", name, err))
+			return
+		}
+		for _, scheme := range schemes {
+			if u.Scheme == scheme && u.Host != "" {
+				return
+			}
+		}
+		problems = append(problems, fmt.Sprintf("%s must be a %s URL with a host, got %q",
+			name, strings.Join(schemes, " or "), value))
+	}
+
+	checkURL("CLOUDFOUNDRY_API_URL", cfg.CloudFoundryApiURL, "http", "https")
+	checkURL("CF_UAA_URL", cfg.CFUAAURL, "http", "https")
+	if cfg.TrafficControllerURL != "" {
+		checkURL("TRAFFIC_CONTROLLER_URL", cfg.TrafficControllerURL, "ws", "wss")
+	}
+	if cfg.SignalFxIngestURL != "" {
+		checkURL("SIGNALFX_INGEST_URL", cfg.SignalFxIngestURL, "http", "https")
+	}
+	if cfg.SignalFxAPIURL != "" {
+		checkURL("SIGNALFX_API_URL", cfg.SignalFxAPIURL, "http", "https")
+	}
+
+	if cfg.EnableTSDBServer {
+		check(cfg.BoshDirectorURL != "" && cfg.BoshUsername != "" && cfg.BoshPassword != "",
+			"BOSH_DIRECTOR_URL, BOSH_CLIENT_ID and BOSH_CLIENT_SECRET are required when ENABLE_TSDB_SERVER is true")
+		if cfg.BoshDirectorURL != "" {
+			checkURL("BOSH_DIRECTOR_URL", cfg.BoshDirectorURL, "http", "https")
+		}
+		check(cfg.TSDBPort > 0 && cfg.TSDBPort <= 65535,
+			"TSDB_PORT must be between 1 and 65535, got %d", cfg.TSDBPort)
+		check(cfg.TSDBHTTPPort >= 0 && cfg.TSDBHTTPPort <= 65535,
+			"TSDB_HTTP_PORT must be between 0 and 65535, got %d", cfg.TSDBHTTPPort)
+		check(cfg.TSDBHTTPPort != cfg.TSDBPort,
+			"TSDB_HTTP_PORT must be different from TSDB_PORT, both are %d", cfg.TSDBPort)
+		check((cfg.TSDBTLSCertFile == "") == (cfg.TSDBTLSKeyFile == ""),
+			"TSDB_TLS_CERT_FILE and TSDB_TLS_KEY_FILE must be set together")
+		check(cfg.TSDBTLSClientCAFile == "" || cfg.TSDBTLSCertFile != "",
+			"TSDB_TLS_CLIENT_CA_FILE needs TSDB_TLS_CERT_FILE and TSDB_TLS_KEY_FILE")
+	}
+
+	check(cfg.FlushIntervalSeconds > 0,
+		"FLUSH_INTERVAL_SECONDS must be at least 1, got %d", cfg.FlushIntervalSeconds)
+	check(cfg.FirehoseIdleTimeoutSeconds >= 0,
+		"FIREHOSE_IDLE_TIMEOUT_SECONDS must not be negative, got %d", cfg.FirehoseIdleTimeoutSeconds)
+	check(cfg.FirehoseReconnectDelaySeconds >= 0,
+		"FIREHOSE_RECONNECT_DELAY_SECONDS must not be negative, got %d", cfg.FirehoseReconnectDelaySeconds)
+	check(cfg.FirehoseSlowConsumerReconnectIntervalSeconds >= 0,
+		"FIREHOSE_SLOW_CONSUMER_RECONNECT_INTERVAL_SECONDS must not be negative, got %d",
+		cfg.FirehoseSlowConsumerReconnectIntervalSeconds)
+	check(cfg.CFAPIVersion == "auto" || cfg.CFAPIVersion == "v2" || cfg.CFAPIVersion == "v3",
+		"CF_API_VERSION must be auto, v2 or v3, got %q", cfg.CFAPIVersion)
+	check(cfg.AppMetadataCacheExpirySeconds >= 0,
+		"APP_METADATA_CACHE_EXPIRY_SECONDS must not be negative, got %d", cfg.AppMetadataCacheExpirySeconds)
+	check(cfg.AppMetadataLookupWorkers > 0,
+		"APP_METADATA_LOOKUP_WORKERS must be at least 1, got %d", cfg.AppMetadataLookupWorkers)
+	check(cfg.AppMetadataRefreshIntervalSeconds >= 0,
+		"APP_METADATA_REFRESH_INTERVAL_SECONDS must not be negative, got %d", cfg.AppMetadataRefreshIntervalSeconds)
+	check(cfg.AppMetadataCacheMaxSize >= 0,
+		"APP_METADATA_CACHE_MAX_SIZE must not be negative, got %d", cfg.AppMetadataCacheMaxSize)
+	check(cfg.SelfMetricsIntervalSeconds >= 0,
+		"SELF_METRICS_INTERVAL_SECONDS must not be negative, got %d", cfg.SelfMetricsIntervalSeconds)
+	check(cfg.ShutdownTimeoutSeconds > 0,
+		"SHUTDOWN_TIMEOUT_SECONDS must be at least 1, got %d", cfg.ShutdownTimeoutSeconds)
+
+	// Otherwise a label like job=web would replace the job dimension
+	labels := LabelExtractor{Prefix: cfg.AppLabelPrefix}
+	checkLabels := func(setting string, keys []string) {
+		for _, key := range keys {
+			name := labels.dimensionName(key)
+			check(!reservedDimensionNames[name],
+				"%s has %q, which would replace the %s dimension, use APP_LABEL_PREFIX", setting, key, name)
+		}
+	}
+	checkLabels("APP_LABELS_TO_INCLUDE", cfg.AppLabelsToInclude)
+	checkLabels("APP_ANNOTATIONS_TO_INCLUDE", cfg.AppAnnotationsToInclude)
+
+	for _, name := range cfg.Enrichers {
+		check(enricherNames[name], "ENRICHERS has unknown enricher %q", name)
+		if name == CSVEnricherName {
+			check(cfg.CSVEnrichmentFile != "", "CSV_ENRICHMENT_FILE is required when ENRICHERS includes csv")
+		}
+	}
+
+	for _, eventType := range cfg.EventTypesToExclude {
+		_, ok := events.Envelope_EventType_value[eventType]
+		check(ok, "EVENT_TYPES_TO_EXCLUDE has unknown event type %q", eventType)
+	}
 
-	for i, v := range cfg.DeploymentsToInclude {
-		cfg.DeploymentsToInclude[i] = strings.TrimSpace(v)
+	if _, err := parseKeyValuePairs(cfg.ExtraDimensions); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid EXTRA_DIMENSIONS: %v", err))
 	}
+	if _, err := parseDimensionRenames(cfg.DimensionsToRename); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid DIMENSIONS_TO_RENAME: %v", err))
+	}
+
+	_, ruleErrs := compileMetricRules(cfg.MetricRules)
+	for _, err := range ruleErrs {
+		problems = append(problems, fmt.Sprintf("invalid metric_rules: %v", err))
+	}
+	if _, err := compileMetricNameRules(cfg.MetricNameRules); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid metric_name_rules: %v", err))
+	}
+
+	if cfg.SpoolDir != "" {
+		check(cfg.SpoolMaxMegabytes > 0,
+			"SPOOL_MAX_MEGABYTES must be at least 1 when SPOOL_DIR is set, got %d", cfg.SpoolMaxMegabytes)
+		check(cfg.SpoolMaxAgeSeconds > 0,
+			"SPOOL_MAX_AGE_SECONDS must be at least 1 when SPOOL_DIR is set, got %d", cfg.SpoolMaxAgeSeconds)
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
 
-	for i, v := range cfg.MetricsToExclude {
-		cfg.MetricsToExclude[i] = strings.TrimSpace(v)
+// An empty list in the config file turns the default rules off
+func (cfg *Config) metricNameRules() []MetricNameRule {
+	if cfg.MetricNameRules == nil {
+		return defaultMetricNameRules
 	}
+	return cfg.MetricNameRules
+}
 
-	return &cfg, err
+// Configs built in code, e.g. in tests, may not set a shutdown timeout
+func (cfg *Config) shutdownTimeout() time.Duration {
+	if cfg.ShutdownTimeoutSeconds <= 0 {
+		return defaultShutdownTimeout
+	}
+	return time.Duration(cfg.ShutdownTimeoutSeconds) * time.Second
+}
+
+// E.g. "CF_USERNAME,required" -> "CF_USERNAME", true
+func parseEnvTag(tag string) (string, bool) {
+	parts := strings.Split(tag, ",")
+	for _, opt := range parts[1:] {
+		if opt == "required" {
+			return parts[0], true
+		}
+	}
+	return parts[0], false
+}
+
+func configFileKey(field reflect.StructField, envName string) string {
+	if tag := field.Tag.Get("yaml"); tag != "" {
+		if tag == "-" {
+			return ""
+		}
+		return strings.Split(tag, ",")[0]
+	}
+	return strings.ToLower(envName)
+}
+
+func settingName(envName, key string) string {
+	if envName != "" {
+		return envName
+	}
+	return key
+}
+
+func setFromString(field reflect.Value, structField reflect.StructField, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", field.Type())
+		}
+		separator := structField.Tag.Get("envSeparator")
+		if separator == "" {
+			separator = ","
+		}
+		items := strings.Split(value, separator)
+		for i := range items {
+			items[i] = strings.TrimSpace(items[i])
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+// The value has already been decoded into generic YAML types, so round-trip
+// it to decode it into the type of the field.
+func setFromYAML(field reflect.Value, value interface{}) error {
+	encoded, err := yaml.Marshal(value)
+	if err != nil {
+		return err
+	}
+	decoded := reflect.New(field.Type())
+	if err := yaml.UnmarshalStrict(encoded, decoded.Interface()); err != nil {
+		return err
+	}
+	field.Set(decoded.Elem())
+	return nil
+}
+
+func isZero(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// When running as a CF app each instance has an index, otherwise fall back
+// to the hostname which is unique per BOSH VM or container.
+func defaultInstanceID() string {
+	if index := os.Getenv("CF_INSTANCE_INDEX"); index != "" {
+		return index
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
 }
 
 func (cfg *Config) ScrubbedString() string {
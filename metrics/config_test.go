@@ -1,6 +1,7 @@
 package metrics_test
 
 import (
+    "io/ioutil"
     "os"
 
     . "github.com/onsi/ginkgo"
@@ -54,4 +55,314 @@ var _ = Describe("NozzleConfig", func() {
         Expect(conf.SignalFxIngestURL).To(Equal("http://10.10.10.10"))
         Expect(conf.SignalFxAccessToken).To(Equal("s3cr3t"))
     })
+
+    setRequiredEnv := func() {
+        os.Setenv("CLOUDFOUNDRY_API_URL", "https://api.walnut-env.cf-app.com")
+        os.Setenv("CF_UAA_URL", "https://uaa.walnut-env.cf-app.com")
+        os.Setenv("CF_USERNAME", "env-user")
+        os.Setenv("CF_PASSWORD", "env-user-password")
+        os.Setenv("BOSH_DIRECTOR_URL", "https://123.123.123.123:25555")
+        os.Setenv("BOSH_CLIENT_ID", "bosh-username")
+        os.Setenv("BOSH_CLIENT_SECRET", "bosh-password")
+        os.Setenv("TRAFFIC_CONTROLLER_URL", "wss://doppler.walnut-env.cf-app.com:4443")
+        os.Setenv("SIGNALFX_ACCESS_TOKEN", "s3cr3t")
+    }
+
+    It("identifies the instance of the bridge", func() {
+        setRequiredEnv()
+
+        By("Defaulting to the hostname")
+        hostname, _ := os.Hostname()
+        conf, err := metrics.GetConfigFromEnv()
+        Expect(err).ToNot(HaveOccurred())
+        Expect(conf.InstanceID).To(Equal(hostname))
+
+        By("Preferring the CF instance index")
+        os.Setenv("CF_INSTANCE_INDEX", "3")
+        conf, err = metrics.GetConfigFromEnv()
+        Expect(err).ToNot(HaveOccurred())
+        Expect(conf.InstanceID).To(Equal("3"))
+
+        By("Using the configured id over both")
+        os.Setenv("BRIDGE_INSTANCE_ID", "bridge-a")
+        conf, err = metrics.GetConfigFromEnv()
+        Expect(err).ToNot(HaveOccurred())
+        Expect(conf.InstanceID).To(Equal("bridge-a"))
+    })
+
+    Context("with a config file", func() {
+        var configFile string
+
+        writeConfigFile := func(contents string) {
+            f, err := ioutil.TempFile("", "bridge-config-*.yml")
+            Expect(err).ToNot(HaveOccurred())
+            defer f.Close()
+            _, err = f.WriteString(contents)
+            Expect(err).ToNot(HaveOccurred())
+            configFile = f.Name()
+        }
+
+        AfterEach(func() {
+            os.Remove(configFile)
+        })
+
+        It("populates config values from the file", func() {
+            writeConfigFile(`
+cloudfoundry_api_url: https://api.walnut-env.cf-app.com
+cf_uaa_url: https://uaa.walnut-env.cf-app.com
+cf_username: file-user
+cf_password: file-user-password
+bosh_director_url: https://123.123.123.123:25555
+bosh_client_id: bosh-username
+bosh_client_secret: bosh-password
+signalfx_access_token: s3cr3t
+flush_interval_seconds: 10
+enable_tsdb_server: false
+deployments_to_include:
+  - cf
+  - redis
+`)
+
+            conf, err := metrics.GetConfig(configFile)
+            Expect(err).ToNot(HaveOccurred())
+            Expect(conf.CFUsername).To(Equal("file-user"))
+            Expect(conf.FlushIntervalSeconds).To(Equal(10))
+            Expect(conf.EnableTSDBServer).To(BeFalse())
+            Expect(conf.DeploymentsToInclude).To(Equal([]string{"cf", "redis"}))
+
+            By("Defaulting settings that aren't in the file")
+            Expect(conf.FirehoseSubscriptionID).To(Equal("signalfx"))
+            Expect(conf.AppMetadataCacheExpirySeconds).To(Equal(300))
+        })
+
+        It("overrides file values with environment variables", func() {
+            setRequiredEnv()
+            os.Setenv("CF_USERNAME", "env-user")
+            os.Setenv("DEPLOYMENTS_TO_INCLUDE", "test1; test2")
+            writeConfigFile(`
+cf_username: file-user
+flush_interval_seconds: 10
+deployments_to_include: [cf, redis]
+`)
+
+            conf, err := metrics.GetConfig(configFile)
+            Expect(err).ToNot(HaveOccurred())
+            Expect(conf.CFUsername).To(Equal("env-user"))
+            Expect(conf.FlushIntervalSeconds).To(Equal(10))
+            Expect(conf.DeploymentsToInclude).To(Equal([]string{"test1", "test2"}))
+        })
+
+        It("resets file values to their defaults with empty environment variables", func() {
+            setRequiredEnv()
+            os.Setenv("DEPLOYMENTS_TO_INCLUDE", "")
+            os.Setenv("FLUSH_INTERVAL_SECONDS", "")
+            os.Setenv("FIREHOSE_SUBSCRIPTION_ID", "")
+            writeConfigFile(`
+flush_interval_seconds: 10
+firehose_subscription_id: from-file
+deployments_to_include: [cf, redis]
+app_metadata_cache_expiry_seconds: 60
+`)
+
+            conf, err := metrics.GetConfig(configFile)
+            Expect(err).ToNot(HaveOccurred())
+            Expect(conf.DeploymentsToInclude).To(BeEmpty())
+            Expect(conf.FlushIntervalSeconds).To(Equal(3))
+            Expect(conf.FirehoseSubscriptionID).To(Equal("signalfx"))
+            Expect(conf.AppMetadataCacheExpirySeconds).To(Equal(60))
+        })
+
+        It("reads metric rules, which can only be set in the file", func() {
+            setRequiredEnv()
+            writeConfigFile(`
+metric_rules:
+  - action: include
+    metric: gorouter.total_requests
+  - action: exclude
+    metric: /^(gorouter|rep)\./
+    dimensions:
+      job: router*
+`)
+
+            conf, err := metrics.GetConfig(configFile)
+            Expect(err).ToNot(HaveOccurred())
+            Expect(conf.MetricRules).To(Equal([]metrics.MetricRule{
+                {Action: "include", Metric: "gorouter.total_requests"},
+                {Action: "exclude", Metric: `/^(gorouter|rep)\./`, Dimensions: map[string]string{"job": "router*"}},
+            }))
+            Expect(conf.Validate()).To(Succeed())
+
+            conf.MetricRules[1].Metric = "/(gorouter/"
+            conf.MetricRules[0].Action = "drop"
+            err = conf.Validate()
+            Expect(err).To(MatchError(ContainSubstring("rule 1: action must be include or exclude")))
+            Expect(err).To(MatchError(ContainSubstring("rule 2: metric: error parsing regexp")))
+
+            // Rather than filtering with only the valid rules
+            _, err = metrics.NewMetricFilter(conf, nil)
+            Expect(err).To(MatchError(ContainSubstring("rule 1: action must be include or exclude")))
+            Expect(err).To(MatchError(ContainSubstring("rule 2: metric: error parsing regexp")))
+        })
+
+        It("reads metric name rules, which can only be set in the file", func() {
+            setRequiredEnv()
+            writeConfigFile(`
+metric_name_rules:
+  - action: replace
+    pattern: ^gorouter\.
+    replacement: router.
+  - action: add_prefix
+    prefix: cf.
+`)
+
+            conf, err := metrics.GetConfig(configFile)
+            Expect(err).ToNot(HaveOccurred())
+            Expect(conf.MetricNameRules).To(Equal([]metrics.MetricNameRule{
+                {Action: "replace", Pattern: `^gorouter\.`, Replacement: "router."},
+                {Action: "add_prefix", Prefix: "cf."},
+            }))
+            Expect(conf.Validate()).To(Succeed())
+
+            conf.MetricNameRules[0].Pattern = "(gorouter"
+            conf.MetricNameRules[1].Action = "uppercase"
+            err = conf.Validate()
+            Expect(err).To(MatchError(ContainSubstring("invalid metric_name_rules: rule 1: pattern")))
+
+            By("Keeping an empty list, which turns off the default rules")
+            writeConfigFile("metric_name_rules: []\n")
+            conf, err = metrics.GetConfig(configFile)
+            Expect(err).ToNot(HaveOccurred())
+            Expect(conf.MetricNameRules).NotTo(BeNil())
+            Expect(conf.MetricNameRules).To(BeEmpty())
+        })
+
+        It("rejects unknown settings", func() {
+            setRequiredEnv()
+            writeConfigFile("flush_interval: 10\n")
+
+            _, err := metrics.GetConfig(configFile)
+            Expect(err).To(MatchError(ContainSubstring(`unknown setting "flush_interval"`)))
+        })
+
+        It("rejects values of the wrong type", func() {
+            setRequiredEnv()
+            writeConfigFile("flush_interval_seconds: often\n")
+
+            _, err := metrics.GetConfig(configFile)
+            Expect(err).To(MatchError(ContainSubstring("FLUSH_INTERVAL_SECONDS")))
+        })
+    })
+
+    Describe("Validate", func() {
+        BeforeEach(func() {
+            setRequiredEnv()
+        })
+
+        It("accepts the defaults", func() {
+            conf, err := metrics.GetConfigFromEnv()
+            Expect(err).ToNot(HaveOccurred())
+            Expect(conf.Validate()).To(Succeed())
+        })
+
+        It("reports all problems at once", func() {
+            os.Setenv("CLOUDFOUNDRY_API_URL", "api.walnut-env.cf-app.com")
+            os.Setenv("TRAFFIC_CONTROLLER_URL", "https://doppler.walnut-env.cf-app.com")
+            os.Setenv("FLUSH_INTERVAL_SECONDS", "0")
+            os.Setenv("FIREHOSE_IDLE_TIMEOUT_SECONDS", "-1")
+            os.Setenv("SPOOL_DIR", "/tmp/spool")
+            os.Setenv("SPOOL_MAX_MEGABYTES", "0")
+            os.Setenv("EVENT_TYPES_TO_EXCLUDE", "LogMessage;Logs")
+            os.Setenv("CF_API_VERSION", "v4")
+            os.Setenv("ENRICHERS", "app_metadata;geoip;csv")
+            os.Setenv("EXTRA_DIMENSIONS", "foundation=prod-east;env")
+            os.Setenv("TSDB_HTTP_PORT", "70000")
+            os.Setenv("TSDB_TLS_KEY_FILE", "/etc/tsdb/server.key")
+            os.Setenv("SHUTDOWN_TIMEOUT_SECONDS", "0")
+
+            conf, err := metrics.GetConfigFromEnv()
+            Expect(err).ToNot(HaveOccurred())
+
+            err = conf.Validate()
+            Expect(err).To(HaveOccurred())
+            Expect(err.(metrics.ConfigErrors)).To(HaveLen(13))
+            Expect(err).To(MatchError(ContainSubstring("CLOUDFOUNDRY_API_URL must be a http or https URL")))
+            Expect(err).To(MatchError(ContainSubstring("TRAFFIC_CONTROLLER_URL must be a ws or wss URL")))
+            Expect(err).To(MatchError(ContainSubstring("FLUSH_INTERVAL_SECONDS must be at least 1")))
+            Expect(err).To(MatchError(ContainSubstring("FIREHOSE_IDLE_TIMEOUT_SECONDS must not be negative")))
+            Expect(err).To(MatchError(ContainSubstring("SPOOL_MAX_MEGABYTES must be at least 1")))
+            Expect(err).To(MatchError(ContainSubstring("CF_API_VERSION must be auto, v2 or v3")))
+            Expect(err).To(MatchError(ContainSubstring(`ENRICHERS has unknown enricher "geoip"`)))
+            Expect(err).To(MatchError(ContainSubstring("CSV_ENRICHMENT_FILE is required")))
+            Expect(err).To(MatchError(ContainSubstring(`invalid EXTRA_DIMENSIONS: "env" is not of the form name=value`)))
+            Expect(err).To(MatchError(ContainSubstring(`EVENT_TYPES_TO_EXCLUDE has unknown event type "Logs"`)))
+            Expect(err).To(MatchError(ContainSubstring("TSDB_HTTP_PORT must be between 0 and 65535")))
+            Expect(err).To(MatchError(ContainSubstring("TSDB_TLS_CERT_FILE and TSDB_TLS_KEY_FILE must be set together")))
+            Expect(err).To(MatchError(ContainSubstring("SHUTDOWN_TIMEOUT_SECONDS must be at least 1")))
+        })
+
+        It("rejects renames whose result would depend on their order", func() {
+            conf, err := metrics.GetConfigFromEnv()
+            Expect(err).ToNot(HaveOccurred())
+
+            conf.DimensionsToRename = []string{"host=ip", "bosh_id=ip"}
+            Expect(conf.Validate()).To(MatchError(ContainSubstring(
+                `invalid DIMENSIONS_TO_RENAME: both "host" and "bosh_id" are renamed to "ip"`)))
+
+            conf.DimensionsToRename = []string{"host=ip", "host=address"}
+            Expect(conf.Validate()).To(MatchError(ContainSubstring(
+                `invalid DIMENSIONS_TO_RENAME: "host" is renamed more than once`)))
+
+            conf.DimensionsToRename = []string{"host=ip", "ip=old_ip"}
+            Expect(conf.Validate()).To(Succeed())
+        })
+
+        It("rejects labels that would replace the bridge's own dimensions", func() {
+            conf, err := metrics.GetConfigFromEnv()
+            Expect(err).ToNot(HaveOccurred())
+
+            conf.AppLabelsToInclude = []string{"team", "job"}
+            conf.AppAnnotationsToInclude = []string{"app_name"}
+            err = conf.Validate()
+            Expect(err.(metrics.ConfigErrors)).To(HaveLen(2))
+            Expect(err).To(MatchError(ContainSubstring(`APP_LABELS_TO_INCLUDE has "job", which would replace the job dimension`)))
+            Expect(err).To(MatchError(ContainSubstring(`APP_ANNOTATIONS_TO_INCLUDE has "app_name", which would replace the app_name dimension`)))
+
+            conf.AppLabelPrefix = "label_"
+            Expect(conf.Validate()).To(Succeed())
+        })
+
+        It("doesn't need BOSH settings when the TSDB server is disabled", func() {
+            os.Unsetenv("BOSH_DIRECTOR_URL")
+            os.Unsetenv("BOSH_CLIENT_ID")
+            os.Unsetenv("BOSH_CLIENT_SECRET")
+            os.Setenv("ENABLE_TSDB_SERVER", "false")
+
+            conf, err := metrics.GetConfigFromEnv()
+            Expect(err).ToNot(HaveOccurred())
+            Expect(conf.Validate()).To(Succeed())
+
+            conf.EnableTSDBServer = true
+            Expect(conf.Validate()).To(MatchError(ContainSubstring("BOSH_DIRECTOR_URL, BOSH_CLIENT_ID and BOSH_CLIENT_SECRET are required")))
+        })
+
+        It("only checks the BOSH settings when the TSDB server is enabled", func() {
+            conf, err := metrics.GetConfigFromEnv()
+            Expect(err).ToNot(HaveOccurred())
+
+            conf.BoshDirectorURL = "123.123.123.123:25555"
+            Expect(conf.Validate()).To(MatchError(ContainSubstring("BOSH_DIRECTOR_URL")))
+
+            conf.EnableTSDBServer = false
+            Expect(conf.Validate()).To(Succeed())
+        })
+    })
+
+    It("reports all missing required settings", func() {
+        os.Setenv("CF_USERNAME", "env-user")
+
+        _, err := metrics.GetConfigFromEnv()
+        Expect(err).To(MatchError(ContainSubstring("CF_PASSWORD")))
+        Expect(err).To(MatchError(ContainSubstring("SIGNALFX_ACCESS_TOKEN")))
+        Expect(err).ToNot(MatchError(ContainSubstring("CF_USERNAME")))
+    })
 })
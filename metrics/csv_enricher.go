@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/signalfx/golib/v3/datapoint"
+)
+
+// Adds dimensions from a CSV file, e.g. to map IPs to availability zones or
+// apps to the team that is on call for them.  The header names the dimension
+// to match on in the first column, and the dimensions to add in the rest:
+//
+//	app_id,team,oncall
+//	6d3a1e0c-...,payments,payments-oncall@example.com
+//
+// Datapoints whose app_id matches a row get its team and oncall dimensions.
+// Empty cells are left out.  The file is only read at startup.
+type CSVEnricher struct {
+	keyDimension string
+	// The dimensions named in the rest of the header
+	dimensions []string
+	// The dimensions to add by the value of the key dimension
+	rows map[string]map[string]string
+}
+
+func NewCSVEnricher(path string) (*CSVEnricher, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	enricher, err := parseCSVEnrichment(f)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return enricher, nil
+}
+
+func parseCSVEnrichment(r io.Reader) (*CSVEnricher, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("missing header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(header) < 2 {
+		return nil, fmt.Errorf("header must have a dimension to match on and at least one to add")
+	}
+
+	rows := make(map[string]map[string]string)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		dims := make(map[string]string, len(header)-1)
+		for i, value := range record[1:] {
+			if value != "" {
+				dims[header[i+1]] = value
+			}
+		}
+		rows[record[0]] = dims
+	}
+
+	return &CSVEnricher{keyDimension: header[0], dimensions: header[1:], rows: rows}, nil
+}
+
+// Satisfies the Enricher interface
+func (e *CSVEnricher) Enrich(dp *datapoint.Datapoint, ctx *EnrichmentContext) bool {
+	key, ok := dp.Dimensions[e.keyDimension]
+	if !ok {
+		return true
+	}
+	for k, v := range e.rows[key] {
+		dp.Dimensions[k] = v
+	}
+	return true
+}
+
+// Satisfies the Enricher interface
+func (e *CSVEnricher) AddedDimensions(source string) []string {
+	return e.dimensions
+}
@@ -0,0 +1,197 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/signalfx/golib/v3/datapoint"
+)
+
+// Rewrites datapoints from both the Firehose and the TSDB server just before
+// they are sent, after they have been filtered, so that the metric rules
+// match on the original names and dimensions.  The metric name is rewritten by
+// the ordered `MetricNameRules`.  Dimensions in `DIMENSIONS_TO_DROP` are
+// removed, then the ones in `DIMENSIONS_TO_RENAME` are renamed, and then the
+// `EXTRA_DIMENSIONS` are added, overriding any dimension of the same name.
+type DatapointRewriter struct {
+	nameRules       []metricNameRewrite
+	extraDimensions map[string]string
+	// Old name -> new name
+	renames map[string]string
+	drops   map[string]bool
+}
+
+// A rule that rewrites metric names, which can only be given in the config
+// file.  Action is one of:
+//   - strip_prefix: removes Prefix from the start of the name
+//   - add_prefix: adds Prefix to the start of the name
+//   - replace: replaces matches of the regular expression Pattern with
+//     Replacement, which can refer to groups as $1
+//   - lowercase
+//   - sanitize: replaces characters other than letters, digits, _, - and .
+//     with _
+type MetricNameRule struct {
+	Action      string `yaml:"action"`
+	Prefix      string `yaml:"prefix"`
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+type metricNameRewrite func(name string) string
+
+// BOSH HM metrics from the Firehose are named like those that come straight
+// from the BOSH HM to the TSDB server, but prefixed
+var defaultMetricNameRules = []MetricNameRule{
+	{Action: "strip_prefix", Prefix: "bosh-hm-forwarder."},
+}
+
+var invalidMetricNameCharsRegexp = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+func NewDatapointRewriter(config *Config) *DatapointRewriter {
+	// These are checked by Config.Validate so any errors here are unexpected
+	nameRules, err := compileMetricNameRules(config.metricNameRules())
+	if err != nil {
+		log.Printf("Ignoring invalid metric name rules: %v", err)
+	}
+	extraDimensions, err := parseKeyValuePairs(config.ExtraDimensions)
+	if err != nil {
+		log.Printf("Ignoring invalid EXTRA_DIMENSIONS: %v", err)
+	}
+	renames, err := parseDimensionRenames(config.DimensionsToRename)
+	if err != nil {
+		log.Printf("Ignoring invalid DIMENSIONS_TO_RENAME: %v", err)
+	}
+
+	drops := make(map[string]bool)
+	for _, name := range config.DimensionsToDrop {
+		drops[strings.TrimSpace(name)] = true
+	}
+
+	return &DatapointRewriter{
+		nameRules:       nameRules,
+		extraDimensions: extraDimensions,
+		renames:         renames,
+		drops:           drops,
+	}
+}
+
+func compileMetricNameRules(rules []MetricNameRule) ([]metricNameRewrite, error) {
+	var compiled []metricNameRewrite
+	for i, rule := range rules {
+		rule := rule
+		switch rule.Action {
+		case "strip_prefix", "add_prefix":
+			if rule.Prefix == "" {
+				return compiled, fmt.Errorf("rule %d: %s needs a prefix", i+1, rule.Action)
+			}
+			if rule.Action == "strip_prefix" {
+				compiled = append(compiled, func(name string) string {
+					return strings.TrimPrefix(name, rule.Prefix)
+				})
+			} else {
+				compiled = append(compiled, func(name string) string {
+					return rule.Prefix + name
+				})
+			}
+		case "replace":
+			if rule.Pattern == "" {
+				return compiled, fmt.Errorf("rule %d: replace needs a pattern", i+1)
+			}
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return compiled, fmt.Errorf("rule %d: pattern: %v", i+1, err)
+			}
+			compiled = append(compiled, func(name string) string {
+				return pattern.ReplaceAllString(name, rule.Replacement)
+			})
+		case "lowercase":
+			compiled = append(compiled, strings.ToLower)
+		case "sanitize":
+			compiled = append(compiled, func(name string) string {
+				return invalidMetricNameCharsRegexp.ReplaceAllString(name, "_")
+			})
+		default:
+			return compiled, fmt.Errorf("rule %d: action must be strip_prefix, add_prefix, replace, lowercase or sanitize, got %q",
+				i+1, rule.Action)
+		}
+	}
+	return compiled, nil
+}
+
+// Parses "key=value" pairs, e.g. from "foundation=prod-east;env=prod"
+func parseKeyValuePairs(pairs []string) (map[string]string, error) {
+	parsed := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" || strings.TrimSpace(parts[1]) == "" {
+			return parsed, fmt.Errorf("%q is not of the form name=value", pair)
+		}
+		parsed[key] = strings.TrimSpace(parts[1])
+	}
+	return parsed, nil
+}
+
+// Parses "old=new" renames.  A dimension can't be renamed twice, and two
+// dimensions can't be renamed to the same name, since the result would then
+// depend on the order the renames are applied in.  Renaming onto a dimension
+// that is itself renamed is fine, e.g. "host=ip;ip=old_ip".
+func parseDimensionRenames(pairs []string) (map[string]string, error) {
+	renames, err := parseKeyValuePairs(pairs)
+	if err != nil {
+		return renames, err
+	}
+
+	oldNames := make(map[string]string, len(pairs))
+	seen := make(map[string]bool, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		oldName, newName := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if seen[oldName] {
+			return renames, fmt.Errorf("%q is renamed more than once", oldName)
+		}
+		if other, ok := oldNames[newName]; ok {
+			return renames, fmt.Errorf("both %q and %q are renamed to %q", other, oldName, newName)
+		}
+		seen[oldName] = true
+		oldNames[newName] = oldName
+	}
+	return renames, nil
+}
+
+func (r *DatapointRewriter) rewritesDimensions() bool {
+	return len(r.extraDimensions) > 0 || len(r.renames) > 0 || len(r.drops) > 0
+}
+
+// Rewrites the datapoint in place
+func (r *DatapointRewriter) Rewrite(dp *datapoint.Datapoint) {
+	for _, rewrite := range r.nameRules {
+		dp.Metric = rewrite(dp.Metric)
+	}
+	if r.rewritesDimensions() {
+		dp.Dimensions = r.rewriteDimensions(dp.Dimensions)
+	}
+}
+
+// Returns a new map, since datapoints built from the same envelope share
+// their dimensions and each must only be rewritten once
+func (r *DatapointRewriter) rewriteDimensions(dims map[string]string) map[string]string {
+	rewritten := make(map[string]string, len(dims)+len(r.extraDimensions))
+	for k, v := range dims {
+		if _, renamed := r.renames[k]; !renamed && !r.drops[k] {
+			rewritten[k] = v
+		}
+	}
+	// Renamed dimensions override ones that already had the new name
+	for oldName, newName := range r.renames {
+		if v, ok := dims[oldName]; ok && !r.drops[oldName] {
+			rewritten[newName] = v
+		}
+	}
+	for k, v := range r.extraDimensions {
+		rewritten[k] = v
+	}
+	return rewritten
+}
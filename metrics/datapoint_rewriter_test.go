@@ -0,0 +1,67 @@
+package metrics_test
+
+import (
+    "time"
+
+    "github.com/signalfx/golib/v3/datapoint"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/signalfx/signalfx-cloudfoundry-bridge/metrics"
+)
+
+var _ = Describe("DatapointRewriter", func() {
+    var config *metrics.Config
+
+    rewrittenName := func(name string) string {
+        dp := datapoint.New(name, map[string]string{}, datapoint.NewIntValue(1), datapoint.Gauge, time.Now())
+        metrics.NewDatapointRewriter(config).Rewrite(dp)
+        return dp.Metric
+    }
+
+    BeforeEach(func() {
+        config = &metrics.Config{}
+    })
+
+    It("strips the bosh-hm-forwarder prefix by default", func() {
+        Expect(rewrittenName("bosh-hm-forwarder.system.cpu.user")).To(Equal("system.cpu.user"))
+        Expect(rewrittenName("gorouter.total_requests")).To(Equal("gorouter.total_requests"))
+
+        By("Not stripping it if the rules are set to an empty list")
+        config.MetricNameRules = []metrics.MetricNameRule{}
+        Expect(rewrittenName("bosh-hm-forwarder.system.cpu.user")).To(Equal("bosh-hm-forwarder.system.cpu.user"))
+    })
+
+    It("applies the rules in order", func() {
+        config.MetricNameRules = []metrics.MetricNameRule{
+            {Action: "strip_prefix", Prefix: "bosh-hm-forwarder."},
+            {Action: "replace", Pattern: `^rep\.Capacity(\w+)`, Replacement: "rep.capacity.$1"},
+            {Action: "lowercase"},
+            {Action: "sanitize"},
+            {Action: "add_prefix", Prefix: "cf."},
+        }
+
+        Expect(rewrittenName("bosh-hm-forwarder.system.cpu.user")).To(Equal("cf.system.cpu.user"))
+        Expect(rewrittenName("rep.CapacityTotalMemory")).To(Equal("cf.rep.capacity.totalmemory"))
+        Expect(rewrittenName("uaa.requests./oauth/token.completed")).To(Equal("cf.uaa.requests._oauth_token.completed"))
+    })
+
+    It("rewrites dimensions into a new map", func() {
+        config.ExtraDimensions = []string{"foundation=prod-east", "ip=overridden"}
+        config.DimensionsToRename = []string{"host=ip", "ip=old_ip"}
+        config.DimensionsToDrop = []string{"bosh_id"}
+
+        dims := map[string]string{"host": "10.0.0.1", "ip": "10.0.0.2", "bosh_id": "abc", "job": "router"}
+        dp := datapoint.New("gorouter.total_requests", dims, datapoint.NewIntValue(1), datapoint.Gauge, time.Now())
+        metrics.NewDatapointRewriter(config).Rewrite(dp)
+
+        Expect(dp.Dimensions).To(Equal(map[string]string{
+            "old_ip": "10.0.0.2",
+            "ip": "overridden",
+            "job": "router",
+            "foundation": "prod-east",
+        }))
+        Expect(dims).To(HaveLen(4))
+    })
+})
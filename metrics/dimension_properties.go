@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/sfxclient"
+)
+
+// Sends app metadata to SignalFx as properties of the app_id dimension, so
+// that datapoints only need the app_id dimension and renaming an app doesn't
+// start new time series.  Properties are only sent when they change, and
+// ones that fail to send are retried every `RetryInterval`.  Only the
+// properties the bridge sets are updated, leaving any tags and properties
+// that users or other integrations put on the dimension alone.
+
+const defaultSignalFxAPIURL = "https://api.signalfx.com"
+const dimensionPropertiesRetryInterval = 10 * time.Second
+
+type DimensionPropertiesUpdater struct {
+	apiURL        string
+	token         string
+	client        *http.Client
+	RetryInterval time.Duration
+
+	// The labels and annotations that are sent, so that the properties of
+	// ones an app no longer has are removed
+	Labels LabelExtractor
+
+	lock sync.Mutex
+	// A hash of the properties last sent for each app in the metadata cache
+	sent map[string]uint64
+	// Properties waiting to be sent, by app GUID
+	pending map[string]map[string]string
+	wake    chan bool
+
+	// Self-metrics, see `Datapoints`
+	updatesSent    int64
+	updateFailures int64
+}
+
+func NewDimensionPropertiesUpdater(apiURL, token string) *DimensionPropertiesUpdater {
+	if apiURL == "" {
+		apiURL = defaultSignalFxAPIURL
+	}
+	return &DimensionPropertiesUpdater{
+		apiURL:        apiURL,
+		token:         token,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		RetryInterval: dimensionPropertiesRetryInterval,
+		sent:          make(map[string]uint64),
+		pending:       make(map[string]map[string]string),
+		wake:          make(chan bool, 1),
+	}
+}
+
+// The properties the bridge sets on the app_id dimension
+var appPropertyNames = []string{"app_name", "app_space", "app_org", "app_buildpack", "app_stack", "app_state"}
+
+// The properties of the app_id dimension, including its labels.  Empty values
+// are left out since SignalFx doesn't allow them.
+func (u *DimensionPropertiesUpdater) appProperties(cacheEntry *CacheEntry) map[string]string {
+	app := cacheEntry.App
+	props := map[string]string{
+		"app_name":      app.Name,
+		"app_space":     app.SpaceName,
+		"app_org":       app.OrgName,
+		"app_buildpack": app.Buildpack,
+		"app_stack":     app.Stack,
+		"app_state":     app.State,
+	}
+	for k, v := range cacheEntry.Labels {
+		props[k] = v
+	}
+	for k, v := range props {
+		if v == "" {
+			delete(props, k)
+		}
+	}
+	return props
+}
+
+func hashProperties(props map[string]string) uint64 {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := fnv.New64a()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\x00", k, props[k])
+	}
+	return h.Sum64()
+}
+
+// Satisfies the AppUpdateListener interface.  Queues the app's properties
+// to be sent if they changed.
+func (u *DimensionPropertiesUpdater) AppUpdated(cacheEntry *CacheEntry) {
+	app := cacheEntry.App
+	props := u.appProperties(cacheEntry)
+	hash := hashProperties(props)
+
+	u.lock.Lock()
+	if sentHash, ok := u.sent[app.Guid]; ok && sentHash == hash {
+		delete(u.pending, app.Guid)
+		u.lock.Unlock()
+		return
+	}
+	u.pending[app.Guid] = props
+	u.lock.Unlock()
+
+	select {
+	case u.wake <- true:
+	default:
+	}
+}
+
+// Satisfies the appRemovalListener interface.  Forgets the properties sent
+// for the app, which are sent again if it is looked up again.
+func (u *DimensionPropertiesUpdater) AppRemoved(guid string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.sent, guid)
+}
+
+// Sends the queued properties until ctx is canceled.  Updates still pending
+// then are dropped, but every app's properties are sent again once the bridge
+// restarts and looks it up.
+func (u *DimensionPropertiesUpdater) Run(ctx context.Context) error {
+	ticker := time.NewTicker(u.RetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-u.wake:
+		case <-ticker.C:
+		}
+		u.sendPending(ctx)
+	}
+}
+
+func (u *DimensionPropertiesUpdater) sendPending(ctx context.Context) {
+	u.lock.Lock()
+	pending := u.pending
+	u.pending = make(map[string]map[string]string)
+	u.lock.Unlock()
+
+	for guid, props := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+		err := u.updateDimension(ctx, "app_id", guid, props)
+
+		u.lock.Lock()
+		if err != nil {
+			log.Printf("Error updating properties of app %s: %v", guid, err)
+			atomic.AddInt64(&u.updateFailures, 1)
+			// Unless newer properties were queued in the meantime
+			if _, ok := u.pending[guid]; !ok {
+				u.pending[guid] = props
+			}
+		} else {
+			atomic.AddInt64(&u.updatesSent, 1)
+			u.sent[guid] = hashProperties(props)
+		}
+		u.lock.Unlock()
+	}
+}
+
+// Sets the bridge's custom properties of the dimension, removing the ones
+// that aren't in props
+func (u *DimensionPropertiesUpdater) updateDimension(ctx context.Context, key, value string, props map[string]string) error {
+	customProperties := make(map[string]interface{}, len(props))
+	// Null removes the property
+	for _, name := range appPropertyNames {
+		customProperties[name] = nil
+	}
+	for _, name := range u.Labels.dimensionNames() {
+		customProperties[name] = nil
+	}
+	for k, v := range props {
+		customProperties[k] = v
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"customProperties": customProperties,
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoint := fmt.Sprintf("%s/v2/dimension/%s/%s/_/update", u.apiURL, url.PathEscape(key), url.PathEscape(value))
+	req, err := http.NewRequestWithContext(ctx, "PATCH", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-SF-Token", u.token)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Satisfies the sfxclient.Collector interface
+func (u *DimensionPropertiesUpdater) Datapoints() []*datapoint.Datapoint {
+	u.lock.Lock()
+	pending := len(u.pending)
+	u.lock.Unlock()
+
+	return []*datapoint.Datapoint{
+		sfxclient.CumulativeP("dimension_properties.updates_sent", nil, &u.updatesSent),
+		sfxclient.CumulativeP("dimension_properties.update_failures", nil, &u.updateFailures),
+		sfxclient.Gauge("dimension_properties.updates_pending", nil, int64(pending)),
+	}
+}
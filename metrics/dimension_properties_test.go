@@ -0,0 +1,147 @@
+package metrics_test
+
+import (
+    "time"
+
+    "github.com/cloudfoundry-community/go-cfclient"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+    . "github.com/signalfx/signalfx-cloudfoundry-bridge/testhelpers"
+
+    "github.com/signalfx/signalfx-cloudfoundry-bridge/metrics"
+)
+
+var _ = Describe("DimensionPropertiesUpdater", func() {
+    var fakeCloudController *FakeCloudController
+    var fakeSignalFx *FakeSignalFx
+    var metadataFetcher *metrics.AppMetadataFetcher
+    var updater *metrics.DimensionPropertiesUpdater
+    var stopUpdater func() error
+
+    BeforeEach(func() {
+        fakeCloudController = NewFakeCloudController()
+        fakeCloudController.Start()
+        fakeSignalFx = NewFakeSignalFx()
+        fakeSignalFx.Start()
+
+        fakeCloudController.AddOrg("org-1", "myorg")
+        fakeCloudController.AddSpace("space-1", "myspace", "org-1")
+        fakeCloudController.AddStack("stack-1", "cflinuxfs2")
+        fakeCloudController.AddApp("app-1", "myapp", "space-1")
+        fakeCloudController.SetAppField("app-1", "stack_guid", "stack-1")
+        fakeCloudController.SetAppField("app-1", "detected_buildpack", "java_buildpack")
+
+        cloudfoundryClient, err := cfclient.NewClient(&cfclient.Config{
+            ApiAddress: fakeCloudController.URL(),
+            Token: "testing",
+            SkipSslValidation: true,
+        })
+        if err != nil {
+            Fail("Could not setup CF client!")
+        }
+
+        metadataSource, err := metrics.NewAppMetadataSource(cloudfoundryClient, "v2", false)
+        Expect(err).NotTo(HaveOccurred())
+        metadataFetcher = metrics.NewAppMetadataFetcher(metadataSource)
+        updater = metrics.NewDimensionPropertiesUpdater(fakeSignalFx.URL(), "s3cr3t")
+        updater.RetryInterval = 200 * time.Millisecond
+        metadataFetcher.AddUpdateListener(updater)
+        stopUpdater = RunInBackground(updater)
+    })
+
+    AfterEach(func() {
+        stopUpdater()
+        fakeSignalFx.Close()
+        fakeCloudController.Close()
+    })
+
+    It("sends the app metadata as properties of the app_id dimension", func() {
+        metadataFetcher.GetAppNameForGUID("app-1")
+
+        update := fakeSignalFx.GetDimensionUpdate()
+        Expect(update.Path).To(Equal("/v2/dimension/app_id/app-1/_/update"))
+        Expect(update.Token).To(Equal("s3cr3t"))
+        Expect(update.Key).To(Equal("app_id"))
+        Expect(update.Value).To(Equal("app-1"))
+        Expect(update.CustomProperties).To(Equal(map[string]string{
+            "app_name": "myapp",
+            "app_space": "myspace",
+            "app_org": "myorg",
+            "app_buildpack": "java_buildpack",
+            "app_stack": "cflinuxfs2",
+            "app_state": "STARTED",
+        }))
+    })
+
+    It("only sends the properties again when they change", func() {
+        metadataFetcher.CacheExpirySeconds = 0
+
+        metadataFetcher.GetAppNameForGUID("app-1")
+        fakeSignalFx.GetDimensionUpdate()
+
+        metadataFetcher.GetAppNameForGUID("app-1")
+        Consistently(fakeSignalFx.DimensionUpdates, 0.5).ShouldNot(Receive())
+
+        fakeCloudController.SetAppField("app-1", "name", "myrenamedapp")
+        fakeCloudController.SetAppField("app-1", "state", "STOPPED")
+        metadataFetcher.GetAppNameForGUID("app-1")
+
+        update := fakeSignalFx.GetDimensionUpdate()
+        Expect(update.CustomProperties["app_name"]).To(Equal("myrenamedapp"))
+        Expect(update.CustomProperties["app_state"]).To(Equal("STOPPED"))
+    })
+
+    It("removes the properties that the app no longer has", func() {
+        metadataFetcher.CacheExpirySeconds = 0
+
+        metadataFetcher.GetAppNameForGUID("app-1")
+        Expect(fakeSignalFx.GetDimensionUpdate().CustomProperties).To(HaveKeyWithValue("app_buildpack", "java_buildpack"))
+
+        fakeCloudController.SetAppField("app-1", "detected_buildpack", "")
+        metadataFetcher.GetAppNameForGUID("app-1")
+
+        update := fakeSignalFx.GetDimensionUpdate()
+        Expect(update.CustomProperties).To(HaveKeyWithValue("app_buildpack", ""))
+        Expect(update.CustomProperties).To(HaveKeyWithValue("app_name", "myapp"))
+        // Tags are left alone
+        Expect(update.Tags).To(BeNil())
+    })
+
+    It("forgets what was sent for apps that leave the cache", func() {
+        fakeCloudController.AddApp("app-2", "myotherapp", "space-1")
+        metadataFetcher.SetMaxCacheSize(1)
+
+        metadataFetcher.GetAppNameForGUID("app-1")
+        Expect(fakeSignalFx.GetDimensionUpdate().Value).To(Equal("app-1"))
+        // Evicts app-1
+        metadataFetcher.GetAppNameForGUID("app-2")
+        Expect(fakeSignalFx.GetDimensionUpdate().Value).To(Equal("app-2"))
+
+        metadataFetcher.GetAppNameForGUID("app-1")
+        Expect(fakeSignalFx.GetDimensionUpdate().Value).To(Equal("app-1"))
+    })
+
+    It("sends properties for every app from the bulk refresh", func() {
+        fakeCloudController.AddApp("app-2", "myotherapp", "space-1")
+        metadataFetcher.RefreshIntervalSeconds = 60
+        defer RunInBackground(metadataFetcher)()
+
+        updates := map[string]string{}
+        for i := 0; i < 2; i++ {
+            update := fakeSignalFx.GetDimensionUpdate()
+            updates[update.Value] = update.CustomProperties["app_name"]
+        }
+        Expect(updates).To(Equal(map[string]string{"app-1": "myapp", "app-2": "myotherapp"}))
+        Eventually(func() int { return fakeCloudController.AppRequestCount("app-1") }, 0.2).Should(Equal(0))
+    })
+
+    It("retries properties that fail to send", func() {
+        fakeSignalFx.SetDimensionUpdateStatus(503)
+        metadataFetcher.GetAppNameForGUID("app-1")
+        Consistently(fakeSignalFx.DimensionUpdates, 0.3).ShouldNot(Receive())
+
+        fakeSignalFx.SetDimensionUpdateStatus(0)
+        Expect(fakeSignalFx.GetDimensionUpdate().Value).To(Equal("app-1"))
+    })
+})
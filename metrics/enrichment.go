@@ -0,0 +1,205 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/signalfx/golib/v3/datapoint"
+)
+
+// Enrichers add dimensions to datapoints from somewhere other than the
+// datapoint itself, e.g. the CF API, BOSH or a CSV file.  The nozzle and the
+// TSDB server run every datapoint through the same ordered chain of
+// enrichers, configured with `ENRICHERS`, so a later enricher can override the
+// dimensions set by an earlier one.  They can't set dimension properties,
+// which only the DimensionPropertiesUpdater sends, for app metadata.
+
+// Where datapoints come from
+const (
+	SourceFirehose = "firehose"
+	SourceTSDB     = "tsdb"
+)
+
+// What an enricher knows about a datapoint besides its name and dimensions
+type EnrichmentContext struct {
+	// SourceFirehose or SourceTSDB
+	Source string
+	// Set for datapoints about an app, e.g. container and HTTP metrics
+	AppGUID string
+	// Bounds the lookups an enricher makes while enriching, e.g. in BOSH.
+	// Defaults to context.Background().
+	Context context.Context
+}
+
+func (c *EnrichmentContext) context() context.Context {
+	if c.Context == nil {
+		return context.Background()
+	}
+	return c.Context
+}
+
+// Enrichers are called from both the nozzle's and the TSDB server's
+// goroutines, so they must be safe for concurrent use.
+type Enricher interface {
+	// Adds dimensions to the datapoint.  Returns false if the metadata
+	// needed isn't available yet, in which case container metrics are held
+	// for up to a flush interval and enriched again.
+	Enrich(dp *datapoint.Datapoint, ctx *EnrichmentContext) bool
+	// The names of the dimensions it may add or change on datapoints from
+	// the source, which the metric filter can't match on until they have
+	// been enriched
+	AddedDimensions(source string) []string
+}
+
+// Enrichers that look metadata up in the background can implement this to
+// start as soon as a datapoint is seen that will be enriched later
+type prefetcher interface {
+	Prefetch(ctx *EnrichmentContext)
+}
+
+type EnricherChain []Enricher
+
+// Runs every enricher in order, returning false if any of them wasn't ready
+func (c EnricherChain) Enrich(dp *datapoint.Datapoint, ctx *EnrichmentContext) bool {
+	ready := true
+	for _, enricher := range c {
+		if !enricher.Enrich(dp, ctx) {
+			ready = false
+		}
+	}
+	return ready
+}
+
+func (c EnricherChain) AddedDimensions(source string) []string {
+	var names []string
+	for _, enricher := range c {
+		names = append(names, enricher.AddedDimensions(source)...)
+	}
+	return names
+}
+
+func (c EnricherChain) Prefetch(ctx *EnrichmentContext) {
+	for _, enricher := range c {
+		if p, ok := enricher.(prefetcher); ok {
+			p.Prefetch(ctx)
+		}
+	}
+}
+
+// The names of the enrichers that can be put in `ENRICHERS`
+const (
+	AppMetadataEnricherName = "app_metadata"
+	BoshVMEnricherName      = "bosh_vm"
+	CSVEnricherName         = "csv"
+)
+
+var enricherNames = map[string]bool{
+	AppMetadataEnricherName: true,
+	BoshVMEnricherName:      true,
+	CSVEnricherName:         true,
+}
+
+// The sources of metadata an enricher chain can be built from.  Enrichers
+// whose source is nil are left out.
+type EnricherSources struct {
+	AppMetadata *AppMetadataFetcher
+	// False if the app metadata is sent as dimension properties instead
+	AppDimensions bool
+	BoshMetadata  *BoshMetadataFetcher
+	CSVFile       string
+}
+
+// Builds the chain of enrichers with the given names, in order
+func NewEnricherChain(names []string, sources EnricherSources) (EnricherChain, error) {
+	var chain EnricherChain
+	for _, name := range names {
+		switch name {
+		case AppMetadataEnricherName:
+			if sources.AppMetadata != nil {
+				chain = append(chain, NewAppMetadataEnricher(sources.AppMetadata, sources.AppDimensions))
+			}
+		case BoshVMEnricherName:
+			if sources.BoshMetadata != nil {
+				chain = append(chain, NewBoshVMEnricher(sources.BoshMetadata))
+			}
+		case CSVEnricherName:
+			csvEnricher, err := NewCSVEnricher(sources.CSVFile)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, csvEnricher)
+		default:
+			return nil, fmt.Errorf("unknown enricher %q", name)
+		}
+	}
+	return chain, nil
+}
+
+// Adds the app name, space, org and labels to datapoints about an app
+type appMetadataEnricher struct {
+	fetcher       *AppMetadataFetcher
+	appDimensions bool
+}
+
+func NewAppMetadataEnricher(fetcher *AppMetadataFetcher, appDimensions bool) Enricher {
+	return &appMetadataEnricher{fetcher: fetcher, appDimensions: appDimensions}
+}
+
+// The app dimensions are set to empty strings if the app isn't cached yet,
+// and its lookup is queued.  If the app metadata is sent as dimension
+// properties instead, only the lookup is needed.
+func (e *appMetadataEnricher) Enrich(dp *datapoint.Datapoint, ctx *EnrichmentContext) bool {
+	if ctx.AppGUID == "" {
+		return true
+	}
+	cacheEntry, ok := e.fetcher.cachedEntry(ctx.AppGUID)
+	if !e.appDimensions {
+		return true
+	}
+	setAppDimensions(dp.Dimensions, cacheEntry)
+	return ok
+}
+
+// Only Firehose datapoints are about apps
+func (e *appMetadataEnricher) AddedDimensions(source string) []string {
+	if !e.appDimensions || source != SourceFirehose {
+		return nil
+	}
+	return append([]string{"app_name", "app_space", "app_org"}, e.fetcher.Labels.dimensionNames()...)
+}
+
+func (e *appMetadataEnricher) Prefetch(ctx *EnrichmentContext) {
+	if ctx.AppGUID != "" {
+		e.fetcher.CachedApp(ctx.AppGUID)
+	}
+}
+
+// Sets the host dimension of BOSH HM metrics to the IP of the VM they are
+// about.  Firehose envelopes have the IP already.
+type boshVMEnricher struct {
+	fetcher *BoshMetadataFetcher
+}
+
+func NewBoshVMEnricher(fetcher *BoshMetadataFetcher) Enricher {
+	return &boshVMEnricher{fetcher: fetcher}
+}
+
+// Only called from the TSDB server's goroutine, since it skips firehose
+// datapoints, so the fetcher needs no locking
+func (e *boshVMEnricher) Enrich(dp *datapoint.Datapoint, ctx *EnrichmentContext) bool {
+	if ctx.Source != SourceTSDB || dp.Dimensions["bosh_id"] == "" {
+		return true
+	}
+	ipAddr := e.fetcher.GetVMIPAddress(ctx.context(), dp.Dimensions["deployment"], dp.Dimensions["bosh_id"])
+	if ipAddr != "" {
+		dp.Dimensions["host"] = ipAddr
+	}
+	return true
+}
+
+func (e *boshVMEnricher) AddedDimensions(source string) []string {
+	if source != SourceTSDB {
+		return nil
+	}
+	return []string{"host"}
+}
@@ -0,0 +1,93 @@
+package metrics_test
+
+import (
+    "io/ioutil"
+    "os"
+    "time"
+
+    "github.com/signalfx/golib/v3/datapoint"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/signalfx/signalfx-cloudfoundry-bridge/metrics"
+)
+
+var _ = Describe("EnricherChain", func() {
+    var csvPath string
+
+    writeCSV := func(content string) {
+        f, err := ioutil.TempFile("", "enrichment")
+        Expect(err).NotTo(HaveOccurred())
+        f.WriteString(content)
+        f.Close()
+        csvPath = f.Name()
+    }
+
+    newDatapoint := func(dims map[string]string) *datapoint.Datapoint {
+        return datapoint.New("container.cpu_percentage", dims, datapoint.NewFloatValue(1), datapoint.Gauge, time.Now())
+    }
+
+    AfterEach(func() {
+        if csvPath != "" {
+            os.Remove(csvPath)
+        }
+    })
+
+    It("adds dimensions from a CSV file by the first column", func() {
+        writeCSV("# app_id to on-call team\n" +
+            "app_id,team,oncall\n" +
+            "app-1,payments,payments-oncall@example.com\n" +
+            "app-2,search,\n")
+        chain, err := metrics.NewEnricherChain([]string{"csv"}, metrics.EnricherSources{CSVFile: csvPath})
+        Expect(err).NotTo(HaveOccurred())
+
+        dp := newDatapoint(map[string]string{"app_id": "app-1"})
+        Expect(chain.Enrich(dp, &metrics.EnrichmentContext{Source: metrics.SourceFirehose})).To(BeTrue())
+        Expect(dp.Dimensions).To(Equal(map[string]string{
+            "app_id": "app-1",
+            "team": "payments",
+            "oncall": "payments-oncall@example.com",
+        }))
+
+        By("Leaving out empty cells")
+        dp = newDatapoint(map[string]string{"app_id": "app-2"})
+        chain.Enrich(dp, &metrics.EnrichmentContext{Source: metrics.SourceFirehose})
+        Expect(dp.Dimensions).To(Equal(map[string]string{"app_id": "app-2", "team": "search"}))
+
+        By("Leaving datapoints that don't match alone")
+        dp = newDatapoint(map[string]string{"host": "10.0.0.1"})
+        chain.Enrich(dp, &metrics.EnrichmentContext{Source: metrics.SourceTSDB})
+        Expect(dp.Dimensions).To(Equal(map[string]string{"host": "10.0.0.1"}))
+    })
+
+    It("runs the enrichers in order", func() {
+        writeCSV("app_id,app_name\napp-1,renamed\n")
+        fetcher := metrics.NewAppMetadataFetcher(nil)
+        chain, err := metrics.NewEnricherChain([]string{"app_metadata", "csv"}, metrics.EnricherSources{
+            AppMetadata: fetcher,
+            AppDimensions: true,
+            CSVFile: csvPath,
+        })
+        Expect(err).NotTo(HaveOccurred())
+
+        dp := newDatapoint(map[string]string{"app_id": "app-1"})
+        // The app isn't cached, and the fetcher isn't started so it never
+        // will be
+        Expect(chain.Enrich(dp, &metrics.EnrichmentContext{Source: metrics.SourceFirehose, AppGUID: "app-1"})).To(BeFalse())
+        Expect(dp.Dimensions["app_name"]).To(Equal("renamed"))
+        Expect(dp.Dimensions).To(HaveKeyWithValue("app_space", ""))
+    })
+
+    It("rejects unknown enrichers and unreadable CSV files", func() {
+        _, err := metrics.NewEnricherChain([]string{"app_metadata", "geoip"}, metrics.EnricherSources{})
+        Expect(err).To(MatchError(ContainSubstring(`unknown enricher "geoip"`)))
+
+        _, err = metrics.NewEnricherChain([]string{"csv"}, metrics.EnricherSources{CSVFile: "/nonexistent.csv"})
+        Expect(err).To(HaveOccurred())
+
+        writeCSV("app_id\n")
+        _, err = metrics.NewEnricherChain([]string{"csv"}, metrics.EnricherSources{CSVFile: csvPath})
+        Expect(err).To(MatchError(ContainSubstring("at least one to add")))
+    })
+})
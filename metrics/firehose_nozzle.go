@@ -1,36 +1,55 @@
 package metrics
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"log"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/net/context"
-
 	//"github.com/davecgh/go-spew/spew"
 
 	"github.com/cloudfoundry/noaa/consumer"
 	"github.com/cloudfoundry/sonde-go/events"
 	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/sfxclient"
 )
 
 type SignalFxFirehoseNozzle struct {
 	MetricFilter
-	config                *Config
-	errs                  <-chan error
-	messages              <-chan *events.Envelope
-	authTokenFetcher      AuthTokenFetcher
-	consumer              *consumer.Consumer
-	client                SignalFxClient
-	stop                  chan bool
-	datapointBuffer       []*datapoint.Datapoint
-	totalMessagesReceived int
-	metadataFetcher       *AppMetadataFetcher
-	deploymentMap         map[string]bool
+	config           *Config
+	errs             <-chan error
+	messages         <-chan *events.Envelope
+	authTokenFetcher AuthTokenFetcher
+	consumer         *consumer.Consumer
+	client           SignalFxClient
+	datapointBuffer  []*datapoint.Datapoint
+	enrichers        EnricherChain
+	rewriter         *DatapointRewriter
+	httpMetrics      *httpMetricAggregator
+	deploymentMap    map[string]bool
 	// Similar to the above
 	metricsExcluded map[string]bool
+
+	// Container metrics waiting for their app's metadata to be looked up
+	heldDatapoints []*heldDatapoints
+
+	// When the nozzle last reconnected because it was a slow consumer
+	lastSlowConsumerReconnect time.Time
+
+	// Self-metrics, see `Datapoints`.  The map is filled up front with every
+	// event type so that it is never written to concurrently.
+	envelopesReceived  map[events.Envelope_EventType]*int64
+	envelopesFiltered  int64
+	datapointsFiltered int64
+	reconnects         int64
+	slowConsumerAlerts int64
+	droppedMessages    int64
+	pushStats          pushStats
 }
 
 type AuthTokenFetcher interface {
@@ -40,34 +59,43 @@ type AuthTokenFetcher interface {
 func NewSignalFxFirehoseNozzle(config *Config,
 	tokenFetcher AuthTokenFetcher,
 	client SignalFxClient,
-	metadataFetcher *AppMetadataFetcher,
-	metricFilter *MetricFilter) *SignalFxFirehoseNozzle {
+	enrichers EnricherChain,
+	metricFilter *MetricFilter,
+	rewriter *DatapointRewriter) *SignalFxFirehoseNozzle {
+
+	envelopesReceived := make(map[events.Envelope_EventType]*int64)
+	for eventType := range events.Envelope_EventType_name {
+		envelopesReceived[events.Envelope_EventType(eventType)] = new(int64)
+	}
 
 	return &SignalFxFirehoseNozzle{
-		MetricFilter:     *metricFilter,
-		config:           config,
-		client:           client,
-		errs:             make(<-chan error),
-		messages:         make(<-chan *events.Envelope),
-		stop:             make(chan bool),
-		authTokenFetcher: tokenFetcher,
-		datapointBuffer:  make([]*datapoint.Datapoint, 0, 10000),
-		metadataFetcher:  metadataFetcher,
+		MetricFilter:      *metricFilter,
+		config:            config,
+		client:            client,
+		errs:              make(<-chan error),
+		messages:          make(<-chan *events.Envelope),
+		authTokenFetcher:  tokenFetcher,
+		datapointBuffer:   make([]*datapoint.Datapoint, 0, 10000),
+		enrichers:         enrichers,
+		rewriter:          rewriter,
+		httpMetrics:       newHTTPMetricAggregator(enrichers),
+		envelopesReceived: envelopesReceived,
 	}
 }
 
-func (o *SignalFxFirehoseNozzle) Start() {
-	var authToken string
-
-	authToken = o.authTokenFetcher.FetchAuthToken()
+// Consumes the Firehose, reconnecting as needed, until ctx is canceled.  It
+// then sends the datapoints that are still buffered or held, including those
+// whose app hasn't been looked up yet, within the shutdown timeout.
+func (o *SignalFxFirehoseNozzle) Run(ctx context.Context) error {
 	log.Print("Starting SignalFx Firehose Nozzle...")
-	o.setupFirehose(authToken)
-	o.consumeFirehose()
+	o.setupFirehose(o.authTokenFetcher.FetchAuthToken())
+	o.consumeFirehose(ctx)
 	log.Print("SignalFx Firehose Nozzle shutting down...")
-}
 
-func (o *SignalFxFirehoseNozzle) Stop() {
-	o.stop <- true
+	flushCtx, cancel := context.WithTimeout(context.Background(), o.config.shutdownTimeout())
+	defer cancel()
+	o.flushAll(flushCtx)
+	return nil
 }
 
 func (o *SignalFxFirehoseNozzle) setupFirehose(authToken string) {
@@ -79,54 +107,224 @@ func (o *SignalFxFirehoseNozzle) setupFirehose(authToken string) {
 	o.messages, o.errs = o.consumer.Firehose(o.config.FirehoseSubscriptionID, authToken)
 }
 
-func (o *SignalFxFirehoseNozzle) consumeFirehose() {
+// Returns once ctx is canceled, with the Firehose connection closed
+func (o *SignalFxFirehoseNozzle) consumeFirehose(ctx context.Context) {
 	ticker := time.NewTicker(time.Duration(o.config.FlushIntervalSeconds) * time.Second)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case <-o.stop:
-			ticker.Stop()
+		case <-ctx.Done():
+			if err := o.consumer.Close(); err != nil {
+				log.Print("Error closing the Firehose connection: ", err)
+			}
 			return
 		case <-ticker.C:
-			o.pushMetrics()
+			o.releaseHeldDatapoints()
+			o.bufferDatapoints(o.httpMetrics.flush(time.Now()))
+			o.pushMetrics(ctx)
 		case envelope := <-o.messages:
-			dps := o.datapointsFromEnvelope(envelope)
-			for i, _ := range dps {
-				if o.shouldShipDatapoint(dps[i]) {
-					o.datapointBuffer = append(o.datapointBuffer, postProcessDP(dps[i]))
+			if counter := o.envelopesReceived[envelope.GetEventType()]; counter != nil {
+				atomic.AddInt64(counter, 1)
+			}
+			if o.shouldProcessEnvelope(envelope) {
+				dps := o.datapointsFromEnvelope(envelope)
+				setOrigin(dps, envelope.GetOrigin())
+				o.bufferDatapoints(dps)
+			} else {
+				atomic.AddInt64(&o.envelopesFiltered, 1)
+			}
+
+			if o.detectDataLoss(envelope) && o.shouldReconnectOnSlowConsumer() {
+				o.pushMetrics(ctx)
+				if !o.reconnect(ctx, errors.New("the Firehose reported this nozzle as a slow consumer")) {
+					return
 				}
+				o.lastSlowConsumerReconnect = time.Now()
 			}
 		case err := <-o.errs:
-			o.handleError(err)
-			o.pushMetrics()
+			// Whatever is buffered is left for the final flush if ctx is
+			// canceled while waiting to reconnect
+			if !o.reconnect(ctx, err) {
+				return
+			}
+			o.pushMetrics(ctx)
+		}
+	}
+}
+
+func (o *SignalFxFirehoseNozzle) bufferDatapoints(dps []*datapoint.Datapoint) {
+	for i, _ := range dps {
+		if o.shouldShipDatapoint(dps[i]) {
+			o.rewriter.Rewrite(dps[i])
+			o.datapointBuffer = append(o.datapointBuffer, dps[i])
+		} else {
+			atomic.AddInt64(&o.datapointsFiltered, 1)
 		}
 	}
 }
 
-func (o *SignalFxFirehoseNozzle) pushMetrics() {
+// The datapoints from a ContainerMetric envelope, which share their dimensions
+type heldDatapoints struct {
+	ctx     *EnrichmentContext
+	dps     []*datapoint.Datapoint
+	flushes int
+}
+
+// Held datapoints are buffered once the enrichers are ready for them, e.g.
+// their app's metadata has been looked up, or after a full flush interval
+// regardless if a lookup is taking too long.
+func (o *SignalFxFirehoseNozzle) releaseHeldDatapoints() {
+	stillHeld := o.heldDatapoints[:0]
+	for _, held := range o.heldDatapoints {
+		// Enriching one datapoint enriches them all since they share their
+		// dimensions
+		if !o.enrichers.Enrich(held.dps[0], held.ctx) && held.flushes == 0 {
+			held.flushes++
+			stillHeld = append(stillHeld, held)
+			continue
+		}
+		o.bufferDatapoints(held.dps)
+	}
+	for i := len(stillHeld); i < len(o.heldDatapoints); i++ {
+		o.heldDatapoints[i] = nil
+	}
+	o.heldDatapoints = stillHeld
+}
+
+// Sends everything that is buffered, held or aggregated, without waiting for
+// held datapoints to be enriched
+func (o *SignalFxFirehoseNozzle) flushAll(ctx context.Context) {
+	for _, held := range o.heldDatapoints {
+		held.flushes++
+	}
+	o.releaseHeldDatapoints()
+	o.bufferDatapoints(o.httpMetrics.flush(time.Now()))
+	o.pushMetrics(ctx)
+}
+
+func (o *SignalFxFirehoseNozzle) pushMetrics(ctx context.Context) {
 	if len(o.datapointBuffer) == 0 {
 		return
 	}
 
 	log.Printf("Pushing %d Firehose metrics to SignalFx", len(o.datapointBuffer))
 
-	err := o.client.AddDatapoints(context.Background(), o.datapointBuffer)
+	err := o.pushStats.addDatapoints(ctx, o.client, o.datapointBuffer)
 	if err != nil {
 		log.Print("Error shipping firehose datapoints to SignalFx: ", err)
 		// If there is an error sending datapoints then just forget about them.
+		// The client will have spooled them to disk if that is enabled.
 	}
 	o.datapointBuffer = o.datapointBuffer[:0]
 }
 
-func (o *SignalFxFirehoseNozzle) handleError(err error) {
+// A slow nozzle gets a stream of alerts, and reconnecting on each of them
+// would lose more data than staying connected
+func (o *SignalFxFirehoseNozzle) shouldReconnectOnSlowConsumer() bool {
+	if !o.config.FirehoseReconnectOnSlowConsumer {
+		return false
+	}
+	interval := time.Duration(o.config.FirehoseSlowConsumerReconnectIntervalSeconds) * time.Second
+	return o.lastSlowConsumerReconnect.IsZero() || time.Since(o.lastSlowConsumerReconnect) >= interval
+}
+
+// Returns false, with the connection closed, if ctx is canceled before the
+// reconnect delay is up
+func (o *SignalFxFirehoseNozzle) reconnect(ctx context.Context, err error) bool {
 	log.Printf("Closing connection with traffic controller due to %v", err)
 	o.consumer.Close()
 
-	time.Sleep(time.Duration(o.config.FirehoseReconnectDelaySeconds) * time.Second)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(time.Duration(o.config.FirehoseReconnectDelaySeconds) * time.Second):
+	}
 
 	log.Println("Reconnecting to Firehose")
+	atomic.AddInt64(&o.reconnects, 1)
 
 	o.setupFirehose(o.authTokenFetcher.FetchAuthToken())
+	return true
+}
+
+// Satisfies the sfxclient.Collector interface to report on the nozzle itself
+func (o *SignalFxFirehoseNozzle) Datapoints() []*datapoint.Datapoint {
+	dps := o.pushStats.datapoints("firehose")
+
+	for eventType, counter := range o.envelopesReceived {
+		dps = append(dps, sfxclient.CumulativeP("firehose.envelopes_received",
+			map[string]string{"event_type": eventType.String()},
+			counter))
+	}
+
+	subscriptionDims := map[string]string{"subscription_id": o.config.FirehoseSubscriptionID}
+
+	return append(dps,
+		sfxclient.CumulativeP("firehose.envelopes_filtered", nil, &o.envelopesFiltered),
+		sfxclient.CumulativeP("firehose.datapoints_filtered", nil, &o.datapointsFiltered),
+		sfxclient.CumulativeP("firehose.reconnects", nil, &o.reconnects),
+		sfxclient.CumulativeP("firehose.slow_consumer_alerts", subscriptionDims, &o.slowConsumerAlerts),
+		sfxclient.CumulativeP("firehose.dropped_messages", subscriptionDims, &o.droppedMessages))
+}
+
+// Doppler tells us about the messages it had to drop because the nozzle
+// wasn't reading them fast enough with a log message like "Log message output
+// is too high. 100 messages dropped (Total 200 messages dropped) to ..."
+var truncatingBufferDropRegexp = regexp.MustCompile(`(\d+) messages dropped`)
+
+// Doppler sends the same messages about the app syslog drains and websocket
+// streams it drops messages to, which carry the app's id.  Ones about the
+// Firehose have none and name the subscription instead.
+func (o *SignalFxFirehoseNozzle) isDropForSubscription(logMessage *events.LogMessage) bool {
+	if logMessage.GetAppId() != "" {
+		return false
+	}
+	subscription := regexp.MustCompile(`(^|[^\w-])` + regexp.QuoteMeta(o.config.FirehoseSubscriptionID) + `([^\w-]|$)`)
+	return subscription.Match(logMessage.GetMessage())
+}
+
+// Looks for the signals that the Firehose sends when it has to drop data
+// because this nozzle is too slow.  Returns true if data was lost.
+func (o *SignalFxFirehoseNozzle) detectDataLoss(envelope *events.Envelope) bool {
+	switch envelope.GetEventType() {
+	case events.Envelope_CounterEvent:
+		if envelope.GetOrigin() != "doppler_proxy" ||
+			envelope.GetCounterEvent().GetName() != "slowConsumerAlert" {
+			return false
+		}
+
+		atomic.AddInt64(&o.slowConsumerAlerts, 1)
+		log.Printf("WARNING: The Firehose reports that this nozzle (subscription id: %s) "+
+			"is a slow consumer and it is dropping data.  Consider scaling out the bridge.",
+			o.config.FirehoseSubscriptionID)
+		return true
+	case events.Envelope_LogMessage:
+		logMessage := envelope.GetLogMessage()
+		if logMessage.GetSourceType() != "DOP" {
+			return false
+		}
+
+		message := string(logMessage.GetMessage())
+		match := truncatingBufferDropRegexp.FindStringSubmatch(message)
+		if match == nil && !strings.Contains(message, "TruncatingBuffer") {
+			return false
+		}
+		if !o.isDropForSubscription(logMessage) {
+			return false
+		}
+
+		dropped := int64(1)
+		if match != nil {
+			dropped, _ = strconv.ParseInt(match[1], 10, 64)
+		}
+
+		atomic.AddInt64(&o.droppedMessages, dropped)
+		log.Printf("WARNING: Doppler dropped %d messages for this nozzle (subscription id: %s): %s",
+			dropped, o.config.FirehoseSubscriptionID, message)
+		return true
+	}
+	return false
 }
 
 // The ContainerMetric envelopes contain multiple metrics per envelope.  The
@@ -157,6 +355,7 @@ func (o *SignalFxFirehoseNozzle) datapointsFromEnvelope(envelope *events.Envelop
 	}
 
 	ts := time.Unix(0, envelope.GetTimestamp())
+	ctx := &EnrichmentContext{Source: SourceFirehose}
 
 	switch eventType {
 	case events.Envelope_ContainerMetric:
@@ -166,33 +365,43 @@ func (o *SignalFxFirehoseNozzle) datapointsFromEnvelope(envelope *events.Envelop
 		dimensions["app_instance_index"] = strconv.Itoa(int(contMetric.GetInstanceIndex()))
 		dimensions["app_id"] = guid
 
-		// Send app metadata as both dims and properties since navigator views
-		// seem to really want them as properties.
-		dimensions["app_name"] = o.metadataFetcher.GetAppNameForGUID(guid)
-		dimensions["app_space"] = o.metadataFetcher.GetSpaceNameForGUID(guid)
-		dimensions["app_org"] = o.metadataFetcher.GetOrgNameForGUID(guid)
-
-		return makeContainerDatapoints(dimensions, properties, ts, contMetric)
+		dps := makeContainerDatapoints(dimensions, properties, ts, contMetric)
+
+		ctx.AppGUID = guid
+		if !o.enrichers.Enrich(dps[0], ctx) {
+			// They are enriched again when they are released, and the
+			// datapoints are filtered then since rules can match on the
+			// dimensions added
+			setOrigin(dps, envelope.GetOrigin())
+			o.heldDatapoints = append(o.heldDatapoints, &heldDatapoints{
+				ctx: ctx,
+				dps: dps,
+			})
+			return []*datapoint.Datapoint{}
+		}
+		return dps
 	case events.Envelope_ValueMetric:
 		valueMetric := envelope.GetValueMetric()
-		return []*datapoint.Datapoint{
-			datapoint.New(origin+"."+valueMetric.GetName(),
-				dimensions,
-				datapoint.NewFloatValue(valueMetric.GetValue()),
-				datapointType(origin, valueMetric.GetName(), datapoint.Gauge),
-				ts),
-		}
+		dp := datapoint.New(origin+"."+valueMetric.GetName(),
+			dimensions,
+			datapoint.NewFloatValue(valueMetric.GetValue()),
+			datapointType(origin, valueMetric.GetName(), datapoint.Gauge),
+			ts)
+		o.enrichers.Enrich(dp, ctx)
+		return []*datapoint.Datapoint{dp}
 	case events.Envelope_CounterEvent:
 		counterMetric := envelope.GetCounterEvent()
-		return []*datapoint.Datapoint{
-			datapoint.New(origin+"."+counterMetric.GetName(),
-				dimensions,
-				datapoint.NewIntValue(int64(counterMetric.GetTotal())),
-				datapointType(origin, counterMetric.GetName(), datapoint.Counter),
-				ts),
-		}
-	// TODO: see if there are any metrics we could pull out of these
+		dp := datapoint.New(origin+"."+counterMetric.GetName(),
+			dimensions,
+			datapoint.NewIntValue(int64(counterMetric.GetTotal())),
+			datapointType(origin, counterMetric.GetName(), datapoint.Counter),
+			ts)
+		o.enrichers.Enrich(dp, ctx)
+		return []*datapoint.Datapoint{dp}
+	// These are aggregated and only turned into datapoints when the buffer
+	// is flushed.
 	case events.Envelope_HttpStartStop:
+		o.httpMetrics.add(envelope)
 		return []*datapoint.Datapoint{}
 	// TODO: figure out what these could be and derive metrics if applicable
 	case events.Envelope_Error:
@@ -237,11 +446,3 @@ func makeContainerDatapoints(dimensions map[string]string,
 			timestamp),
 	}
 }
-
-// This basically exists so that we can send BOSH HM metrics from the firehose
-// and have them have the same name as those that come straight from the BOSH
-// HM.
-func postProcessDP(dp *datapoint.Datapoint) *datapoint.Datapoint {
-	dp.Metric = strings.TrimPrefix(dp.Metric, "bosh-hm-forwarder.")
-	return dp
-}
@@ -4,11 +4,13 @@ import (
     "fmt"
     //"log"
     "strings"
+    "time"
 
     "github.com/cloudfoundry/sonde-go/events"
     "github.com/cloudfoundry-community/go-cfclient"
     "github.com/gogo/protobuf/proto"
     sfxproto "github.com/signalfx/com_signalfx_metrics_protobuf"
+    "github.com/signalfx/golib/v3/datapoint"
     "github.com/signalfx/golib/v3/sfxclient"
 
     . "github.com/onsi/ginkgo"
@@ -27,6 +29,10 @@ var _ = Describe("SignalFx Firehose Nozzle", func() {
     var config *metrics.Config
     var nozzle *metrics.SignalFxFirehoseNozzle
     var tokenFetcher *metrics.UAATokenFetcher
+    var metadataFetcher *metrics.AppMetadataFetcher
+    var stopMetadataFetcher func() error
+    var enrichers metrics.EnricherChain
+    var metricFilter *metrics.MetricFilter
     var client *sfxclient.HTTPSink
 
     fakeFirehoseURL := func(ffh *FakeFirehose) string { return strings.Replace(ffh.URL(), "http:", "ws:", 1) }
@@ -69,15 +75,20 @@ var _ = Describe("SignalFx Firehose Nozzle", func() {
         if err != nil {
             Fail("Could not setup CF client!")
         }
-        metadataFetcher := metrics.NewAppMetadataFetcher(cloudfoundryClient)
+        metadataSource, err := metrics.NewAppMetadataSource(cloudfoundryClient, "v2", false)
+        Expect(err).NotTo(HaveOccurred())
+        metadataFetcher = metrics.NewAppMetadataFetcher(metadataSource)
+        stopMetadataFetcher = RunInBackground(metadataFetcher)
+        enrichers = metrics.EnricherChain{metrics.NewAppMetadataEnricher(metadataFetcher, true)}
 
-        metricFilter := metrics.NewMetricFilter(config)
+        metricFilter = newMetricFilter(config, enrichers)
 
         fakeFirehose.KeepConnectionAlive()
-        nozzle = metrics.NewSignalFxFirehoseNozzle(config, tokenFetcher, client, metadataFetcher, metricFilter)
+        nozzle = metrics.NewSignalFxFirehoseNozzle(config, tokenFetcher, client, enrichers, metricFilter, metrics.NewDatapointRewriter(config))
     })
 
     AfterEach(func() {
+        stopMetadataFetcher()
         fakeUAA.Close()
         fakeFirehose.Close()
         fakeSignalFx.Close()
@@ -107,8 +118,7 @@ var _ = Describe("SignalFx Firehose Nozzle", func() {
             fakeFirehose.AddEvent(envelope)
         }
 
-        go nozzle.Start()
-        defer nozzle.Stop()
+        defer RunInBackground(nozzle)()
 
         By("Sending valid datapoints to the SignalFx ingest endpoint")
         datapoints := fakeSignalFx.GetIngestedDatapoints()
@@ -163,8 +173,7 @@ var _ = Describe("SignalFx Firehose Nozzle", func() {
         }
         fakeFirehose.AddEvent(envelope)
 
-        go nozzle.Start()
-        defer nozzle.Stop()
+        defer RunInBackground(nozzle)()
 
         datapoints := fakeSignalFx.GetIngestedDatapoints()
         By("Splitting a single ContainerMetric to 5 datapoints")
@@ -196,6 +205,170 @@ var _ = Describe("SignalFx Firehose Nozzle", func() {
         Expect(dimensions["app_space"]).To(Equal("myspace"))
     }, 5)
 
+    It("only sends the app_id dimension when app metadata is sent as properties", func(done Done) {
+        defer close(done)
+        defer GinkgoRecover()
+
+        enrichers = metrics.EnricherChain{metrics.NewAppMetadataEnricher(metadataFetcher, false)}
+        nozzle = metrics.NewSignalFxFirehoseNozzle(config, tokenFetcher, client, enrichers, metricFilter, metrics.NewDatapointRewriter(config))
+
+        fakeCloudController.SetResponseDelay(2 * time.Second)
+        fakeFirehose.AddEvent(events.Envelope{
+            Origin:    proto.String("rep"),
+            Timestamp: proto.Int64(1000000000),
+            EventType: events.Envelope_ContainerMetric.Enum(),
+            ContainerMetric: &events.ContainerMetric{
+                ApplicationId:  proto.String("testapp"),
+                InstanceIndex: proto.Int32(2),
+                CpuPercentage: proto.Float64(5.5),
+                MemoryBytes: proto.Uint64(1000),
+                DiskBytes: proto.Uint64(1000),
+                MemoryBytesQuota: proto.Uint64(10000),
+                DiskBytesQuota: proto.Uint64(10000),
+            },
+            Deployment: proto.String("cf"),
+            Job:        proto.String("diego"),
+            Index:      proto.String("abcdefg"),
+            Ip:         proto.String("127.0.0.1"),
+        })
+
+        defer RunInBackground(nozzle)()
+
+        start := time.Now()
+        datapoints := fakeSignalFx.GetIngestedDatapoints()
+        Expect(datapoints).To(HaveLen(5))
+
+        By("Not waiting for the app to be looked up")
+        Expect(time.Since(start)).To(BeNumerically("<", 1900 * time.Millisecond))
+
+        dimensions := ProtoDimensionsToMap(datapoints[0].GetDimensions())
+        Expect(dimensions["app_id"]).To(Equal("testapp"))
+        Expect(dimensions).ToNot(HaveKey("app_name"))
+        Expect(dimensions).ToNot(HaveKey("app_space"))
+        Expect(dimensions).ToNot(HaveKey("app_org"))
+
+        By("Still looking up the app so its properties can be sent")
+        Eventually(func() int { return fakeCloudController.AppRequestCount("testapp") }).Should(Equal(1))
+    }, 5)
+
+    It("doesn't hold up other metrics while looking up app metadata", func(done Done) {
+        defer close(done)
+        defer GinkgoRecover()
+
+        fakeCloudController.SetResponseDelay(1500 * time.Millisecond)
+
+        fakeFirehose.AddEvent(events.Envelope{
+            Origin:    proto.String("rep"),
+            Timestamp: proto.Int64(1000000000),
+            EventType: events.Envelope_ContainerMetric.Enum(),
+            ContainerMetric: &events.ContainerMetric{
+                ApplicationId: proto.String("testapp"),
+                InstanceIndex: proto.Int32(0),
+                CpuPercentage: proto.Float64(5.5),
+                MemoryBytes:   proto.Uint64(1000),
+                DiskBytes:     proto.Uint64(1000),
+            },
+            Deployment: proto.String("cf"),
+            Job:        proto.String("diego_cell"),
+        })
+        fakeFirehose.AddEvent(events.Envelope{
+            Origin:    proto.String("cc"),
+            Timestamp: proto.Int64(1000000000),
+            EventType: events.Envelope_ValueMetric.Enum(),
+            ValueMetric: &events.ValueMetric{
+                Name:  proto.String("requests"),
+                Value: proto.Float64(1),
+                Unit:  proto.String("gauge"),
+            },
+            Deployment: proto.String("cf"),
+            Job:        proto.String("cloud_controller"),
+        })
+
+        defer RunInBackground(nozzle)()
+
+        By("Sending the other metrics while the app is looked up")
+        datapoints := fakeSignalFx.GetIngestedDatapoints()
+        Expect(datapoints).To(HaveLen(1))
+        Expect(datapoints[0].GetMetric()).To(Equal("cc.requests"))
+
+        By("Holding the container metrics until the app is known")
+        datapoints = fakeSignalFx.GetIngestedDatapoints()
+        Expect(datapoints).To(HaveLen(5))
+        Expect(ProtoDimensionsToMap(datapoints[0].GetDimensions())["app_name"]).To(Equal("app-testapp"))
+        Expect(fakeCloudController.AppRequestCount("testapp")).To(Equal(1))
+    }, 5)
+
+    It("aggregates HttpStartStop events into per-app request metrics", func(done Done) {
+        defer close(done)
+        defer GinkgoRecover()
+
+        // Formats to 00010203-0405-0607-0809-0a0b0c0d0e0f
+        appId := &events.UUID{
+            Low:  proto.Uint64(0x0706050403020100),
+            High: proto.Uint64(0x0f0e0d0c0b0a0908),
+        }
+
+        addRequest := func(status int32, latencyMs int64, peerType events.PeerType) {
+            const start int64 = 1000000000
+            fakeFirehose.AddEvent(events.Envelope{
+                Origin:    proto.String("gorouter"),
+                Timestamp: proto.Int64(start),
+                EventType: events.Envelope_HttpStartStop.Enum(),
+                HttpStartStop: &events.HttpStartStop{
+                    StartTimestamp: proto.Int64(start),
+                    StopTimestamp:  proto.Int64(start + latencyMs*1000000),
+                    RequestId:      &events.UUID{Low: proto.Uint64(1), High: proto.Uint64(2)},
+                    PeerType:       peerType.Enum(),
+                    Method:         events.Method_GET.Enum(),
+                    Uri:            proto.String("http://app.example.com/"),
+                    RemoteAddress:  proto.String("10.0.0.1"),
+                    UserAgent:      proto.String("curl"),
+                    StatusCode:     proto.Int32(status),
+                    ContentLength:  proto.Int64(100),
+                    ApplicationId:  appId,
+                },
+                Deployment: proto.String("cf"),
+                Job:        proto.String("router"),
+                Index:      proto.String("abcdefg"),
+                Ip:         proto.String("127.0.0.1"),
+            })
+        }
+
+        addRequest(200, 10, events.PeerType_Client)
+        addRequest(200, 30, events.PeerType_Client)
+        addRequest(503, 5, events.PeerType_Client)
+        // Should not be double counted
+        addRequest(200, 10, events.PeerType_Server)
+
+        defer RunInBackground(nozzle)()
+
+        datapoints := fakeSignalFx.GetIngestedDatapoints()
+        By("Sending a count, average and max latency per status class")
+        Expect(datapoints).To(HaveLen(6))
+
+        values := make(map[string]*sfxproto.DataPoint)
+        for _, dp := range datapoints {
+            dimensions := ProtoDimensionsToMap(dp.GetDimensions())
+            values[dp.GetMetric() + "/" + dimensions["status_class"]] = dp
+        }
+
+        Expect(values["http.request_count/2xx"].GetValue().GetIntValue()).To(Equal(int64(2)))
+        Expect(values["http.request_count/2xx"].GetMetricType()).To(Equal(sfxproto.MetricType_COUNTER))
+        Expect(values["http.request_count/5xx"].GetValue().GetIntValue()).To(Equal(int64(1)))
+        Expect(values["http.latency_ms.avg/2xx"].GetValue().GetDoubleValue()).To(Equal(float64(20)))
+        Expect(values["http.latency_ms.max/2xx"].GetValue().GetDoubleValue()).To(Equal(float64(30)))
+        Expect(values["http.latency_ms.max/5xx"].GetValue().GetDoubleValue()).To(Equal(float64(5)))
+
+        By("Setting the app dimensions")
+        dimensions := ProtoDimensionsToMap(values["http.request_count/5xx"].GetDimensions())
+        Expect(dimensions["app_id"]).To(Equal("00010203-0405-0607-0809-0a0b0c0d0e0f"))
+        Expect(dimensions["app_name"]).To(Equal("app-00010203-0405-0607-0809-0a0b0c0d0e0f"))
+        Expect(dimensions["app_org"]).To(Equal("myorg"))
+        Expect(dimensions["app_space"]).To(Equal("myspace"))
+        Expect(dimensions["method"]).To(Equal("GET"))
+        Expect(dimensions["metric_source"]).To(Equal("cloudfoundry"))
+    }, 5)
+
     It("excludes metrics in blacklist", func(done Done) {
         defer close(done)
         defer GinkgoRecover()
@@ -216,19 +389,479 @@ var _ = Describe("SignalFx Firehose Nozzle", func() {
         }
         fakeFirehose.AddEvent(envelope)
 
-        go nozzle.Start()
-        defer nozzle.Stop()
+        defer RunInBackground(nozzle)()
 
         fakeSignalFx.EnsureNoDatapoints()
     }, 5)
 
+    It("applies the metric rules in order", func(done Done) {
+        defer close(done)
+        defer GinkgoRecover()
+
+        for _, event := range []struct{ origin, name, job string }{
+            {"gorouter", "total_requests", "router"},
+            {"gorouter", "latency", "router"},
+            {"rep", "CapacityTotalMemory", "diego_cell"},
+            {"rep", "CapacityTotalMemory", "diego_brain"},
+            {"uaa", "requests.global.completed.count", "uaa"},
+            {"cc", "requests.completed", "cloud_controller"},
+        } {
+            fakeFirehose.AddEvent(events.Envelope{
+                Origin:    proto.String(event.origin),
+                Timestamp: proto.Int64(1000000000),
+                EventType: events.Envelope_ValueMetric.Enum(),
+                ValueMetric: &events.ValueMetric{
+                    Name:  proto.String(event.name),
+                    Value: proto.Float64(1),
+                    Unit:  proto.String("gauge"),
+                },
+                Deployment: proto.String("cf"),
+                Job:        proto.String(event.job),
+                Index:      proto.String("abcdefg"),
+                Ip:         proto.String("127.0.0.1"),
+            })
+        }
+
+        config.MetricRules = []metrics.MetricRule{
+            {Action: "include", Metric: "gorouter.total_requests"},
+            {Action: "exclude", Metric: "gorouter.*"},
+            {Action: "exclude", Metric: `/^rep\.Capacity/`, Dimensions: map[string]string{"job": "diego_c?ll"}},
+            {Action: "exclude", Dimensions: map[string]string{"origin": "uaa"}},
+        }
+        nozzle = metrics.NewSignalFxFirehoseNozzle(config, tokenFetcher, client, enrichers, newMetricFilter(config, enrichers), metrics.NewDatapointRewriter(config))
+
+        defer RunInBackground(nozzle)()
+
+        datapoints := fakeSignalFx.GetIngestedDatapoints()
+        shipped := make([]string, 0, len(datapoints))
+        for _, dp := range datapoints {
+            shipped = append(shipped, dp.GetMetric()+"/"+ProtoDimensionsToMap(dp.GetDimensions())["job"])
+        }
+        Expect(shipped).To(ConsistOf(
+            "gorouter.total_requests/router",
+            "rep.CapacityTotalMemory/diego_brain",
+            "cc.requests.completed/cloud_controller"))
+    }, 5)
+
+    It("adds, renames and drops dimensions after filtering", func(done Done) {
+        defer close(done)
+        defer GinkgoRecover()
+
+        fakeFirehose.AddEvent(events.Envelope{
+            Origin:    proto.String("rep"),
+            Timestamp: proto.Int64(1000000000),
+            EventType: events.Envelope_ContainerMetric.Enum(),
+            ContainerMetric: &events.ContainerMetric{
+                ApplicationId: proto.String("testapp"),
+                InstanceIndex: proto.Int32(0),
+                CpuPercentage: proto.Float64(5.5),
+                MemoryBytes: proto.Uint64(1000),
+                DiskBytes: proto.Uint64(1000),
+            },
+            Deployment: proto.String("cf"),
+            Job:        proto.String("diego_cell"),
+            Index:      proto.String("abcdefg"),
+            Ip:         proto.String("127.0.0.1"),
+        })
+
+        config.ExtraDimensions = []string{"foundation=prod-east", "env=prod"}
+        config.DimensionsToRename = []string{"host=ip", "job=ip_job"}
+        config.DimensionsToDrop = []string{"bosh_id"}
+        // Rules match on the dimensions before they are rewritten
+        config.MetricRules = []metrics.MetricRule{
+            {Action: "exclude", Dimensions: map[string]string{"bosh_id": "abcdefg", "job": "diego_cell"}, Metric: "container.disk_*"},
+        }
+        nozzle = metrics.NewSignalFxFirehoseNozzle(config, tokenFetcher, client, enrichers, newMetricFilter(config, enrichers), metrics.NewDatapointRewriter(config))
+
+        defer RunInBackground(nozzle)()
+
+        datapoints := fakeSignalFx.GetIngestedDatapoints()
+        Expect(datapoints).To(HaveLen(3))
+        for _, dp := range datapoints {
+            dimensions := ProtoDimensionsToMap(dp.GetDimensions())
+            Expect(dimensions["foundation"]).To(Equal("prod-east"))
+            Expect(dimensions["env"]).To(Equal("prod"))
+            Expect(dimensions["metric_source"]).To(Equal("cloudfoundry"))
+            Expect(dimensions["ip"]).To(Equal("127.0.0.1"))
+            Expect(dimensions["ip_job"]).To(Equal("diego_cell"))
+            Expect(dimensions["app_name"]).To(Equal("app-testapp"))
+            Expect(dimensions).NotTo(HaveKey("host"))
+            Expect(dimensions).NotTo(HaveKey("job"))
+            Expect(dimensions).NotTo(HaveKey("bosh_id"))
+        }
+    }, 5)
+
+    It("drops envelopes before building datapoints from them", func(done Done) {
+        defer close(done)
+        defer GinkgoRecover()
+
+        containerMetric := func(deployment, job string) events.Envelope {
+            return events.Envelope{
+                Origin:    proto.String("rep"),
+                Timestamp: proto.Int64(1000000000),
+                EventType: events.Envelope_ContainerMetric.Enum(),
+                ContainerMetric: &events.ContainerMetric{
+                    ApplicationId: proto.String("app-" + deployment + "-" + job),
+                    InstanceIndex: proto.Int32(0),
+                    CpuPercentage: proto.Float64(5.5),
+                    MemoryBytes: proto.Uint64(1000),
+                    DiskBytes: proto.Uint64(1000),
+                },
+                Deployment: proto.String(deployment),
+                Job:        proto.String(job),
+                Index:      proto.String("abcdefg"),
+                Ip:         proto.String("127.0.0.1"),
+            }
+        }
+        fakeFirehose.AddEvent(containerMetric("not-included", "diego_cell"))
+        fakeFirehose.AddEvent(containerMetric("cf", "isolated_diego_cell"))
+        fakeFirehose.AddEvent(containerMetric("cf", "diego_cell"))
+        fakeFirehose.AddEvent(events.Envelope{
+            Origin:    proto.String("gorouter"),
+            Timestamp: proto.Int64(1000000000),
+            EventType: events.Envelope_CounterEvent.Enum(),
+            CounterEvent: &events.CounterEvent{
+                Name:  proto.String("total_requests"),
+                Delta: proto.Uint64(1),
+                Total: proto.Uint64(1),
+            },
+            Deployment: proto.String("cf"),
+            Job:        proto.String("router"),
+        })
+
+        config.EventTypesToExclude = []string{"CounterEvent"}
+        config.MetricRules = []metrics.MetricRule{
+            {Action: "exclude", Dimensions: map[string]string{"job": "isolated_*"}},
+        }
+        nozzle = metrics.NewSignalFxFirehoseNozzle(config, tokenFetcher, client, enrichers, newMetricFilter(config, enrichers), metrics.NewDatapointRewriter(config))
+
+        defer RunInBackground(nozzle)()
+
+        datapoints := fakeSignalFx.GetIngestedDatapoints()
+        Expect(datapoints).To(HaveLen(5))
+        Expect(ProtoDimensionsToMap(datapoints[0].GetDimensions())["app_id"]).To(Equal("app-cf-diego_cell"))
+
+        By("Not looking up the metadata of apps that are filtered out")
+        Expect(fakeCloudController.AppReqCounts).To(HaveLen(1))
+        Expect(fakeCloudController.AppReqCounts).To(HaveKey("app-cf-diego_cell"))
+
+        By("Counting the envelopes that were dropped")
+        filtered := func() int64 {
+            for _, dp := range nozzle.Datapoints() {
+                if dp.Metric == "firehose.envelopes_filtered" {
+                    return dp.Value.(datapoint.IntValue).Int()
+                }
+            }
+            return -1
+        }
+        Eventually(filtered).Should(Equal(int64(3)))
+    }, 5)
+
+    It("doesn't drop envelopes that a rule on an app label may include", func(done Done) {
+        defer close(done)
+        defer GinkgoRecover()
+
+        for _, guid := range []string{"payments-app", "other-app"} {
+            fakeFirehose.AddEvent(events.Envelope{
+                Origin:    proto.String("rep"),
+                Timestamp: proto.Int64(1000000000),
+                EventType: events.Envelope_ContainerMetric.Enum(),
+                ContainerMetric: &events.ContainerMetric{
+                    ApplicationId: proto.String(guid),
+                    InstanceIndex: proto.Int32(0),
+                    CpuPercentage: proto.Float64(5.5),
+                    MemoryBytes: proto.Uint64(1000),
+                    DiskBytes: proto.Uint64(1000),
+                },
+                Deployment: proto.String("cf"),
+                Job:        proto.String("diego_cell"),
+                Index:      proto.String("abcdefg"),
+                Ip:         proto.String("127.0.0.1"),
+            })
+        }
+        fakeCloudController.SetLabels("payments-app", map[string]string{"team": "payments"}, nil)
+
+        cloudfoundryClient, err := cfclient.NewClient(&cfclient.Config{
+            ApiAddress: fakeCloudController.URL(),
+            Token: "testing",
+            SkipSslValidation: true,
+        })
+        Expect(err).NotTo(HaveOccurred())
+        metadataSource, err := metrics.NewAppMetadataSource(cloudfoundryClient, "v2", true)
+        Expect(err).NotTo(HaveOccurred())
+        labelsFetcher := metrics.NewAppMetadataFetcher(metadataSource)
+        labelsFetcher.Labels = metrics.LabelExtractor{Labels: []string{"team"}}
+        defer RunInBackground(labelsFetcher)()
+
+        // The team dimension is only added once the envelope is enriched, so
+        // the broader exclude can't be applied to the envelope beforehand
+        config.MetricRules = []metrics.MetricRule{
+            {Action: "include", Dimensions: map[string]string{"team": "payments"}},
+            {Action: "exclude", Dimensions: map[string]string{"job": "diego_cell"}},
+        }
+        labelsEnrichers := metrics.EnricherChain{metrics.NewAppMetadataEnricher(labelsFetcher, true)}
+        nozzle = metrics.NewSignalFxFirehoseNozzle(config, tokenFetcher, client, labelsEnrichers,
+            newMetricFilter(config, labelsEnrichers), metrics.NewDatapointRewriter(config))
+
+        defer RunInBackground(nozzle)()
+
+        datapoints := fakeSignalFx.GetIngestedDatapoints()
+        Expect(datapoints).To(HaveLen(5))
+        for _, dp := range datapoints {
+            dimensions := ProtoDimensionsToMap(dp.GetDimensions())
+            Expect(dimensions["app_id"]).To(Equal("payments-app"))
+            Expect(dimensions["team"]).To(Equal("payments"))
+        }
+    }, 5)
+
+    It("reports metrics about itself", func(done Done) {
+        defer close(done)
+        defer GinkgoRecover()
+
+        for _, deployment := range []string{"cf", "not-included"} {
+            fakeFirehose.AddEvent(events.Envelope{
+                Origin:    proto.String("cc"),
+                Timestamp: proto.Int64(1000000000),
+                EventType: events.Envelope_ValueMetric.Enum(),
+                ValueMetric: &events.ValueMetric{
+                    Name:  proto.String("requests"),
+                    Value: proto.Float64(1),
+                    Unit:  proto.String("gauge"),
+                },
+                Deployment: proto.String(deployment),
+                Job:        proto.String("cloud_controller"),
+                Index:      proto.String("abcdefg"),
+                Ip:         proto.String("127.0.0.1"),
+            })
+        }
+
+        defer RunInBackground(nozzle)()
+
+        Expect(fakeSignalFx.GetIngestedDatapoints()).To(HaveLen(1))
+
+        selfMetrics := func() map[string]int64 {
+            values := make(map[string]int64)
+            for _, dp := range nozzle.Datapoints() {
+                key := dp.Metric
+                if eventType := dp.Dimensions["event_type"]; eventType != "" {
+                    key += "/" + eventType
+                }
+                values[key] = dp.Value.(datapoint.IntValue).Int()
+            }
+            return values
+        }
+
+        Eventually(selfMetrics).Should(HaveKeyWithValue("firehose.pushes", int64(1)))
+        values := selfMetrics()
+        Expect(values).To(HaveKeyWithValue("firehose.envelopes_received/ValueMetric", int64(2)))
+        Expect(values).To(HaveKeyWithValue("firehose.envelopes_received/LogMessage", int64(0)))
+        // The envelope from the deployment that isn't included is dropped
+        // before any datapoints are built from it
+        Expect(values).To(HaveKeyWithValue("firehose.envelopes_filtered", int64(1)))
+        Expect(values).To(HaveKeyWithValue("firehose.datapoints_filtered", int64(0)))
+        Expect(values).To(HaveKeyWithValue("firehose.datapoints_sent", int64(1)))
+        Expect(values).To(HaveKeyWithValue("firehose.buffer_size", int64(1)))
+        Expect(values).To(HaveKeyWithValue("firehose.push_failures", int64(0)))
+    }, 5)
+
+    Context("when several nozzles share a subscription id", func() {
+        // Splitting the events between the instances is up to the Firehose,
+        // so each nozzle just ships whatever it is sent.  The fake Firehose
+        // sends every connection all of the events.
+        It("ships what each instance receives as is and only tells them apart in self-metrics", func(done Done) {
+            defer close(done)
+            defer GinkgoRecover()
+
+            fakeFirehose.AddEvent(events.Envelope{
+                Origin:    proto.String("cc"),
+                Timestamp: proto.Int64(1000000000),
+                EventType: events.Envelope_ValueMetric.Enum(),
+                ValueMetric: &events.ValueMetric{
+                    Name:  proto.String("requests"),
+                    Value: proto.Float64(1),
+                    Unit:  proto.String("gauge"),
+                },
+                Deployment: proto.String("cf"),
+                Job:        proto.String("cloud_controller"),
+                Index:      proto.String("abcdefg"),
+                Ip:         proto.String("127.0.0.1"),
+            })
+
+            config.FirehoseSubscriptionID = "signalfx-shared"
+            config.InstanceID = "0"
+            otherConfig := *config
+            otherConfig.InstanceID = "1"
+            otherNozzle := metrics.NewSignalFxFirehoseNozzle(&otherConfig, tokenFetcher, client, enrichers, metricFilter, metrics.NewDatapointRewriter(&otherConfig))
+
+            defer RunInBackground(nozzle)()
+            defer RunInBackground(otherNozzle)()
+
+            By("Subscribing with the shared id")
+            Eventually(func() int { return fakeFirehose.SubscriberCount("signalfx-shared") }).Should(Equal(2))
+
+            By("Not deduplicating across instances or marking the datapoints with the instance")
+            for i := 0; i < 2; i++ {
+                datapoints := fakeSignalFx.GetIngestedDatapoints()
+                Expect(datapoints).To(HaveLen(1))
+                Expect(datapoints[0].GetMetric()).To(Equal("cc.requests"))
+                for _, dim := range datapoints[0].GetDimensions() {
+                    Expect(dim.GetKey()).ToNot(Equal("bridge_instance"))
+                    Expect(dim.GetKey()).ToNot(Equal("subscription_id"))
+                }
+            }
+
+            By("Telling the instances apart in the self-metrics")
+            for _, instance := range []struct {
+                id     string
+                nozzle *metrics.SignalFxFirehoseNozzle
+            }{{"0", nozzle}, {"1", otherNozzle}} {
+                scheduler := metrics.NewSelfMetricsScheduler(client, 10, instance.id)
+                scheduler.AddCallback(instance.nozzle)
+
+                var envelopesReceived int64
+                for _, dp := range scheduler.CollectDatapoints() {
+                    Expect(dp.Dimensions["bridge_instance"]).To(Equal(instance.id))
+                    if dp.Metric == "signalfx_bridge.firehose.slow_consumer_alerts" {
+                        Expect(dp.Dimensions["subscription_id"]).To(Equal("signalfx-shared"))
+                    }
+                    if dp.Metric == "signalfx_bridge.firehose.envelopes_received" &&
+                        dp.Dimensions["event_type"] == "ValueMetric" {
+                        envelopesReceived = dp.Value.(datapoint.IntValue).Int()
+                    }
+                }
+                Expect(envelopesReceived).To(Equal(int64(1)))
+            }
+        }, 5)
+    })
+
+    Context("when the firehose reports that the nozzle is too slow", func() {
+        BeforeEach(func() {
+            fakeFirehose.AddEvent(events.Envelope{
+                Origin:    proto.String("doppler_proxy"),
+                Timestamp: proto.Int64(1000000000),
+                EventType: events.Envelope_CounterEvent.Enum(),
+                CounterEvent: &events.CounterEvent{
+                    Name:  proto.String("slowConsumerAlert"),
+                    Delta: proto.Uint64(1),
+                    Total: proto.Uint64(1),
+                },
+                Deployment: proto.String("cf"),
+                Job:        proto.String("loggregator_trafficcontroller"),
+                Index:      proto.String("abcdefg"),
+                Ip:         proto.String("127.0.0.1"),
+            })
+            fakeFirehose.AddEvent(events.Envelope{
+                Origin:    proto.String("DopplerServer"),
+                Timestamp: proto.Int64(1000000000),
+                EventType: events.Envelope_LogMessage.Enum(),
+                LogMessage: &events.LogMessage{
+                    Message:     []byte("Log message output is too high. 42 messages dropped (Total 42 messages dropped) to signalfx-test."),
+                    MessageType: events.LogMessage_ERR.Enum(),
+                    Timestamp:   proto.Int64(1000000000),
+                    SourceType:  proto.String("DOP"),
+                },
+            })
+            // Doppler dropping messages to an app's syslog drain isn't about
+            // this nozzle
+            fakeFirehose.AddEvent(events.Envelope{
+                Origin:    proto.String("DopplerServer"),
+                Timestamp: proto.Int64(1000000000),
+                EventType: events.Envelope_LogMessage.Enum(),
+                LogMessage: &events.LogMessage{
+                    Message:     []byte("Log message output is too high. 7 messages dropped (Total 7 messages dropped) to syslog://logs.example.com:514."),
+                    MessageType: events.LogMessage_ERR.Enum(),
+                    Timestamp:   proto.Int64(1000000000),
+                    AppId:       proto.String("4630f6ba-8ddc-41f1-afea-1905332d6660"),
+                    SourceType:  proto.String("DOP"),
+                },
+            })
+
+            config.FirehoseSubscriptionID = "signalfx-test"
+            // Make sure any reconnect is due to the alert
+            config.FirehoseIdleTimeoutSeconds = 10
+        })
+
+        selfMetric := func(metric string) func() int64 {
+            return func() int64 {
+                for _, dp := range nozzle.Datapoints() {
+                    if dp.Metric == metric {
+                        Expect(dp.Dimensions["subscription_id"]).To(Equal("signalfx-test"))
+                        return dp.Value.(datapoint.IntValue).Int()
+                    }
+                }
+                return -1
+            }
+        }
+
+        It("reports the alerts and dropped messages", func(done Done) {
+            defer close(done)
+            defer GinkgoRecover()
+
+            defer RunInBackground(nozzle)()
+
+            Eventually(selfMetric("firehose.slow_consumer_alerts")).Should(Equal(int64(1)))
+            Eventually(selfMetric("firehose.dropped_messages")).Should(Equal(int64(42)))
+            Consistently(selfMetric("firehose.dropped_messages"), 1).Should(Equal(int64(42)))
+
+            By("Still forwarding the alert counter")
+            datapoints := fakeSignalFx.GetIngestedDatapoints()
+            Expect(datapoints).To(HaveLen(1))
+            Expect(datapoints[0].GetMetric()).To(Equal("doppler_proxy.slowConsumerAlert"))
+
+            Consistently(fakeFirehose.RequestCount, 2).Should(Equal(1))
+        }, 5)
+
+        It("reconnects if configured to", func(done Done) {
+            defer close(done)
+            defer GinkgoRecover()
+
+            config.FirehoseReconnectOnSlowConsumer = true
+
+            defer RunInBackground(nozzle)()
+
+            Eventually(fakeFirehose.RequestCount, 3).Should(BeNumerically(">=", 2))
+        }, 5)
+
+        It("reconnects only once for a burst of alerts", func(done Done) {
+            defer close(done)
+            defer GinkgoRecover()
+
+            config.FirehoseReconnectOnSlowConsumer = true
+            config.FirehoseSlowConsumerReconnectIntervalSeconds = 60
+            for i := 0; i < 5; i++ {
+                fakeFirehose.AddEvent(events.Envelope{
+                    Origin:    proto.String("doppler_proxy"),
+                    Timestamp: proto.Int64(1000000000),
+                    EventType: events.Envelope_CounterEvent.Enum(),
+                    CounterEvent: &events.CounterEvent{
+                        Name:  proto.String("slowConsumerAlert"),
+                        Delta: proto.Uint64(1),
+                        Total: proto.Uint64(uint64(i + 2)),
+                    },
+                })
+            }
+
+            defer RunInBackground(nozzle)()
+
+            // The first alert closes the first connection, and the new one
+            // gets all six alerts again
+            Eventually(fakeFirehose.RequestCount, 3).Should(Equal(2))
+            Eventually(selfMetric("firehose.slow_consumer_alerts"), 3).Should(BeNumerically(">=", 7))
+            Consistently(fakeFirehose.RequestCount, 2).Should(Equal(2))
+            for _, dp := range nozzle.Datapoints() {
+                if dp.Metric == "firehose.reconnects" {
+                    Expect(dp.Value).To(Equal(datapoint.NewIntValue(1)))
+                }
+            }
+        }, 10)
+    })
+
     Context("when the firehose sends an error", func() {
         It("should reconnect with different token", func(done Done) {
             defer close(done)
             defer GinkgoRecover()
 
-            go nozzle.Start()
-            defer nozzle.Stop()
+            defer RunInBackground(nozzle)()
 
             Eventually(fakeFirehose.Requested).Should(BeTrue())
             Expect(fakeFirehose.LastAuthorization()).To(Equal("bearer 123456789"))
@@ -244,8 +877,7 @@ var _ = Describe("SignalFx Firehose Nozzle", func() {
             defer close(done)
             defer GinkgoRecover()
 
-            go nozzle.Start()
-            defer nozzle.Stop()
+            defer RunInBackground(nozzle)()
 
             Eventually(fakeFirehose.Requested).Should(BeTrue())
             Expect(fakeFirehose.LastAuthorization()).To(Equal("bearer 123456789"))
@@ -260,4 +892,87 @@ var _ = Describe("SignalFx Firehose Nozzle", func() {
         }, 3)
     })
 
+
+    Context("when its context is canceled", func() {
+        It("sends the datapoints that are still buffered or held", func(done Done) {
+            defer close(done)
+            defer GinkgoRecover()
+
+            config.FlushIntervalSeconds = 60
+            fakeFirehose.AddEvent(events.Envelope{
+                Origin:    proto.String("cc"),
+                Timestamp: proto.Int64(1000000000),
+                EventType: events.Envelope_ValueMetric.Enum(),
+                ValueMetric: &events.ValueMetric{
+                    Name:  proto.String("requests"),
+                    Value: proto.Float64(1),
+                    Unit:  proto.String("gauge"),
+                },
+                Deployment: proto.String("cf"),
+                Job:        proto.String("cloud_controller"),
+                Index:      proto.String("abcdefg"),
+                Ip:         proto.String("127.0.0.1"),
+            })
+            // Held until its app is looked up, which it never is
+            fakeCloudController.SetAppMissing("deleted-app")
+            fakeFirehose.AddEvent(events.Envelope{
+                Origin:    proto.String("rep"),
+                Timestamp: proto.Int64(1000000000),
+                EventType: events.Envelope_ContainerMetric.Enum(),
+                ContainerMetric: &events.ContainerMetric{
+                    ApplicationId:  proto.String("deleted-app"),
+                    InstanceIndex: proto.Int32(0),
+                    CpuPercentage: proto.Float64(5.5),
+                    MemoryBytes: proto.Uint64(1000),
+                    DiskBytes: proto.Uint64(1000),
+                    MemoryBytesQuota: proto.Uint64(10000),
+                    DiskBytesQuota: proto.Uint64(10000),
+                },
+                Deployment: proto.String("cf"),
+                Job:        proto.String("diego"),
+                Index:      proto.String("abcdefg"),
+                Ip:         proto.String("127.0.0.1"),
+            })
+
+            stop := RunInBackground(nozzle)
+
+            envelopesReceived := func() int64 {
+                var total int64
+                for _, dp := range nozzle.Datapoints() {
+                    if dp.Metric == "firehose.envelopes_received" {
+                        total += dp.Value.(datapoint.IntValue).Int()
+                    }
+                }
+                return total
+            }
+            Eventually(envelopesReceived).Should(Equal(int64(2)))
+
+            Expect(stop()).To(Succeed())
+
+            datapoints := fakeSignalFx.GetIngestedDatapoints()
+            Expect(datapoints).To(HaveLen(6))
+            Expect(datapoints[0].GetMetric()).To(Equal("cc.requests"))
+
+            By("Not pushing again afterwards")
+            fakeSignalFx.EnsureNoDatapoints()
+        }, 10)
+
+        It("returns without waiting out the reconnect delay", func(done Done) {
+            defer close(done)
+            defer GinkgoRecover()
+
+            config.FirehoseReconnectDelaySeconds = 60
+
+            stop := RunInBackground(nozzle)
+            Eventually(fakeFirehose.Requested).Should(BeTrue())
+            fakeFirehose.CloseAliveConnection()
+            // Give the nozzle time to notice and start waiting
+            time.Sleep(200 * time.Millisecond)
+
+            start := time.Now()
+            Expect(stop()).To(Succeed())
+            Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+            Expect(fakeFirehose.RequestCount()).To(Equal(1))
+        }, 5)
+    })
 })
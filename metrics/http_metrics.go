@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry/sonde-go/events"
+	"github.com/signalfx/golib/v3/datapoint"
+)
+
+// HttpStartStop envelopes are emitted by the gorouter once per request, so
+// sending them 1:1 would be far too much data.  Instead, they are aggregated
+// per app, method and status class over each flush interval and turned into
+// a request count and latency datapoints when the nozzle flushes.
+
+type httpMetricKey struct {
+	appGUID     string
+	deployment  string
+	method      string
+	statusClass string
+}
+
+type httpMetricStats struct {
+	count          int64
+	totalLatencyMs float64
+	maxLatencyMs   float64
+}
+
+type httpMetricAggregator struct {
+	stats     map[httpMetricKey]*httpMetricStats
+	enrichers EnricherChain
+}
+
+func newHTTPMetricAggregator(enrichers EnricherChain) *httpMetricAggregator {
+	return &httpMetricAggregator{
+		stats:     make(map[httpMetricKey]*httpMetricStats),
+		enrichers: enrichers,
+	}
+}
+
+// Only the router (client) side of the request is counted so that apps that
+// also emit HttpStartStop events don't get their requests counted twice.
+// Requests that weren't routed to an app are ignored.
+func (a *httpMetricAggregator) add(envelope *events.Envelope) {
+	httpEvent := envelope.GetHttpStartStop()
+	if httpEvent == nil || httpEvent.GetApplicationId() == nil ||
+		httpEvent.GetPeerType() != events.PeerType_Client {
+		return
+	}
+
+	key := httpMetricKey{
+		appGUID:     formatUUID(httpEvent.GetApplicationId()),
+		deployment:  envelope.GetDeployment(),
+		method:      httpEvent.GetMethod().String(),
+		statusClass: statusClass(httpEvent.GetStatusCode()),
+	}
+
+	stats := a.stats[key]
+	if stats == nil {
+		stats = &httpMetricStats{}
+		a.stats[key] = stats
+		// Start looking up the app so that it is hopefully cached by the
+		// time of the flush
+		a.enrichers.Prefetch(&EnrichmentContext{Source: SourceFirehose, AppGUID: key.appGUID})
+	}
+
+	latencyMs := float64(httpEvent.GetStopTimestamp()-httpEvent.GetStartTimestamp()) / float64(time.Millisecond)
+	if latencyMs < 0 {
+		latencyMs = 0
+	}
+
+	stats.count++
+	stats.totalLatencyMs += latencyMs
+	if latencyMs > stats.maxLatencyMs {
+		stats.maxLatencyMs = latencyMs
+	}
+}
+
+// Turns everything aggregated since the last flush into datapoints and
+// resets the aggregator.  The datapoints are enriched even if the enrichers
+// aren't ready, e.g. the app dimensions are left empty if the app's metadata
+// isn't cached yet.
+func (a *httpMetricAggregator) flush(timestamp time.Time) []*datapoint.Datapoint {
+	dps := make([]*datapoint.Datapoint, 0, len(a.stats)*3)
+
+	for key, stats := range a.stats {
+		dimensions := map[string]string{
+			"deployment":    key.deployment,
+			"metric_source": "cloudfoundry",
+			"app_id":        key.appGUID,
+			"method":        key.method,
+			"status_class":  key.statusClass,
+		}
+		requestCount := datapoint.New("http.request_count",
+			dimensions,
+			datapoint.NewIntValue(stats.count),
+			datapoint.Count,
+			timestamp)
+		// The datapoints share their dimensions, so enriching one enriches
+		// them all
+		a.enrichers.Enrich(requestCount, &EnrichmentContext{Source: SourceFirehose, AppGUID: key.appGUID})
+
+		dps = append(dps,
+			requestCount,
+			datapoint.New("http.latency_ms.avg",
+				dimensions,
+				datapoint.NewFloatValue(stats.totalLatencyMs/float64(stats.count)),
+				datapoint.Gauge,
+				timestamp),
+			datapoint.New("http.latency_ms.max",
+				dimensions,
+				datapoint.NewFloatValue(stats.maxLatencyMs),
+				datapoint.Gauge,
+				timestamp))
+	}
+
+	a.stats = make(map[httpMetricKey]*httpMetricStats)
+	return dps
+}
+
+// E.g. 503 -> "5xx"
+func statusClass(statusCode int32) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "unknown"
+	}
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+// The Firehose sends guids as a pair of little-endian uint64s.  This formats
+// them the same way as the Cloud Controller API does.
+func formatUUID(uuid *events.UUID) string {
+	var uuidBytes [16]byte
+	binary.LittleEndian.PutUint64(uuidBytes[:8], uuid.GetLow())
+	binary.LittleEndian.PutUint64(uuidBytes[8:], uuid.GetHigh())
+	return fmt.Sprintf("%x-%x-%x-%x-%x",
+		uuidBytes[0:4], uuidBytes[4:6], uuidBytes[6:8], uuidBytes[8:10], uuidBytes[10:])
+}
@@ -1,20 +1,63 @@
 package metrics
 
 import (
+    "fmt"
+    "regexp"
+    "sort"
+    "strconv"
     "strings"
 
+    "github.com/cloudfoundry/sonde-go/events"
     "github.com/signalfx/golib/v3/datapoint"
 )
 
-// Filters datapoints based on deployment name and metric name
+// Filters datapoints based on deployment name and metric name, and then on
+// the ordered `MetricRules` from the config.  Firehose envelopes and TSDB lines
+// are also pre-filtered on what is known before their datapoints are built.
 type MetricFilter struct {
     // An optimization to quickly look up whether to allow a deployment
     deploymentSet     map[string]bool
     // Similar to the above but a blacklist on metric name
     metricBlacklistSet map[string]bool
+    // And on Firehose event type
+    eventTypeBlacklistSet map[events.Envelope_EventType]bool
+    rules []*compiledMetricRule
+    // The dimensions that enrichers may add or change, by source, which
+    // aren't known until datapoints have been built and enriched
+    enrichedDimensions map[string]map[string]bool
 }
 
-func NewMetricFilter(config *Config) *MetricFilter {
+// A rule that includes or excludes the datapoints that match all of its
+// patterns.  Patterns are globs (`*` and `?`) unless they are wrapped in
+// slashes, in which case they are regular expressions, e.g. `/^rep\.(cpu|mem)/`.
+// Dimensions that a datapoint doesn't have are matched as empty strings.
+type MetricRule struct {
+    // Either "include" or "exclude"
+    Action     string            `yaml:"action"`
+    Metric     string            `yaml:"metric"`
+    Dimensions map[string]string `yaml:"dimensions"`
+}
+
+type compiledMetricRule struct {
+    include bool
+    // nil matches any metric
+    metric     *regexp.Regexp
+    dimensions map[string]*regexp.Regexp
+}
+
+// The Firehose origin is part of the metric name rather than a dimension, so
+// it is kept in the datapoint's Meta for the rules to match on as if it were
+// a dimension.
+type metaKey string
+
+const originMetaKey metaKey = "origin"
+
+// Fails if any of the metric rules or event types are invalid, rather than
+// filtering with only some of them.  Config.Validate reports the same
+// problems.  The enrichers are the ones that the datapoints being filtered go
+// through.
+func NewMetricFilter(config *Config, enrichers EnricherChain) (*MetricFilter, error) {
+    var problems ConfigErrors
     deploymentSet := make(map[string]bool)
     for _, v := range config.DeploymentsToInclude {
         deploymentSet[strings.TrimSpace(v)] = true
@@ -25,19 +68,292 @@ func NewMetricFilter(config *Config) *MetricFilter {
         metricsBlacklistSet[strings.TrimSpace(v)] = true
     }
 
+    eventTypeBlacklistSet := make(map[events.Envelope_EventType]bool)
+    for _, v := range config.EventTypesToExclude {
+        eventType, ok := events.Envelope_EventType_value[v]
+        if !ok {
+            problems = append(problems, fmt.Sprintf("EVENT_TYPES_TO_EXCLUDE has unknown event type %q", v))
+        }
+        eventTypeBlacklistSet[events.Envelope_EventType(eventType)] = true
+    }
+
+    rules, ruleErrs := compileMetricRules(config.MetricRules)
+    for _, err := range ruleErrs {
+        problems = append(problems, fmt.Sprintf("invalid metric_rules: %v", err))
+    }
+    if len(problems) > 0 {
+        return nil, problems
+    }
+
+    enrichedDimensions := make(map[string]map[string]bool)
+    for _, source := range []string{SourceFirehose, SourceTSDB} {
+        enrichedDimensions[source] = make(map[string]bool)
+        for _, name := range enrichers.AddedDimensions(source) {
+            enrichedDimensions[source][name] = true
+        }
+    }
+
     return &MetricFilter{
         deploymentSet: deploymentSet,
         metricBlacklistSet: metricsBlacklistSet,
+        eventTypeBlacklistSet: eventTypeBlacklistSet,
+        rules: rules,
+        enrichedDimensions: enrichedDimensions,
+    }, nil
+}
+
+// Looks up a dimension of a datapoint that hasn't been built yet.  Returns
+// false if the value won't be known until the datapoint is built and
+// enriched.
+type dimensionLookup func(name string) (string, bool)
+
+// Decides whether an envelope could produce any datapoints that would be
+// shipped, so that the rest can be dropped before building datapoints or
+// looking up app metadata.  This mirrors the dimensions that
+// `datapointsFromEnvelope` sets.
+func (o *MetricFilter) shouldProcessEnvelope(envelope *events.Envelope) bool {
+    if o.eventTypeBlacklistSet[envelope.GetEventType()] {
+        return false
     }
+
+    switch envelope.GetEventType() {
+    case events.Envelope_ValueMetric:
+        name := envelope.GetOrigin() + "." + envelope.GetValueMetric().GetName()
+        return o.preFilter(SourceFirehose, name, envelopeDimensionLookup(envelope, nil))
+    case events.Envelope_CounterEvent:
+        name := envelope.GetOrigin() + "." + envelope.GetCounterEvent().GetName()
+        return o.preFilter(SourceFirehose, name, envelopeDimensionLookup(envelope, nil))
+    case events.Envelope_ContainerMetric:
+        // There are several container metrics per envelope
+        contMetric := envelope.GetContainerMetric()
+        return o.preFilter(SourceFirehose, "", envelopeDimensionLookup(envelope, map[string]string{
+            "app_id":             contMetric.GetApplicationId(),
+            "app_instance_index": strconv.Itoa(int(contMetric.GetInstanceIndex())),
+        }))
+    default:
+        // The HTTP metrics are aggregated with their own dimensions, so only
+        // the deployment is known
+        return o.preFilter(SourceFirehose, "", func(name string) (string, bool) {
+            if name == "deployment" {
+                return envelope.GetDeployment(), true
+            }
+            return "", false
+        })
+    }
+}
+
+// Only the dimensions that are set from the envelope itself are known.  Any
+// other dimension may be added by an enricher, e.g. from an app label or a
+// CSV file.
+func envelopeDimensionLookup(envelope *events.Envelope, extra map[string]string) dimensionLookup {
+    return func(name string) (string, bool) {
+        if value, ok := extra[name]; ok {
+            return value, true
+        }
+        if value, ok := envelope.GetTags()[name]; ok {
+            return value, true
+        }
+        switch name {
+        case "job":
+            return envelope.GetJob(), true
+        case "deployment":
+            return envelope.GetDeployment(), true
+        case "host":
+            return envelope.GetIp(), true
+        case "bosh_id":
+            return envelope.GetIndex(), true
+        case "metric_source":
+            return "cloudfoundry", true
+        case string(originMetaKey):
+            return envelope.GetOrigin(), true
+        }
+        return "", false
+    }
+}
+
+// Like envelopes, only the dimensions parsed from the line are known
+func (o *MetricFilter) shouldProcessTSDBLine(line *tsdbLine) bool {
+    return o.preFilter(SourceTSDB, line.metric, func(name string) (string, bool) {
+        value, ok := line.dimensions[name]
+        return value, ok
+    })
+}
+
+// Returns false only if every datapoint with the given name and dimensions
+// would be filtered out.  `name` is empty if it isn't known yet.  Dimensions
+// that the enrichers may add or change are never known, even if the source
+// set them.
+func (o *MetricFilter) preFilter(source, name string, sourceLookup dimensionLookup) bool {
+    lookup := func(dimension string) (string, bool) {
+        if o.enrichedDimensions[source][dimension] {
+            return "", false
+        }
+        return sourceLookup(dimension)
+    }
+
+    if deployment, ok := lookup("deployment"); ok &&
+        len(o.deploymentSet) > 0 && !o.deploymentSet[deployment] {
+        return false
+    }
+    if name != "" && o.metricBlacklistSet[name] {
+        return false
+    }
+
+    for _, rule := range o.rules {
+        matches, known := rule.preMatches(name, lookup)
+        if !known {
+            // The datapoint filter will have to decide
+            return true
+        }
+        if matches {
+            return rule.include
+        }
+    }
+    return true
 }
 
-// It is far simpler to filter the already created datapoint.  We could
-// short-cut the filtering and do it on the firehose envelope or on the TSDB
-// line before datapoints are created and save a bit of time, but this should
-// be sufficient for now.
+// Checks all of the filters against the built datapoint, which are the final
+// word even if the envelope or TSDB line was already pre-filtered
 func (o *MetricFilter) shouldShipDatapoint(dp *datapoint.Datapoint) bool {
     deploymentAllowed := len(o.deploymentSet) == 0 || o.deploymentSet[dp.Dimensions["deployment"]]
     metricAllowed := !o.metricBlacklistSet[dp.Metric]
 
-    return deploymentAllowed && metricAllowed
+    if !deploymentAllowed || !metricAllowed {
+        return false
+    }
+
+    // The first matching rule wins, and datapoints that match no rule are
+    // shipped
+    for _, rule := range o.rules {
+        if rule.matches(dp) {
+            return rule.include
+        }
+    }
+    return true
+}
+
+func (r *compiledMetricRule) matches(dp *datapoint.Datapoint) bool {
+    if r.metric != nil && !r.metric.MatchString(dp.Metric) {
+        return false
+    }
+    for name, pattern := range r.dimensions {
+        if !pattern.MatchString(dimensionValue(dp, name)) {
+            return false
+        }
+    }
+    return true
+}
+
+// Like `matches` but also returns false if that can't be known yet.  A rule
+// is known not to match as soon as any known part of it doesn't match.
+func (r *compiledMetricRule) preMatches(name string, lookup dimensionLookup) (bool, bool) {
+    known := true
+    if r.metric != nil {
+        if name == "" {
+            known = false
+        } else if !r.metric.MatchString(name) {
+            return false, true
+        }
+    }
+
+    for dimension, pattern := range r.dimensions {
+        value, ok := lookup(dimension)
+        if !ok {
+            known = false
+        } else if !pattern.MatchString(value) {
+            return false, true
+        }
+    }
+    return known, known
+}
+
+func dimensionValue(dp *datapoint.Datapoint, name string) string {
+    if value, ok := dp.Dimensions[name]; ok {
+        return value
+    }
+    if name == string(originMetaKey) && dp.Meta != nil {
+        if origin, ok := dp.Meta[originMetaKey].(string); ok {
+            return origin
+        }
+    }
+    return ""
+}
+
+func setOrigin(dps []*datapoint.Datapoint, origin string) {
+    for _, dp := range dps {
+        if dp.Meta == nil {
+            dp.Meta = make(map[interface{}]interface{})
+        }
+        dp.Meta[originMetaKey] = origin
+    }
+}
+
+// Returns an error for every invalid rule, or part of one, so that they can
+// all be fixed at once
+func compileMetricRules(rules []MetricRule) ([]*compiledMetricRule, []error) {
+    var compiled []*compiledMetricRule
+    var errs []error
+    for i, rule := range rules {
+        c := &compiledMetricRule{
+            dimensions: make(map[string]*regexp.Regexp, len(rule.Dimensions)),
+        }
+
+        switch rule.Action {
+        case "include":
+            c.include = true
+        case "exclude":
+            c.include = false
+        default:
+            errs = append(errs, fmt.Errorf("rule %d: action must be include or exclude, got %q", i+1, rule.Action))
+        }
+
+        var err error
+        if rule.Metric != "" {
+            c.metric, err = compilePattern(rule.Metric)
+            if err != nil {
+                errs = append(errs, fmt.Errorf("rule %d: metric: %v", i+1, err))
+            }
+        }
+
+        names := make([]string, 0, len(rule.Dimensions))
+        for name := range rule.Dimensions {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            c.dimensions[name], err = compilePattern(rule.Dimensions[name])
+            if err != nil {
+                errs = append(errs, fmt.Errorf("rule %d: dimension %s: %v", i+1, name, err))
+            }
+        }
+
+        compiled = append(compiled, c)
+    }
+    if len(errs) > 0 {
+        return nil, errs
+    }
+    return compiled, nil
+}
+
+// Globs are turned into anchored regexps so that all patterns are matched the
+// same way
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+    if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+        return regexp.Compile(pattern[1 : len(pattern)-1])
+    }
+
+    var expr strings.Builder
+    expr.WriteString("^")
+    for _, r := range pattern {
+        switch r {
+        case '*':
+            expr.WriteString(".*")
+        case '?':
+            expr.WriteString(".")
+        default:
+            expr.WriteString(regexp.QuoteMeta(string(r)))
+        }
+    }
+    expr.WriteString("$")
+    return regexp.Compile(expr.String())
 }
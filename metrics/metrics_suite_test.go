@@ -5,9 +5,17 @@ import (
     . "github.com/onsi/gomega"
 
     "testing"
+
+    "github.com/signalfx/signalfx-cloudfoundry-bridge/metrics"
 )
 
 func TestSignalFXfirehosenozzle(t *testing.T) {
     RegisterFailHandler(Fail)
     RunSpecs(t, "SignalFx Metrics Suite")
 }
+
+func newMetricFilter(config *metrics.Config, enrichers metrics.EnricherChain) *metrics.MetricFilter {
+    metricFilter, err := metrics.NewMetricFilter(config, enrichers)
+    Expect(err).ToNot(HaveOccurred())
+    return metricFilter
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/sfxclient"
+)
+
+// The bridge reports metrics about itself through a sfxclient.Scheduler.
+// Each component that has something to report satisfies the
+// sfxclient.Collector interface by having a `Datapoints` method, and is
+// registered with the scheduler in the main package.  The metric names
+// returned by the components are relative to `selfMetricsPrefix`.  Every
+// datapoint has a `bridge_instance` dimension so that instances of the bridge
+// sharing a Firehose subscription don't report over each other.
+
+const selfMetricsPrefix = "signalfx_bridge."
+
+func NewSelfMetricsScheduler(sink SignalFxClient, intervalSeconds int, instanceID string) *sfxclient.Scheduler {
+	scheduler := sfxclient.NewScheduler()
+	scheduler.Sink = sink
+	scheduler.Prefix = selfMetricsPrefix
+	scheduler.ReportingDelay(time.Duration(intervalSeconds) * time.Second)
+	scheduler.DefaultDimensions(map[string]string{
+		"metric_source":   "signalfx_bridge",
+		"bridge_instance": instanceID,
+	})
+	return scheduler
+}
+
+// Keeps track of how pushes of datapoint buffers to SignalFx went.  This is
+// shared by the nozzle and the TSDB server, which each push from their own
+// goroutine, while the scheduler reads from another, so everything is
+// accessed atomically.
+type pushStats struct {
+	pushes         int64
+	pushFailures   int64
+	datapointsSent int64
+	lastLatencyMs  int64
+	lastBufferSize int64
+}
+
+// How long a push can take, unless ctx has an earlier deadline
+const pushTimeout = 30 * time.Second
+
+// Pushes the datapoints to SignalFx and records how it went
+func (p *pushStats) addDatapoints(ctx context.Context, client SignalFxClient, dps []*datapoint.Datapoint) error {
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := client.AddDatapoints(ctx, dps)
+
+	atomic.StoreInt64(&p.lastLatencyMs, int64(time.Since(start)/time.Millisecond))
+	atomic.StoreInt64(&p.lastBufferSize, int64(len(dps)))
+	atomic.AddInt64(&p.pushes, 1)
+	if err != nil {
+		atomic.AddInt64(&p.pushFailures, 1)
+	} else {
+		atomic.AddInt64(&p.datapointsSent, int64(len(dps)))
+	}
+	return err
+}
+
+// The datapoints are prefixed with the name of the component that pushes
+func (p *pushStats) datapoints(component string) []*datapoint.Datapoint {
+	return []*datapoint.Datapoint{
+		sfxclient.CumulativeP(component+".pushes", nil, &p.pushes),
+		sfxclient.CumulativeP(component+".push_failures", nil, &p.pushFailures),
+		sfxclient.CumulativeP(component+".datapoints_sent", nil, &p.datapointsSent),
+		sfxclient.Gauge(component+".push_latency_ms", nil, atomic.LoadInt64(&p.lastLatencyMs)),
+		sfxclient.Gauge(component+".buffer_size", nil, atomic.LoadInt64(&p.lastBufferSize)),
+	}
+}
@@ -0,0 +1,543 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/signalfx/golib/v3/datapoint"
+	"github.com/signalfx/golib/v3/sfxclient"
+)
+
+// The DatapointSpool is a bounded write-ahead buffer on local disk for
+// datapoints that could not be sent to SignalFx.  Each failed batch is
+// written to its own file, named so that sorting the file names sorts the
+// batches by the timestamp of their oldest datapoint.  When the spool grows
+// past `MaxBytes`, or batches get older than `MaxAge`, the oldest batches are
+// dropped.
+
+const spoolFileSuffix = ".spool"
+
+// Batches are written to a temp file and then renamed into place
+const spoolTmpSuffix = ".tmp"
+
+type spoolBatch struct {
+	path          string
+	timestamp     time.Time
+	size          int64
+	numDatapoints int64
+}
+
+type DatapointSpool struct {
+	dir      string
+	MaxBytes int64
+	MaxAge   time.Duration
+
+	lock      sync.Mutex
+	batches   []*spoolBatch
+	totalSize int64
+	seq       int64
+
+	datapointsSpooled  int64
+	datapointsReplayed int64
+	datapointsDropped  int64
+	// Dropped because the sink rejected them
+	datapointsRejected int64
+}
+
+// The on-disk format of a single datapoint.  Datapoint values are
+// interfaces so the type has to be kept explicitly.
+type spooledDatapoint struct {
+	Metric      string            `json:"metric"`
+	Dimensions  map[string]string `json:"dimensions"`
+	MetricType  int               `json:"type"`
+	TimestampMs int64             `json:"ts"`
+	IntValue    *int64            `json:"i,omitempty"`
+	FloatValue  *float64          `json:"f,omitempty"`
+	StrValue    *string           `json:"s,omitempty"`
+}
+
+// Opens (or creates) the spool in `dir`.  Any batches left over from a
+// previous run are picked up so that they are replayed too, and temp files
+// left by a crash while writing a batch are removed.
+func NewDatapointSpool(dir string, maxBytes int64, maxAge time.Duration) (*DatapointSpool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	spool := &DatapointSpool{
+		dir:      dir,
+		MaxBytes: maxBytes,
+		MaxAge:   maxAge,
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), spoolFileSuffix+spoolTmpSuffix) {
+			path := filepath.Join(dir, f.Name())
+			log.Printf("Removing partially written spool file %s", path)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Could not remove spool file %s: %v", path, err)
+			}
+			continue
+		}
+
+		batch, err := parseSpoolFileName(filepath.Join(dir, f.Name()))
+		if err != nil {
+			continue
+		}
+		batch.size = f.Size()
+		spool.batches = append(spool.batches, batch)
+		spool.totalSize += batch.size
+	}
+	sort.Slice(spool.batches, func(i, j int) bool {
+		return spool.batches[i].path < spool.batches[j].path
+	})
+
+	if len(spool.batches) > 0 {
+		log.Printf("Found %d spooled datapoint batches in %s", len(spool.batches), dir)
+	}
+
+	return spool, nil
+}
+
+// File names look like <oldest ts in ns>-<sequence>-<# of datapoints>.spool
+func spoolFileName(timestamp time.Time, seq int64, numDatapoints int) string {
+	return fmt.Sprintf("%020d-%010d-%d%s", timestamp.UnixNano(), seq, numDatapoints, spoolFileSuffix)
+}
+
+func parseSpoolFileName(path string) (*spoolBatch, error) {
+	name := filepath.Base(path)
+	if !strings.HasSuffix(name, spoolFileSuffix) {
+		return nil, fmt.Errorf("Not a spool file: %s", name)
+	}
+
+	parts := strings.Split(strings.TrimSuffix(name, spoolFileSuffix), "-")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Malformed spool file name: %s", name)
+	}
+
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	numDatapoints, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &spoolBatch{
+		path:          path,
+		timestamp:     time.Unix(0, ts),
+		numDatapoints: numDatapoints,
+	}, nil
+}
+
+// Writes the datapoints to disk as a single batch
+func (s *DatapointSpool) Write(dps []*datapoint.Datapoint) error {
+	if len(dps) == 0 {
+		return nil
+	}
+
+	var oldest time.Time
+	for _, dp := range dps {
+		if !dp.Timestamp.IsZero() && (oldest.IsZero() || dp.Timestamp.Before(oldest)) {
+			oldest = dp.Timestamp
+		}
+	}
+	if oldest.IsZero() {
+		oldest = time.Now()
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seq++
+	path := filepath.Join(s.dir, spoolFileName(oldest, s.seq, len(dps)))
+
+	size, err := writeSpoolFile(path, dps)
+	if err != nil {
+		return err
+	}
+
+	batch := &spoolBatch{
+		path:          path,
+		timestamp:     oldest,
+		size:          size,
+		numDatapoints: int64(len(dps)),
+	}
+	s.batches = append(s.batches, batch)
+	sort.Slice(s.batches, func(i, j int) bool {
+		return s.batches[i].path < s.batches[j].path
+	})
+	s.totalSize += size
+	atomic.AddInt64(&s.datapointsSpooled, batch.numDatapoints)
+
+	s.enforceLimits()
+	return nil
+}
+
+// Write to a temp file first so that a crash never leaves a partial batch
+// that looks valid.
+func writeSpoolFile(path string, dps []*datapoint.Datapoint) (int64, error) {
+	tmpPath := path + spoolTmpSuffix
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, dp := range dps {
+		if err := enc.Encode(toSpooledDatapoint(dp)); err != nil {
+			f.Close()
+			os.Remove(tmpPath)
+			return 0, err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Must be called with the lock held
+func (s *DatapointSpool) enforceLimits() {
+	cutoff := time.Now().Add(-s.MaxAge)
+	for len(s.batches) > 0 {
+		oldest := s.batches[0]
+		tooBig := s.MaxBytes > 0 && s.totalSize > s.MaxBytes
+		tooOld := s.MaxAge > 0 && oldest.timestamp.Before(cutoff)
+		if !tooBig && !tooOld {
+			break
+		}
+
+		log.Printf("Dropping %d spooled datapoints (spool size: %d bytes, oldest: %s)",
+			oldest.numDatapoints, s.totalSize, oldest.timestamp)
+		s.removeOldest()
+		atomic.AddInt64(&s.datapointsDropped, oldest.numDatapoints)
+	}
+}
+
+// Must be called with the lock held
+func (s *DatapointSpool) removeOldest() {
+	s.remove(0)
+}
+
+// Must be called with the lock held
+func (s *DatapointSpool) remove(i int) {
+	batch := s.batches[i]
+	if err := os.Remove(batch.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not remove spool file %s: %v", batch.path, err)
+	}
+	s.totalSize -= batch.size
+	s.batches = append(s.batches[:i], s.batches[i+1:]...)
+}
+
+// Returns the oldest batch and its datapoints, sorted by timestamp, or nil
+// if the spool is empty.  The batch stays in the spool until `ack` is called
+// with it.  The file is read without the lock held so that writes aren't held
+// up by it.
+func (s *DatapointSpool) peek() (*spoolBatch, []*datapoint.Datapoint) {
+	for {
+		s.lock.Lock()
+		s.enforceLimits()
+		if len(s.batches) == 0 {
+			s.lock.Unlock()
+			return nil, nil
+		}
+		batch := s.batches[0]
+		s.lock.Unlock()
+
+		dps, err := readSpoolFile(batch.path)
+		if err == nil && len(dps) > 0 {
+			sort.SliceStable(dps, func(i, j int) bool {
+				return dps[i].Timestamp.Before(dps[j].Timestamp)
+			})
+			return batch, dps
+		}
+
+		// Don't let one corrupt file block the spool forever.  It may also
+		// have been dropped for being over the limits while it was read.
+		s.lock.Lock()
+		if s.removeBatch(batch) {
+			log.Printf("Discarding unreadable spool file %s: %v", batch.path, err)
+			atomic.AddInt64(&s.datapointsDropped, batch.numDatapoints)
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (s *DatapointSpool) isEmpty() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.batches) == 0
+}
+
+// Removes a batch after it was successfully replayed.  It might have been
+// dropped in the meantime if the spool was over its limits.
+func (s *DatapointSpool) ack(batch *spoolBatch) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.removeBatch(batch) {
+		atomic.AddInt64(&s.datapointsReplayed, batch.numDatapoints)
+	}
+}
+
+// Removes a batch that the sink rejected outright, so that retrying it won't
+// help
+func (s *DatapointSpool) reject(batch *spoolBatch) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.removeBatch(batch) {
+		atomic.AddInt64(&s.datapointsRejected, batch.numDatapoints)
+	}
+}
+
+// Must be called with the lock held.  Returns false if the batch was already
+// removed.
+func (s *DatapointSpool) removeBatch(batch *spoolBatch) bool {
+	for i := range s.batches {
+		if s.batches[i] == batch {
+			s.remove(i)
+			return true
+		}
+	}
+	return false
+}
+
+func readSpoolFile(path string) ([]*datapoint.Datapoint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dps := make([]*datapoint.Datapoint, 0)
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var sdp spooledDatapoint
+		if err := dec.Decode(&sdp); err != nil {
+			return nil, err
+		}
+		dps = append(dps, sdp.toDatapoint())
+	}
+	return dps, nil
+}
+
+func toSpooledDatapoint(dp *datapoint.Datapoint) *spooledDatapoint {
+	sdp := &spooledDatapoint{
+		Metric:      dp.Metric,
+		Dimensions:  dp.Dimensions,
+		MetricType:  int(dp.MetricType),
+		TimestampMs: dp.Timestamp.UnixNano() / int64(time.Millisecond),
+	}
+
+	switch v := dp.Value.(type) {
+	case datapoint.IntValue:
+		i := v.Int()
+		sdp.IntValue = &i
+	case datapoint.FloatValue:
+		f := v.Float()
+		sdp.FloatValue = &f
+	default:
+		str := dp.Value.String()
+		sdp.StrValue = &str
+	}
+	return sdp
+}
+
+func (sdp *spooledDatapoint) toDatapoint() *datapoint.Datapoint {
+	var value datapoint.Value
+	switch {
+	case sdp.IntValue != nil:
+		value = datapoint.NewIntValue(*sdp.IntValue)
+	case sdp.FloatValue != nil:
+		value = datapoint.NewFloatValue(*sdp.FloatValue)
+	case sdp.StrValue != nil:
+		value = datapoint.NewStringValue(*sdp.StrValue)
+	}
+
+	return datapoint.New(sdp.Metric,
+		sdp.Dimensions,
+		value,
+		datapoint.MetricType(sdp.MetricType),
+		time.Unix(0, sdp.TimestampMs*int64(time.Millisecond)))
+}
+
+// Satisfies the sfxclient.Collector interface to report how deep the spool
+// is.
+func (s *DatapointSpool) Datapoints() []*datapoint.Datapoint {
+	s.lock.Lock()
+	numBatches := int64(len(s.batches))
+	totalSize := s.totalSize
+	var numDatapoints int64
+	for _, b := range s.batches {
+		numDatapoints += b.numDatapoints
+	}
+	s.lock.Unlock()
+
+	return []*datapoint.Datapoint{
+		sfxclient.Gauge("spool.batches", nil, numBatches),
+		sfxclient.Gauge("spool.bytes", nil, totalSize),
+		sfxclient.Gauge("spool.datapoints", nil, numDatapoints),
+		sfxclient.CumulativeP("spool.datapoints_spooled", nil, &s.datapointsSpooled),
+		sfxclient.CumulativeP("spool.datapoints_replayed", nil, &s.datapointsReplayed),
+		sfxclient.CumulativeP("spool.datapoints_dropped", nil, &s.datapointsDropped),
+		sfxclient.CumulativeP("spool.datapoints_rejected", nil, &s.datapointsRejected),
+	}
+}
+
+const (
+	spoolReplayMinBackoff = 1 * time.Second
+	spoolReplayMaxBackoff = 2 * time.Minute
+)
+
+// The SpoolingClient wraps a SignalFxClient and writes any datapoints that
+// fail to send to a DatapointSpool.  `Run` replays the spool in the
+// background, backing off exponentially while the sink is still failing.
+// While anything is spooled, new datapoints are spooled behind it so that
+// the sink gets them all in order.
+type SpoolingClient struct {
+	client SignalFxClient
+	spool  *DatapointSpool
+	// Replays the spool without waiting out the backoff
+	wake chan struct{}
+}
+
+func NewSpoolingClient(client SignalFxClient, spool *DatapointSpool) *SpoolingClient {
+	return &SpoolingClient{
+		client: client,
+		spool:  spool,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func (o *SpoolingClient) AddDatapoints(ctx context.Context, dps []*datapoint.Datapoint) error {
+	if !o.spool.isEmpty() {
+		if err := o.spool.Write(dps); err != nil {
+			return fmt.Errorf("could not spool datapoints behind the ones waiting to be replayed: %v", err)
+		}
+		// Tries the sink as often as pushing directly would
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+
+	err := o.client.AddDatapoints(ctx, dps)
+	if err == nil || isRejection(err) {
+		return err
+	}
+
+	if spoolErr := o.spool.Write(dps); spoolErr != nil {
+		return fmt.Errorf("%v (could not spool datapoints for retry: %v)", err, spoolErr)
+	}
+	return fmt.Errorf("%v (spooled %d datapoints for retry)", err, len(dps))
+}
+
+// Replays the spool until ctx is canceled.  Whatever is still spooled then is
+// replayed the next time the bridge starts.
+func (o *SpoolingClient) Run(ctx context.Context) error {
+	backoff := spoolReplayMinBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		case <-o.wake:
+		}
+
+		err := o.replay(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			backoff = spoolReplayMinBackoff
+			continue
+		}
+
+		backoff *= 2
+		if backoff > spoolReplayMaxBackoff {
+			backoff = spoolReplayMaxBackoff
+		}
+		log.Printf("Could not replay spooled datapoints, retrying in %s: %v", backoff, err)
+	}
+}
+
+// Sends spooled batches, oldest first, until the spool is empty or the sink
+// fails again.  Batches the sink rejects are dropped rather than holding up
+// the ones behind them.
+func (o *SpoolingClient) replay(ctx context.Context) error {
+	for {
+		batch, dps := o.spool.peek()
+		if batch == nil {
+			return nil
+		}
+
+		pushCtx, cancel := context.WithTimeout(ctx, pushTimeout)
+		err := o.client.AddDatapoints(pushCtx, dps)
+		cancel()
+		if err != nil {
+			if !isRejection(err) {
+				return err
+			}
+			log.Printf("Dropping %d spooled datapoints that SignalFx rejected: %v", len(dps), err)
+			o.spool.reject(batch)
+			continue
+		}
+
+		DebugLog("Replayed %d spooled datapoints", len(dps))
+		o.spool.ack(batch)
+	}
+}
+
+// Whether the sink rejected the datapoints themselves with a 4xx status.
+// Timeouts, throttling and auth errors are retried since they will likely
+// pass once the sink or the token is fixed.
+func isRejection(err error) bool {
+	var apiErr *sfxclient.SFXAPIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return apiErr.StatusCode >= 400 && apiErr.StatusCode < 500
+}
@@ -0,0 +1,224 @@
+package metrics_test
+
+import (
+    "context"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "time"
+
+    "github.com/signalfx/golib/v3/datapoint"
+    "github.com/signalfx/golib/v3/sfxclient"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+    . "github.com/signalfx/signalfx-cloudfoundry-bridge/testhelpers"
+
+    "github.com/signalfx/signalfx-cloudfoundry-bridge/metrics"
+)
+
+var _ = Describe("DatapointSpool", func() {
+    var spoolDir string
+    var sink *FakeSink
+
+    makeDatapoints := func(metric string, timestamps ...time.Time) []*datapoint.Datapoint {
+        dps := make([]*datapoint.Datapoint, 0, len(timestamps))
+        for i, ts := range timestamps {
+            dps = append(dps, datapoint.New(metric,
+                map[string]string{"deployment": "cf"},
+                datapoint.NewIntValue(int64(i)),
+                datapoint.Gauge,
+                ts))
+        }
+        return dps
+    }
+
+    metricNames := func(dps []*datapoint.Datapoint) []string {
+        names := make([]string, 0, len(dps))
+        for _, dp := range dps {
+            names = append(names, dp.Metric)
+        }
+        return names
+    }
+
+    spoolGauge := func(spool *metrics.DatapointSpool, metric string) int64 {
+        for _, dp := range spool.Datapoints() {
+            if dp.Metric == metric {
+                return dp.Value.(datapoint.IntValue).Int()
+            }
+        }
+        Fail("No spool metric " + metric)
+        return 0
+    }
+
+    BeforeEach(func() {
+        var err error
+        spoolDir, err = ioutil.TempDir("", "spool-test")
+        Expect(err).ToNot(HaveOccurred())
+
+        sink = NewFakeSink()
+    })
+
+    AfterEach(func() {
+        os.RemoveAll(spoolDir)
+    })
+
+    It("spools failed pushes and replays them in timestamp order once the sink recovers", func() {
+        spool, err := metrics.NewDatapointSpool(spoolDir, 0, 0)
+        Expect(err).ToNot(HaveOccurred())
+        client := metrics.NewSpoolingClient(sink, spool)
+
+        now := time.Now()
+        sink.SetFailing(true)
+
+        err = client.AddDatapoints(context.Background(),
+            makeDatapoints("later", now.Add(-10*time.Second), now.Add(-20*time.Second)))
+        Expect(err).To(HaveOccurred())
+        // Spooled behind the first batch without trying the sink
+        err = client.AddDatapoints(context.Background(),
+            makeDatapoints("earlier", now.Add(-30*time.Second)))
+        Expect(err).ToNot(HaveOccurred())
+
+        Expect(sink.Received()).To(BeEmpty())
+        Expect(spoolGauge(spool, "spool.batches")).To(Equal(int64(2)))
+        Expect(spoolGauge(spool, "spool.datapoints")).To(Equal(int64(3)))
+
+        defer RunInBackground(client)()
+
+        sink.SetFailing(false)
+
+        Eventually(func() []*datapoint.Datapoint { return sink.Received() }, 5).Should(HaveLen(3))
+        Expect(metricNames(sink.Received())).To(Equal([]string{"earlier", "later", "later"}))
+
+        received := sink.Received()
+        Expect(received[1].Timestamp.Before(received[2].Timestamp)).To(BeTrue())
+
+        Expect(spoolGauge(spool, "spool.batches")).To(Equal(int64(0)))
+        Expect(spoolGauge(spool, "spool.datapoints_replayed")).To(Equal(int64(3)))
+    })
+
+    It("sends new datapoints after the spooled ones once the sink recovers", func() {
+        spool, err := metrics.NewDatapointSpool(spoolDir, 0, 0)
+        Expect(err).ToNot(HaveOccurred())
+        client := metrics.NewSpoolingClient(sink, spool)
+
+        now := time.Now()
+        sink.SetFailing(true)
+        err = client.AddDatapoints(context.Background(), makeDatapoints("old", now.Add(-time.Minute)))
+        Expect(err).To(HaveOccurred())
+
+        // Lets the replay back off well past the test's timeouts
+        stop := RunInBackground(client)
+        defer func() { stop() }()
+        time.Sleep(4 * time.Second)
+
+        sink.SetFailing(false)
+        Expect(client.AddDatapoints(context.Background(), makeDatapoints("new", now))).To(Succeed())
+
+        Eventually(func() []*datapoint.Datapoint { return sink.Received() }, 2).Should(HaveLen(2))
+        Expect(metricNames(sink.Received())).To(Equal([]string{"old", "new"}))
+        Expect(spoolGauge(spool, "spool.batches")).To(Equal(int64(0)))
+    })
+
+    It("doesn't spool datapoints that the sink rejects", func() {
+        spool, err := metrics.NewDatapointSpool(spoolDir, 0, 0)
+        Expect(err).ToNot(HaveOccurred())
+        client := metrics.NewSpoolingClient(sink, spool)
+
+        sink.FailWith(&sfxclient.SFXAPIError{StatusCode: 400, ResponseBody: "bad datapoint"})
+        err = client.AddDatapoints(context.Background(), makeDatapoints("rejected", time.Now()))
+        Expect(err).To(HaveOccurred())
+
+        Expect(spoolGauge(spool, "spool.batches")).To(Equal(int64(0)))
+        Expect(spoolGauge(spool, "spool.datapoints_spooled")).To(Equal(int64(0)))
+    })
+
+    It("drops the oldest batches when the spool is over its size cap", func() {
+        spool, err := metrics.NewDatapointSpool(spoolDir, 300, 0)
+        Expect(err).ToNot(HaveOccurred())
+
+        now := time.Now()
+        for i := 0; i < 10; i++ {
+            Expect(spool.Write(makeDatapoints("metric", now.Add(time.Duration(i)*time.Second)))).To(Succeed())
+        }
+
+        Expect(spoolGauge(spool, "spool.bytes")).To(BeNumerically("<=", 300))
+        Expect(spoolGauge(spool, "spool.datapoints_dropped")).To(BeNumerically(">", 0))
+        Expect(spoolGauge(spool, "spool.datapoints") + spoolGauge(spool, "spool.datapoints_dropped")).To(Equal(int64(10)))
+    })
+
+    It("drops batches that are older than the max age", func() {
+        spool, err := metrics.NewDatapointSpool(spoolDir, 0, time.Minute)
+        Expect(err).ToNot(HaveOccurred())
+
+        now := time.Now()
+        Expect(spool.Write(makeDatapoints("old", now.Add(-2*time.Minute)))).To(Succeed())
+        Expect(spool.Write(makeDatapoints("new", now))).To(Succeed())
+
+        Expect(spoolGauge(spool, "spool.batches")).To(Equal(int64(1)))
+        Expect(spoolGauge(spool, "spool.datapoints_dropped")).To(Equal(int64(1)))
+    })
+
+    It("picks up batches spooled by a previous run", func() {
+        spool, err := metrics.NewDatapointSpool(spoolDir, 0, 0)
+        Expect(err).ToNot(HaveOccurred())
+        Expect(spool.Write(makeDatapoints("leftover", time.Now()))).To(Succeed())
+
+        spool, err = metrics.NewDatapointSpool(spoolDir, 0, 0)
+        Expect(err).ToNot(HaveOccurred())
+        Expect(spoolGauge(spool, "spool.datapoints")).To(Equal(int64(1)))
+
+        client := metrics.NewSpoolingClient(sink, spool)
+        defer RunInBackground(client)()
+
+        Eventually(func() []*datapoint.Datapoint { return sink.Received() }, 5).Should(HaveLen(1))
+        dp := sink.Received()[0]
+        Expect(dp.Metric).To(Equal("leftover"))
+        Expect(dp.Dimensions["deployment"]).To(Equal("cf"))
+        Expect(dp.Value.(datapoint.IntValue).Int()).To(Equal(int64(0)))
+    })
+
+    It("drops batches that the sink rejects without holding up the rest", func() {
+        spool, err := metrics.NewDatapointSpool(spoolDir, 0, 0)
+        Expect(err).ToNot(HaveOccurred())
+        now := time.Now()
+        Expect(spool.Write(makeDatapoints("rejected", now.Add(-20*time.Second)))).To(Succeed())
+        Expect(spool.Write(makeDatapoints("rejected", now.Add(-10*time.Second)))).To(Succeed())
+
+        sink.FailWith(&sfxclient.SFXAPIError{StatusCode: 400, ResponseBody: "bad datapoint"})
+        client := metrics.NewSpoolingClient(sink, spool)
+        defer RunInBackground(client)()
+
+        // Both within the first replay, rather than backing off after the
+        // first
+        Eventually(func() int64 { return spoolGauge(spool, "spool.datapoints_rejected") }, 1.9).Should(Equal(int64(2)))
+        Expect(spoolGauge(spool, "spool.batches")).To(Equal(int64(0)))
+        Expect(spoolGauge(spool, "spool.datapoints_dropped")).To(Equal(int64(0)))
+    })
+
+    It("keeps retrying batches while the sink is throttling or unreachable", func() {
+        spool, err := metrics.NewDatapointSpool(spoolDir, 0, 0)
+        Expect(err).ToNot(HaveOccurred())
+        Expect(spool.Write(makeDatapoints("throttled", time.Now()))).To(Succeed())
+
+        sink.FailWith(&sfxclient.SFXAPIError{StatusCode: 429})
+        client := metrics.NewSpoolingClient(sink, spool)
+        defer RunInBackground(client)()
+
+        Consistently(func() int64 { return spoolGauge(spool, "spool.batches") }, 1.5).Should(Equal(int64(1)))
+        Expect(spoolGauge(spool, "spool.datapoints_rejected")).To(Equal(int64(0)))
+    })
+
+    It("removes temp files left by a crash while writing a batch", func() {
+        tmpPath := filepath.Join(spoolDir, "00000000000000000001-0000000001-1.spool.tmp")
+        Expect(ioutil.WriteFile(tmpPath, []byte("{\"metric\":"), 0600)).To(Succeed())
+
+        spool, err := metrics.NewDatapointSpool(spoolDir, 0, 0)
+        Expect(err).ToNot(HaveOccurred())
+
+        _, err = os.Stat(tmpPath)
+        Expect(os.IsNotExist(err)).To(BeTrue())
+        Expect(spoolGauge(spool, "spool.batches")).To(Equal(int64(0)))
+        Expect(spoolGauge(spool, "spool.bytes")).To(Equal(int64(0)))
+    })
+})
@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// The long-running parts of the bridge, i.e. the nozzle, the TSDB server,
+// the app metadata fetcher, the dimension properties updater and the spool
+// replayer, are all Components run by a Supervisor in the main package.  When
+// the shared context is canceled, on SIGTERM or because a component failed,
+// each component sends what it still has buffered, within the shutdown
+// timeout, and returns.
+
+// Used when SHUTDOWN_TIMEOUT_SECONDS isn't set
+const defaultShutdownTimeout = 10 * time.Second
+
+type Component interface {
+	// Blocks until ctx is canceled, returning nil, or until the component
+	// fails, returning why
+	Run(ctx context.Context) error
+}
+
+// Lets a plain function be supervised
+type ComponentFunc func(ctx context.Context) error
+
+func (f ComponentFunc) Run(ctx context.Context) error {
+	return f(ctx)
+}
+
+type supervisedComponent struct {
+	name      string
+	component Component
+}
+
+type Supervisor struct {
+	components []supervisedComponent
+}
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{}
+}
+
+// Must be called before `Run`.  The name is used in errors and logs.
+func (s *Supervisor) Add(name string, component Component) {
+	s.components = append(s.components, supervisedComponent{name, component})
+}
+
+// Runs every component until ctx is canceled or the first of them fails or
+// returns early, in which case the rest are stopped by canceling their shared
+// context.  Returns once they have all returned, with the first error.
+func (s *Supervisor) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var lock sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for _, c := range s.components {
+		c := c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := c.component.Run(ctx)
+			if err == nil && ctx.Err() == nil {
+				err = fmt.Errorf("%s stopped unexpectedly", c.name)
+			} else if err != nil {
+				err = fmt.Errorf("%s failed: %v", c.name, err)
+			}
+			if err == nil {
+				return
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if firstErr == nil {
+				firstErr = err
+				log.Printf("Stopping since %v", err)
+				cancel()
+			} else {
+				log.Print(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firstErr
+}
@@ -0,0 +1,92 @@
+package metrics_test
+
+import (
+    "context"
+    "errors"
+    "time"
+
+    . "github.com/onsi/ginkgo"
+    . "github.com/onsi/gomega"
+
+    "github.com/signalfx/signalfx-cloudfoundry-bridge/metrics"
+)
+
+var _ = Describe("Supervisor", func() {
+    var supervisor *metrics.Supervisor
+    // Closed by each blocking component once its context is canceled
+    var stopped []chan struct{}
+
+    blockingComponent := func() metrics.Component {
+        done := make(chan struct{})
+        stopped = append(stopped, done)
+        return metrics.ComponentFunc(func(ctx context.Context) error {
+            <-ctx.Done()
+            close(done)
+            return nil
+        })
+    }
+
+    runSupervisor := func(ctx context.Context) <-chan error {
+        result := make(chan error, 1)
+        go func() {
+            result <- supervisor.Run(ctx)
+        }()
+        return result
+    }
+
+    BeforeEach(func() {
+        supervisor = metrics.NewSupervisor()
+        stopped = nil
+        supervisor.Add("first", blockingComponent())
+        supervisor.Add("second", blockingComponent())
+    })
+
+    It("runs until its context is canceled", func() {
+        ctx, cancel := context.WithCancel(context.Background())
+        result := runSupervisor(ctx)
+        Consistently(result, 0.2).ShouldNot(Receive())
+
+        cancel()
+        Eventually(result).Should(Receive(BeNil()))
+        for _, done := range stopped {
+            Expect(done).To(BeClosed())
+        }
+    })
+
+    It("stops every component when one of them fails", func() {
+        supervisor.Add("failing", metrics.ComponentFunc(func(ctx context.Context) error {
+            return errors.New("port in use")
+        }))
+
+        var err error
+        Eventually(runSupervisor(context.Background())).Should(Receive(&err))
+        Expect(err).To(MatchError("failing failed: port in use"))
+        for _, done := range stopped {
+            Expect(done).To(BeClosed())
+        }
+    })
+
+    It("treats a component returning early as a failure", func() {
+        supervisor.Add("quitter", metrics.ComponentFunc(func(ctx context.Context) error {
+            return nil
+        }))
+
+        var err error
+        Eventually(runSupervisor(context.Background())).Should(Receive(&err))
+        Expect(err).To(MatchError("quitter stopped unexpectedly"))
+    })
+
+    It("waits for every component to return", func() {
+        supervisor.Add("slow", metrics.ComponentFunc(func(ctx context.Context) error {
+            <-ctx.Done()
+            time.Sleep(300 * time.Millisecond)
+            return nil
+        }))
+
+        ctx, cancel := context.WithCancel(context.Background())
+        result := runSupervisor(ctx)
+        cancel()
+        Consistently(result, 0.2).ShouldNot(Receive())
+        Eventually(result).Should(Receive(BeNil()))
+    })
+})
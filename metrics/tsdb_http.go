@@ -0,0 +1,163 @@
+package metrics
+
+// Implements OpenTSDB's HTTP /api/put endpoint, see
+// http://opentsdb.net/docs/build/html/api_http/put.html
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/json"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "log"
+    "net/http"
+    "sync/atomic"
+)
+
+// The largest request body accepted, after decompressing it
+const tsdbHTTPMaxBodyBytes = 10 * 1024 * 1024
+
+// A datapoint in a /api/put request.  The timestamp and value can be numbers
+// or strings, and are parsed like the fields of a telnet put line.
+type tsdbHTTPDatapoint struct {
+    Metric    string            `json:"metric"`
+    Timestamp interface{}       `json:"timestamp"`
+    Value     interface{}       `json:"value"`
+    Tags      map[string]string `json:"tags"`
+}
+
+type tsdbHTTPError struct {
+    Datapoint *tsdbHTTPDatapoint `json:"datapoint"`
+    Error     string             `json:"error"`
+}
+
+// The response body if the summary or details query parameter is given
+type tsdbHTTPResponse struct {
+    Success int              `json:"success"`
+    Failed  int              `json:"failed"`
+    Errors  []*tsdbHTTPError `json:"errors,omitempty"`
+}
+
+func (o *TSDBServer) httpHandler(lines chan<- *tsdbLine) http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/api/put", func(rw http.ResponseWriter, r *http.Request) {
+        o.handlePut(rw, r, lines)
+    })
+    return mux
+}
+
+func (o *TSDBServer) handlePut(rw http.ResponseWriter, r *http.Request, lines chan<- *tsdbLine) {
+    if r.Method != http.MethodPost && r.Method != http.MethodPut {
+        rw.Header().Set("Allow", "POST, PUT")
+        http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    datapoints, err := decodeTSDBHTTPDatapoints(r)
+    if err != nil {
+        atomic.AddInt64(o.linesMalformed[tsdbInvalidJSON], 1)
+        log.Printf("Malformed TSDB HTTP request from %s: %v", r.RemoteAddr, err)
+        http.Error(rw, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    response := &tsdbHTTPResponse{}
+    for i, dp := range datapoints {
+        if dp == nil {
+            dp = &tsdbHTTPDatapoint{}
+            datapoints[i] = dp
+        }
+        atomic.AddInt64(&o.linesReceived, 1)
+
+        fields := []string{dp.Metric, jsonScalarString(dp.Timestamp), jsonScalarString(dp.Value)}
+        for k, v := range dp.Tags {
+            fields = append(fields, k+"="+v)
+        }
+
+        line, err := parseTSDBPut(fields)
+        if err != nil {
+            atomic.AddInt64(o.linesMalformed[err.(*tsdbParseError).reason], 1)
+            response.Failed++
+            response.Errors = append(response.Errors, &tsdbHTTPError{Datapoint: dp, Error: err.Error()})
+            continue
+        }
+        lines <- line
+        response.Success++
+    }
+
+    status := http.StatusNoContent
+    if response.Failed > 0 {
+        status = http.StatusBadRequest
+        log.Printf("%d of %d datapoints from %s were malformed, e.g. %s",
+            response.Failed, len(datapoints), r.RemoteAddr, response.Errors[0].Error)
+    }
+
+    query := r.URL.Query()
+    _, details := query["details"]
+    _, summary := query["summary"]
+    if !details && !summary {
+        rw.WriteHeader(status)
+        return
+    }
+    if !details {
+        response.Errors = nil
+    }
+    if status == http.StatusNoContent {
+        status = http.StatusOK
+    }
+    rw.Header().Set("Content-Type", "application/json")
+    rw.WriteHeader(status)
+    json.NewEncoder(rw).Encode(response)
+}
+
+// The body is either a single datapoint or an array of them
+func decodeTSDBHTTPDatapoints(r *http.Request) ([]*tsdbHTTPDatapoint, error) {
+    var body io.Reader = r.Body
+    if r.Header.Get("Content-Encoding") == "gzip" {
+        gzipReader, err := gzip.NewReader(r.Body)
+        if err != nil {
+            return nil, err
+        }
+        defer gzipReader.Close()
+        body = gzipReader
+    }
+
+    contents, err := ioutil.ReadAll(io.LimitReader(body, tsdbHTTPMaxBodyBytes+1))
+    if err != nil {
+        return nil, err
+    }
+    if len(contents) > tsdbHTTPMaxBodyBytes {
+        return nil, fmt.Errorf("request body is larger than %d bytes", tsdbHTTPMaxBodyBytes)
+    }
+
+    decoder := json.NewDecoder(bytes.NewReader(contents))
+    decoder.UseNumber()
+
+    trimmed := bytes.TrimSpace(contents)
+    if len(trimmed) > 0 && trimmed[0] == '[' {
+        var datapoints []*tsdbHTTPDatapoint
+        if err := decoder.Decode(&datapoints); err != nil {
+            return nil, err
+        }
+        return datapoints, nil
+    }
+
+    datapoint := &tsdbHTTPDatapoint{}
+    if err := decoder.Decode(datapoint); err != nil {
+        return nil, err
+    }
+    return []*tsdbHTTPDatapoint{datapoint}, nil
+}
+
+// Numbers are kept as they were written, e.g. 1493049198.123
+func jsonScalarString(value interface{}) string {
+    switch v := value.(type) {
+    case json.Number:
+        return v.String()
+    case string:
+        return v
+    default:
+        return fmt.Sprint(v)
+    }
+}
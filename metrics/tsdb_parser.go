@@ -0,0 +1,164 @@
+package metrics
+
+// Parses the OpenTSDB telnet protocol, see
+// http://opentsdb.net/docs/build/html/api_telnet/put.html
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+)
+
+// Why a TSDB line couldn't be parsed, reported as the reason dimension of the
+// tsdb.lines_malformed self-metric
+const (
+    tsdbUnknownCommand   = "unknown_command"
+    tsdbMissingFields    = "missing_fields"
+    tsdbInvalidMetric    = "invalid_metric"
+    tsdbInvalidTimestamp = "invalid_timestamp"
+    tsdbInvalidValue     = "invalid_value"
+    tsdbInvalidTag       = "invalid_tag"
+    tsdbDuplicateTag     = "duplicate_tag"
+    // A telnet line was longer than tsdbMaxLineLength
+    tsdbLineTooLong      = "line_too_long"
+    // The body of an HTTP request couldn't be decoded at all
+    tsdbInvalidJSON      = "invalid_json"
+)
+
+var tsdbMalformedReasons = []string{
+    tsdbUnknownCommand,
+    tsdbMissingFields,
+    tsdbInvalidMetric,
+    tsdbInvalidTimestamp,
+    tsdbInvalidValue,
+    tsdbInvalidTag,
+    tsdbDuplicateTag,
+    tsdbLineTooLong,
+    tsdbInvalidJSON,
+}
+
+type tsdbParseError struct {
+    reason  string
+    message string
+}
+
+func (e *tsdbParseError) Error() string {
+    return e.message
+}
+
+func newTSDBParseError(reason string, format string, args ...interface{}) *tsdbParseError {
+    return &tsdbParseError{reason: reason, message: fmt.Sprintf(format, args...)}
+}
+
+// A parsed TSDB line, before it is enriched
+type tsdbLine struct {
+    metric     string
+    timestamp  time.Time
+    value      float64
+    dimensions map[string]string
+}
+
+// Parses the fields of a put command after the "put" itself:
+//
+//   <metric> <timestamp> <value> <tagk1=tagv1 ...>
+//
+// Fields can be separated by any amount of whitespace.  The timestamp is in
+// seconds, or in milliseconds if it has 13 digits or 3 decimal places.  Tags
+// are optional, unlike in OpenTSDB itself.
+func parseTSDBPut(fields []string) (*tsdbLine, error) {
+    if len(fields) < 3 {
+        return nil, newTSDBParseError(tsdbMissingFields,
+            "put needs a metric, timestamp and value, got %d fields", len(fields))
+    }
+
+    metric := fields[0]
+    if !validTSDBString(metric) {
+        return nil, newTSDBParseError(tsdbInvalidMetric, "invalid metric name %q", metric)
+    }
+
+    timestamp, ok := parseTSDBTimestamp(fields[1])
+    if !ok {
+        return nil, newTSDBParseError(tsdbInvalidTimestamp, "invalid timestamp %q", fields[1])
+    }
+
+    value, err := strconv.ParseFloat(fields[2], 64)
+    if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+        return nil, newTSDBParseError(tsdbInvalidValue, "invalid value %q", fields[2])
+    }
+
+    dimensions := make(map[string]string, len(fields)-2)
+    for _, tag := range fields[3:] {
+        // Values can't contain "=" so splitting on the first one is enough
+        // to reject them
+        parts := strings.SplitN(tag, "=", 2)
+        if len(parts) != 2 || !validTSDBString(parts[0]) || !validTSDBString(parts[1]) {
+            return nil, newTSDBParseError(tsdbInvalidTag, "invalid tag %q", tag)
+        }
+        if _, ok := dimensions[parts[0]]; ok {
+            return nil, newTSDBParseError(tsdbDuplicateTag, "duplicate tag %q", parts[0])
+        }
+        dimensions[parts[0]] = parts[1]
+    }
+
+    // "id" is a reserved property in the backend so don't use it
+    dimensions["bosh_id"] = dimensions["id"]
+    delete(dimensions, "id")
+
+    dimensions["metric_source"] = "cloudfoundry"
+
+    return &tsdbLine{
+        metric:     metric,
+        timestamp:  timestamp,
+        value:      value,
+        dimensions: dimensions,
+    }, nil
+}
+
+// E.g. 1493049198, 1493049198123 or 1493049198.123
+func parseTSDBTimestamp(field string) (time.Time, bool) {
+    digits := field
+    millis := false
+    if i := strings.IndexByte(field, '.'); i >= 0 {
+        if i == 0 || i > 10 || len(field)-i != 4 {
+            return time.Time{}, false
+        }
+        digits = field[:i] + field[i+1:]
+        millis = true
+    } else if len(digits) == 13 {
+        millis = true
+    } else if len(digits) > 10 {
+        return time.Time{}, false
+    }
+
+    for _, c := range digits {
+        if c < '0' || c > '9' {
+            return time.Time{}, false
+        }
+    }
+    n, err := strconv.ParseInt(digits, 10, 64)
+    if err != nil || n <= 0 {
+        return time.Time{}, false
+    }
+
+    if millis {
+        return time.Unix(0, n*int64(time.Millisecond)), true
+    }
+    return time.Unix(n, 0), true
+}
+
+// Metric names and tags can only have letters, digits and -_./ like in
+// OpenTSDB
+func validTSDBString(s string) bool {
+    if s == "" {
+        return false
+    }
+    for _, c := range s {
+        if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !strings.ContainsRune("-_./", c) {
+            return false
+        }
+    }
+    return true
+}
@@ -1,20 +1,28 @@
 package metrics
 
-// This code is adapted from the bosh-hm-forwarder app at
+// We act as an OpenTSDB "Telnet" server that the BOSH HM sends VM metrics to,
+// like the bosh-hm-forwarder app at
 // https://github.com/cloudfoundry/bosh-hm-forwarder
-// Basically, we need to act as a TSDB "Telnet" server that Bosh HM sends VM
-// metrics to
 
 import (
+    "bufio"
+    "context"
+    "crypto/tls"
+    "crypto/x509"
     "fmt"
+    "io/ioutil"
     "log"
-    "time"
-    "strings"
+    "net"
+    "net/http"
+    "sort"
     "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
 
-    "github.com/cloudfoundry/bosh-hm-forwarder/tcp"
     "github.com/signalfx/golib/v3/datapoint"
-    "golang.org/x/net/context"
+    "github.com/signalfx/golib/v3/sfxclient"
 )
 
 // This is the port that the BOSH HM OpenTSDB plugin is configured to connect
@@ -24,85 +32,345 @@ const tsdbPort = 13321
 
 const initialBufferCapacity = 10000
 
+// How long to wait for clients to read the response to a command
+const tsdbWriteTimeout = 10 * time.Second
+
+// The longest line that will be read, well beyond what a put line with many
+// tags needs.  Connections that send longer lines are closed.
+const tsdbMaxLineLength = 1024 * 1024
+
 type TSDBServer struct {
     MetricFilter
+    config        *Config
     client        SignalFxClient
     flushInterval int
     port          int
-    bosh          *BoshMetadataFetcher
-    stop          chan bool
+    // The port of the HTTP /api/put endpoint, or 0 if it is disabled
+    httpPort      int
+    enrichers     EnricherChain
+    rewriter      *DatapointRewriter
+
+    connsLock sync.Mutex
+    // The open telnet connections, which are closed when stopping
+    conns     map[net.Conn]bool
+    stopped   bool
+
+    // Self-metrics, see `Datapoints`.  The map is filled up front with every
+    // reason so that it is never written to concurrently.
+    linesReceived      int64
+    linesMalformed     map[string]*int64
+    linesFiltered      int64
+    datapointsFiltered int64
+    pushStats          pushStats
 }
 
-func NewTSDBServer(client SignalFxClient, flushInterval int, port int, bosh *BoshMetadataFetcher, metricFilter *MetricFilter) *TSDBServer {
+func NewTSDBServer(config *Config, client SignalFxClient, enrichers EnricherChain, metricFilter *MetricFilter, rewriter *DatapointRewriter) *TSDBServer {
+    port := config.TSDBPort
     if port == 0 {
         port = tsdbPort
     }
 
+    linesMalformed := make(map[string]*int64)
+    for _, reason := range tsdbMalformedReasons {
+        linesMalformed[reason] = new(int64)
+    }
+
     return &TSDBServer{
         MetricFilter:     *metricFilter,
+        config:           config,
         client:           client,
-        flushInterval:    flushInterval,
+        flushInterval:    config.FlushIntervalSeconds,
         port:             port,
-        bosh:             bosh,
-        stop:             make(chan bool),
+        httpPort:         config.TSDBHTTPPort,
+        enrichers:        enrichers,
+        rewriter:         rewriter,
+        conns:            make(map[net.Conn]bool),
+        linesMalformed:   linesMalformed,
     }
 }
 
-// We accept port purely so we don't muck with global variables in testing
-func (o *TSDBServer) Start() (error) {
-    err := tcp.Open(o.port, o.startMessageHandler())
+// Accepts connections until ctx is canceled or accepting fails.  Both ports
+// are opened before any connections are accepted, so that an error is
+// returned if either is in use.  When stopping, the open connections are
+// closed and HTTP requests in flight are waited for, and then the datapoints
+// that are still buffered are sent, all within the shutdown timeout.
+func (o *TSDBServer) Run(ctx context.Context) error {
+    tlsConfig, err := o.tlsConfig()
+    if err != nil {
+        log.Print("Could not load the TSDB server TLS config: ", err)
+        return err
+    }
+
+    listener, err := o.listen(o.port, tlsConfig)
     if err != nil {
-        log.Print("Could not open TSDB server port", err)
+        log.Print("Could not open TSDB server port: ", err)
+        return err
+    }
+
+    var httpListener net.Listener
+    if o.httpPort != 0 {
+        httpListener, err = o.listen(o.httpPort, tlsConfig)
+        if err != nil {
+            listener.Close()
+            log.Print("Could not open TSDB server HTTP port: ", err)
+            return err
+        }
+    }
+
+    // BOSH lookups and pushes in progress when ctx is canceled get until the
+    // shutdown timeout to finish
+    workCtx, cancelWork := context.WithCancel(context.Background())
+    defer cancelWork()
+
+    lines := make(chan *tsdbLine, initialBufferCapacity)
+    stop := make(chan struct{})
+    handled := make(chan struct{})
+    go func() {
+        o.handleMessages(workCtx, lines, stop)
+        close(handled)
+    }()
+
+    // Either port failing stops the server
+    failed := make(chan error, 2)
+    go func() {
+        failed <- o.accept(listener, lines)
+    }()
+
+    var httpServer *http.Server
+    if httpListener != nil {
+        httpServer = &http.Server{Handler: o.httpHandler(lines)}
+        go func() {
+            failed <- o.serveHTTP(httpServer, httpListener)
+        }()
+    }
+
+    select {
+    case <-ctx.Done():
+    case err = <-failed:
+        log.Print("TSDB server stopped accepting connections: ", err)
+    }
+
+    timer := time.AfterFunc(o.config.shutdownTimeout(), cancelWork)
+    defer timer.Stop()
+
+    o.stopAccepting(listener)
+    if httpServer != nil {
+        if shutdownErr := httpServer.Shutdown(workCtx); shutdownErr != nil {
+            log.Print("Error stopping the TSDB server HTTP endpoint: ", shutdownErr)
+        }
+    }
+
+    close(stop)
+    select {
+    case <-handled:
+    case <-workCtx.Done():
+        log.Print("Gave up sending the buffered BOSH HM datapoints: ", workCtx.Err())
     }
     return err
 }
 
-func (o *TSDBServer) Stop() {
-    o.stop <- true
+// Returns nil once the listener is closed by `stopAccepting`
+func (o *TSDBServer) accept(listener net.Listener, lines chan<- *tsdbLine) error {
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            if o.isStopped() {
+                return nil
+            }
+            return err
+        }
+        if o.trackConn(conn) {
+            go o.handleConnection(conn, lines)
+        }
+    }
+}
+
+func (o *TSDBServer) stopAccepting(listener net.Listener) {
+    o.connsLock.Lock()
+    defer o.connsLock.Unlock()
+    o.stopped = true
+    listener.Close()
+    for conn := range o.conns {
+        conn.Close()
+    }
+}
+
+// Returns false, after closing the connection, if the server is stopping
+func (o *TSDBServer) trackConn(conn net.Conn) bool {
+    o.connsLock.Lock()
+    defer o.connsLock.Unlock()
+    if o.stopped {
+        conn.Close()
+        return false
+    }
+    o.conns[conn] = true
+    return true
 }
 
-func (o *TSDBServer) startMessageHandler() chan<- string {
-    // Buffer the channel so that the channel hopefully won't ever block when
-    // the metrics are in the process of being shipped to the ingest API.
-    dataCh := make(chan string, initialBufferCapacity)
+func (o *TSDBServer) untrackConn(conn net.Conn) {
+    o.connsLock.Lock()
+    defer o.connsLock.Unlock()
+    delete(o.conns, conn)
+}
 
-    go o.handleMessages(dataCh)
-    return dataCh
+func (o *TSDBServer) listen(port int, tlsConfig *tls.Config) (net.Listener, error) {
+    listener, err := net.Listen("tcp", net.JoinHostPort(o.config.TSDBListenAddress, strconv.Itoa(port)))
+    if err != nil {
+        return nil, err
+    }
+    if tlsConfig != nil {
+        listener = tls.NewListener(listener, tlsConfig)
+    }
+    return listener, nil
 }
 
+// Returns nil if TLS isn't configured
+func (o *TSDBServer) tlsConfig() (*tls.Config, error) {
+    if o.config.TSDBTLSCertFile == "" {
+        return nil, nil
+    }
 
-func (o *TSDBServer) handleMessages(tsdbLines chan string) {
+    cert, err := tls.LoadX509KeyPair(o.config.TSDBTLSCertFile, o.config.TSDBTLSKeyFile)
+    if err != nil {
+        return nil, err
+    }
+    tlsConfig := &tls.Config{
+        Certificates: []tls.Certificate{cert},
+        MinVersion:   tls.VersionTLS12,
+    }
+
+    if o.config.TSDBTLSClientCAFile != "" {
+        caCerts, err := ioutil.ReadFile(o.config.TSDBTLSClientCAFile)
+        if err != nil {
+            return nil, err
+        }
+        clientCAs := x509.NewCertPool()
+        if !clientCAs.AppendCertsFromPEM(caCerts) {
+            return nil, fmt.Errorf("no certificates found in %s", o.config.TSDBTLSClientCAFile)
+        }
+        tlsConfig.ClientCAs = clientCAs
+        tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+    }
+    return tlsConfig, nil
+}
+
+// Returns nil once the server is shut down
+func (o *TSDBServer) serveHTTP(server *http.Server, listener net.Listener) error {
+    if err := server.Serve(listener); err != http.ErrServerClosed {
+        return err
+    }
+    return nil
+}
+
+func (o *TSDBServer) isStopped() bool {
+    o.connsLock.Lock()
+    defer o.connsLock.Unlock()
+    return o.stopped
+}
+
+// Lines are parsed on each connection's goroutine, and only the put commands
+// that parse are passed on to be enriched, filtered and buffered
+func (o *TSDBServer) handleConnection(conn net.Conn, lines chan<- *tsdbLine) {
+    defer o.untrackConn(conn)
+    defer conn.Close()
+
+    scanner := bufio.NewScanner(conn)
+    scanner.Buffer(make([]byte, bufio.MaxScanTokenSize), tsdbMaxLineLength)
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) == 0 {
+            continue
+        }
+        atomic.AddInt64(&o.linesReceived, 1)
+
+        var err error
+        switch fields[0] {
+        case "put":
+            var line *tsdbLine
+            line, err = parseTSDBPut(fields[1:])
+            if err == nil {
+                lines <- line
+            }
+        case "version":
+            err = o.respond(conn, "signalfx-cloudfoundry-bridge OpenTSDB telnet server\n")
+        case "stats":
+            err = o.respond(conn, o.formatStats())
+        case "exit":
+            return
+        default:
+            err = newTSDBParseError(tsdbUnknownCommand, "unknown command %q", fields[0])
+        }
+
+        if parseErr, ok := err.(*tsdbParseError); ok {
+            atomic.AddInt64(o.linesMalformed[parseErr.reason], 1)
+            log.Printf("Malformed TSDB line from %s: %v", conn.RemoteAddr(), err)
+        } else if err != nil {
+            log.Printf("Could not respond to TSDB client %s: %v", conn.RemoteAddr(), err)
+            return
+        }
+    }
+
+    // The rest of the connection can't be read once a line is too long,
+    // since the next line can't be found
+    if err := scanner.Err(); err == bufio.ErrTooLong {
+        atomic.AddInt64(&o.linesReceived, 1)
+        atomic.AddInt64(o.linesMalformed[tsdbLineTooLong], 1)
+        log.Printf("Closing TSDB connection from %s after a line over %d bytes", conn.RemoteAddr(), tsdbMaxLineLength)
+    } else if err != nil && !o.isStopped() {
+        log.Printf("Could not read from TSDB client %s: %v", conn.RemoteAddr(), err)
+    }
+}
+
+func (o *TSDBServer) respond(conn net.Conn, response string) error {
+    conn.SetWriteDeadline(time.Now().Add(tsdbWriteTimeout))
+    _, err := conn.Write([]byte(response))
+    return err
+}
+
+// The self-metrics as put lines, like OpenTSDB's own stats command
+func (o *TSDBServer) formatStats() string {
+    var stats strings.Builder
+    now := time.Now().Unix()
+    for _, dp := range o.Datapoints() {
+        fmt.Fprintf(&stats, "signalfx_bridge.%s %d %s", dp.Metric, now, dp.Value)
+
+        tags := make([]string, 0, len(dp.Dimensions))
+        for k, v := range dp.Dimensions {
+            tags = append(tags, k+"="+v)
+        }
+        sort.Strings(tags)
+        for _, tag := range tags {
+            stats.WriteString(" " + tag)
+        }
+        stats.WriteString("\n")
+    }
+    return stats.String()
+}
+
+// The lines channel is buffered so that it hopefully won't ever block when
+// the metrics are in the process of being shipped to the ingest API.  Once
+// stop is closed, the lines left in the channel are buffered and everything is
+// pushed one last time.
+func (o *TSDBServer) handleMessages(ctx context.Context, tsdbLines chan *tsdbLine, stop <-chan struct{}) {
     ticker := time.NewTicker(time.Second * time.Duration(o.flushInterval))
     defer ticker.Stop()
 
     datapointBuffer := make([]*datapoint.Datapoint, 0, initialBufferCapacity)
 
-    var message string
     for {
         select {
-        case <- o.stop:
-            return
-        case message = <-tsdbLines:
-            dp, err := o.buildDatapoint(message)
-            if err != nil || !o.shouldShipDatapoint(dp) {
-                continue
+        case <-stop:
+            // The connections are closed by now, so these are the last lines
+            for len(tsdbLines) > 0 {
+                datapointBuffer = o.bufferLine(ctx, datapointBuffer, <-tsdbLines)
             }
-
-            datapointBuffer = append(datapointBuffer, dp)
+            o.pushDatapoints(ctx, datapointBuffer)
+            return
+        case line := <-tsdbLines:
+            datapointBuffer = o.bufferLine(ctx, datapointBuffer, line)
         case <-ticker.C:
             // Just send the datapoints synchronously for now since the data channel can buffer
-            err := o.client.AddDatapoints(context.Background(), datapointBuffer)
-
-            log.Printf("Pushing %d BOSH HM datapoints to SignalFx", len(datapointBuffer))
-
-            // Right now if there is an error shipping the datapoints to
-            // SignalFx, we just forget about them and move on.  Some other
-            // possiblities are: letting the buffer grow and just retry sending
-            // them on the next tick; or immediately retrying one (or a fixed
-            // number of) additional times.
-            if err != nil {
-                log.Println("Error pushing datapoints: ", err)
-            }
+            o.pushDatapoints(ctx, datapointBuffer)
 
             // Old datapoints will be GC'd as they are overwritten in the
             // backing array of the slice.  Conceivably, if one interval had an
@@ -119,57 +387,61 @@ func (o *TSDBServer) handleMessages(tsdbLines chan string) {
     }
 }
 
-func buildMap(tokens []string, startAt int) map[string]string {
-    parsed := make(map[string]string)
+func (o *TSDBServer) bufferLine(ctx context.Context, datapointBuffer []*datapoint.Datapoint, line *tsdbLine) []*datapoint.Datapoint {
+    // Skip enriching lines that would be dropped, e.g. looking up
+    // their VM in BOSH
+    if !o.shouldProcessTSDBLine(line) {
+        atomic.AddInt64(&o.linesFiltered, 1)
+        return datapointBuffer
+    }
 
-    for i := startAt; i < len(tokens); i++ {
-        token := tokens[i]
-        split := strings.Split(token, "=")
-        value := ""
-        if len(split) > 1 {
-            value = split[1]
-        }
-        parsed[split[0]] = value
+    dp := o.buildDatapoint(ctx, line)
+    if !o.shouldShipDatapoint(dp) {
+        atomic.AddInt64(&o.datapointsFiltered, 1)
+        return datapointBuffer
     }
-    return parsed
+    o.rewriter.Rewrite(dp)
+
+    return append(datapointBuffer, dp)
 }
 
-func (o *TSDBServer) buildDatapoint(message string) (*datapoint.Datapoint, error) {
-    tokens := strings.Split(message, " ")
+func (o *TSDBServer) pushDatapoints(ctx context.Context, datapointBuffer []*datapoint.Datapoint) {
+    err := o.pushStats.addDatapoints(ctx, o.client, datapointBuffer)
 
-    if len(tokens) < 4 {
-        return nil, fmt.Errorf("Malformed TSDB message: %s", message)
-    }
+    log.Printf("Pushing %d BOSH HM datapoints to SignalFx", len(datapointBuffer))
 
-    metricName := tokens[1]
-    secondsSinceEpoch, err := strconv.ParseInt(tokens[2], 10, 64)
-    if err != nil {
-        log.Println("Cannot parse message: ", err)
-        return nil, err
-    }
-    value, err := strconv.ParseFloat(tokens[3], 64)
+    // If there is an error shipping the datapoints to SignalFx, we
+    // just forget about them and move on.  Retrying is left to the
+    // client, which will have spooled them to disk if that is
+    // enabled.
     if err != nil {
-        log.Println("Cannot parse message: ", err)
-        return nil, err
+        log.Println("Error pushing datapoints: ", err)
     }
-    dimensions := buildMap(tokens, 4)
-
-	// "id" is a reserved property in the backend so don't use it
-	dimensions["bosh_id"] = dimensions["id"]
-	delete(dimensions, "id")
+}
 
-    dimensions["metric_source"] = "cloudfoundry"
+// Satisfies the sfxclient.Collector interface to report on the TSDB server
+// itself
+func (o *TSDBServer) Datapoints() []*datapoint.Datapoint {
+    dps := o.pushStats.datapoints("tsdb")
 
-    if dimensions["bosh_id"] != "" {
-        ipAddr := o.bosh.GetVMIPAddress(dimensions["deployment"], dimensions["bosh_id"])
-        if ipAddr != "" {
-            dimensions["host"] = ipAddr
-        }
+    for reason, counter := range o.linesMalformed {
+        dps = append(dps, sfxclient.CumulativeP("tsdb.lines_malformed",
+            map[string]string{"reason": reason},
+            counter))
     }
 
-    return datapoint.New(metricName,
-                         dimensions,
-                         datapoint.NewFloatValue(value),
-                         datapoint.Gauge,
-                         time.Unix(secondsSinceEpoch, 0)), nil
+    return append(dps,
+        sfxclient.CumulativeP("tsdb.lines_received", nil, &o.linesReceived),
+        sfxclient.CumulativeP("tsdb.lines_filtered", nil, &o.linesFiltered),
+        sfxclient.CumulativeP("tsdb.datapoints_filtered", nil, &o.datapointsFiltered))
+}
+
+func (o *TSDBServer) buildDatapoint(ctx context.Context, line *tsdbLine) *datapoint.Datapoint {
+    dp := datapoint.New(line.metric,
+                        line.dimensions,
+                        datapoint.NewFloatValue(line.value),
+                        datapoint.Gauge,
+                        line.timestamp)
+    o.enrichers.Enrich(dp, &EnrichmentContext{Source: SourceTSDB, Context: ctx})
+    return dp
 }
@@ -4,12 +4,23 @@ package metrics_test
 
 
 import (
+    "bufio"
+    "context"
+    "crypto/tls"
+    "encoding/json"
     "fmt"
+    "io"
+    "io/ioutil"
+    "math/rand"
     "net"
+    "net/http"
+    "os"
     "strconv"
+    "strings"
     "time"
 
     sfxproto "github.com/signalfx/com_signalfx_metrics_protobuf"
+    "github.com/signalfx/golib/v3/datapoint"
     "github.com/signalfx/golib/v3/sfxclient"
 
     . "github.com/onsi/ginkgo"
@@ -26,7 +37,15 @@ var _ = Describe("TSDBServer", func() {
     var fakeBosh *FakeBosh
     var sfxClient *sfxclient.HTTPSink
     var tsdbServer *metrics.TSDBServer
+    var bosh *metrics.BoshMetadataFetcher
+    var enrichers metrics.EnricherChain
+    var filterConfig *metrics.Config
     var port int
+    var httpPort int
+    var conn net.Conn
+    var flushInterval int
+    // Cancels the server's context and returns what Run returned
+    var stopTSDBServer func() error
 
     BeforeEach(func() {
         fakeUAA = NewFakeUAA("bearer", "123456789")
@@ -46,17 +65,39 @@ var _ = Describe("TSDBServer", func() {
         }
 
         boshClient := metrics.NewBoshClient(fakeBosh.URL(), tokenFetcher, true)
-        bosh := metrics.NewBoshMetadataFetcher(boshClient)
+        bosh = metrics.NewBoshMetadataFetcher(boshClient)
+        enrichers = metrics.EnricherChain{metrics.NewBoshVMEnricher(bosh)}
 
-        metricFilter := metrics.NewMetricFilter(&metrics.Config{})
+        filterConfig = &metrics.Config{}
+        flushInterval = 1
+    })
+
+    // The server is started after any nested BeforeEach has changed the
+    // filter config
+    JustBeforeEach(func() {
+        metricFilter := newMetricFilter(filterConfig, enrichers)
 
         port = 13321
 
+        ctx, cancel := context.WithCancel(context.Background())
+        stopped := make(chan struct{})
+        var runErr error
+        stopTSDBServer = func() error {
+            cancel()
+            <-stopped
+            return runErr
+        }
+
         go func() {
+            defer close(stopped)
             for {
-                tsdbServer = metrics.NewTSDBServer(sfxClient, 1, port, bosh, metricFilter)
-                err := tsdbServer.Start()
-                if err != nil {
+                httpPort = port + 1000
+                filterConfig.FlushIntervalSeconds = flushInterval
+                filterConfig.TSDBPort = port
+                filterConfig.TSDBHTTPPort = httpPort
+                tsdbServer = metrics.NewTSDBServer(filterConfig, sfxClient, enrichers, metricFilter, metrics.NewDatapointRewriter(filterConfig))
+                runErr = tsdbServer.Run(ctx)
+                if runErr != nil {
                     // Make the tests more robust by not being dependent on a
                     // single hard coded port
                     port += 1
@@ -64,7 +105,7 @@ var _ = Describe("TSDBServer", func() {
             }
         }()
 
-        // Since TSDBServer.Start blocks if it binds successfully to the port,
+        // Since TSDBServer.Run blocks if it binds successfully to the port,
         // we need to poll the port var until it stops changing.  This is still
         // theoretically subject to race conditions if the StartTSDBServer
         // method has started down a successful path but hasn't fully
@@ -86,13 +127,22 @@ var _ = Describe("TSDBServer", func() {
         fakeSignalFx.Close()
         fakeUAA.Close()
         fakeBosh.Close()
-        tsdbServer.Stop()
+        stopTSDBServer()
+        if conn != nil {
+            conn.Close()
+            conn = nil
+        }
     })
 
+    // Lines are sent over one connection per test so that they are received
+    // in order
     sendTSDBLine := func(line string) {
-        conn, err := net.Dial("tcp", "localhost:" + strconv.Itoa(port))
-        if err != nil {
-            Fail(fmt.Sprint("Could not send to TSDBServer: ", err.Error()))
+        if conn == nil {
+            var err error
+            conn, err = net.Dial("tcp", "localhost:" + strconv.Itoa(port))
+            if err != nil {
+                Fail(fmt.Sprint("Could not send to TSDBServer: ", err.Error()))
+            }
         }
 
         fmt.Fprintf(conn, line + "\n")
@@ -127,6 +177,470 @@ var _ = Describe("TSDBServer", func() {
         Expect(dp.GetValue().GetDoubleValue()).To(Equal(0.6))
     })
 
+    // Keyed by the metric name, and the reason for tsdb.lines_malformed
+    selfMetrics := func() map[string]int64 {
+        values := make(map[string]int64)
+        for _, dp := range tsdbServer.Datapoints() {
+            name := dp.Metric
+            if reason, ok := dp.Dimensions["reason"]; ok {
+                name += "." + reason
+            }
+            values[name] = dp.Value.(datapoint.IntValue).Int()
+        }
+        return values
+    }
+
+    It("counts malformed lines by reason", func() {
+        sendTSDBLine("put system.cpu.user notanumber 0.6 deployment=cf")
+        sendTSDBLine("put system.cpu.user 1493049198 0.6 deployment=cf-1f83d62c70fa873ce366 id=cd14da4b-b764-4e45-b6c3-142a8a058f4a")
+
+        Expect(fakeSignalFx.GetIngestedDatapoints()).To(HaveLen(1))
+
+        Eventually(selfMetrics).Should(HaveKeyWithValue("tsdb.lines_received", int64(2)))
+        Expect(selfMetrics()).To(HaveKeyWithValue("tsdb.lines_malformed.invalid_timestamp", int64(1)))
+
+        malformed := map[string]string{
+            "unknown_command": "putt system.cpu.user 1493049198 0.6 deployment=cf",
+            "missing_fields": "put system.cpu.user 1493049198",
+            "invalid_metric": "put system.cpu:user 1493049198 0.6 deployment=cf",
+            "invalid_value": "put system.cpu.user 1493049198 NaN deployment=cf",
+            "invalid_tag": "put system.cpu.user 1493049198 0.6 deployment=cf=1",
+            "duplicate_tag": "put system.cpu.user 1493049198 0.6 deployment=cf deployment=cf",
+        }
+        for _, line := range malformed {
+            sendTSDBLine(line)
+        }
+        Eventually(selfMetrics).Should(HaveKeyWithValue("tsdb.lines_received", int64(2 + len(malformed))))
+        for reason := range malformed {
+            Expect(selfMetrics()).To(HaveKeyWithValue("tsdb.lines_malformed." + reason, int64(1)))
+        }
+        fakeSignalFx.EnsureNoDatapoints()
+    })
+
+    It("counts lines that are too long and closes the connection", func() {
+        sendTSDBLine("put system.cpu.user 1493049198 0.6 deployment=cf id=" + strings.Repeat("a", 2 * 1024 * 1024))
+
+        Eventually(selfMetrics).Should(HaveKeyWithValue("tsdb.lines_malformed.line_too_long", int64(1)))
+        Expect(selfMetrics()).To(HaveKeyWithValue("tsdb.lines_received", int64(1)))
+
+        // The unread rest of the line may make the close a reset
+        conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        _, err := ioutil.ReadAll(conn)
+        if netErr, ok := err.(net.Error); ok {
+            Expect(netErr.Timeout()).To(BeFalse())
+        }
+        conn.Close()
+        conn = nil
+
+        By("Still reading lines on other connections")
+        sendTSDBLine("put system.cpu.user 1493049198 0.6 deployment=cf-1f83d62c70fa873ce366 id=cd14da4b-b764-4e45-b6c3-142a8a058f4a")
+        Expect(fakeSignalFx.GetIngestedDatapoints()).To(HaveLen(1))
+    })
+
+    It("accepts extra whitespace and millisecond timestamps", func() {
+        sendTSDBLine("put  system.cpu.user\t1493049198123   0.6 deployment=cf-1 id=vm-1 ")
+        sendTSDBLine("put system.cpu.sys 1493049198.456 1e-1 deployment=cf-1 id=vm-1")
+
+        datapoints := fakeSignalFx.GetIngestedDatapoints()
+        Expect(datapoints).To(HaveLen(2))
+        Expect(datapoints[0].GetTimestamp()).To(Equal(int64(1493049198123)))
+        Expect(datapoints[0].GetValue().GetDoubleValue()).To(Equal(0.6))
+        Expect(ProtoDimensionsToMap(datapoints[0].GetDimensions())["deployment"]).To(Equal("cf-1"))
+        Expect(datapoints[1].GetTimestamp()).To(Equal(int64(1493049198456)))
+        Expect(datapoints[1].GetValue().GetDoubleValue()).To(Equal(0.1))
+    })
+
+    It("answers the version and stats commands", func() {
+        client, err := net.Dial("tcp", "localhost:" + strconv.Itoa(port))
+        Expect(err).NotTo(HaveOccurred())
+        defer client.Close()
+        reader := bufio.NewReader(client)
+
+        fmt.Fprint(client, "version\n")
+        response, err := reader.ReadString('\n')
+        Expect(err).NotTo(HaveOccurred())
+        Expect(response).To(ContainSubstring("signalfx-cloudfoundry-bridge"))
+
+        fmt.Fprint(client, "bogus\nstats\n")
+        var stats []string
+        for len(stats) < len(tsdbServer.Datapoints()) {
+            line, err := reader.ReadString('\n')
+            Expect(err).NotTo(HaveOccurred())
+            stats = append(stats, line)
+        }
+        Expect(stats).To(ContainElement(MatchRegexp(`^signalfx_bridge\.tsdb\.lines_received \d+ 3\n$`)))
+        Expect(stats).To(ContainElement(MatchRegexp(`^signalfx_bridge\.tsdb\.lines_malformed \d+ 1 reason=unknown_command\n$`)))
+
+        By("Closing the connection on exit")
+        fmt.Fprint(client, "exit\n")
+        _, err = reader.ReadString('\n')
+        Expect(err).To(Equal(io.EOF))
+    })
+
+    Context("when sent random lines", func() {
+        BeforeEach(func() {
+            enrichers = nil
+        })
+
+        // Mangles a valid line in one to three random ways
+        mutate := func(r *rand.Rand, line string) string {
+            junk := []byte(" \t=.-_/:,x0\x00\xff")
+            b := []byte(line)
+            for n := r.Intn(3) + 1; n > 0 && len(b) > 0; n-- {
+                i := r.Intn(len(b))
+                switch r.Intn(5) {
+                case 0:
+                    b = append(b[:i], b[i+1:]...)
+                case 1:
+                    b = append(b[:i], append([]byte{junk[r.Intn(len(junk))]}, b[i:]...)...)
+                case 2:
+                    b[i] = byte(r.Intn(256))
+                    if b[i] == '\n' || b[i] == '\r' {
+                        b[i] = ' '
+                    }
+                case 3:
+                    b = b[:i]
+                case 4:
+                    fields := strings.Fields(string(b))
+                    if len(fields) == 0 {
+                        continue
+                    }
+                    j, k := r.Intn(len(fields)), r.Intn(len(fields))
+                    fields[j], fields[k] = fields[k], fields[j]
+                    b = []byte(strings.Join(fields, " "))
+                }
+            }
+            return string(b)
+        }
+
+        It("either sends or counts every one as malformed", func() {
+            r := rand.New(rand.NewSource(GinkgoRandomSeed()))
+            valid := "put system.cpu.user 1493049198 0.6 deployment=cf-1 id=vm-1 index=0"
+
+            sent := 0
+            for i := 0; i < 1000; i++ {
+                line := mutate(r, valid)
+                if fields := strings.Fields(line); len(fields) > 0 && fields[0] != "exit" {
+                    sendTSDBLine(line)
+                    sent++
+                }
+            }
+
+            Eventually(selfMetrics).Should(HaveKeyWithValue("tsdb.lines_received", int64(sent)))
+            Eventually(func() int64 {
+                values := selfMetrics()
+                total := values["tsdb.datapoints_sent"]
+                for _, reason := range []string{"unknown_command", "missing_fields", "invalid_metric",
+                        "invalid_timestamp", "invalid_value", "invalid_tag", "duplicate_tag"} {
+                    total += values["tsdb.lines_malformed." + reason]
+                }
+                return total
+            }, 5).Should(Equal(int64(sent)))
+        })
+    })
+
+    Context("when datapoints are posted to /api/put", func() {
+        put := func(query string, body string) (int, map[string]interface{}) {
+            resp, err := http.Post(fmt.Sprintf("http://localhost:%d/api/put%s", httpPort, query),
+                "application/json", strings.NewReader(body))
+            Expect(err).NotTo(HaveOccurred())
+            defer resp.Body.Close()
+
+            var response map[string]interface{}
+            if resp.StatusCode != http.StatusNoContent && resp.Header.Get("Content-Type") == "application/json" {
+                Expect(json.NewDecoder(resp.Body).Decode(&response)).To(Succeed())
+            }
+            return resp.StatusCode, response
+        }
+
+        It("forwards a single datapoint like a put line", func() {
+            fakeBosh.AddVM("cf-1f83d62c70fa873ce366", "cd14da4b-b764-4e45-b6c3-142a8a058f4a", "10.0.10.10")
+
+            status, _ := put("", `{"metric": "system.cpu.user", "timestamp": 1493049198, "value": 0.6,
+                "tags": {"deployment": "cf-1f83d62c70fa873ce366", "id": "cd14da4b-b764-4e45-b6c3-142a8a058f4a", "job": "consul_server"}}`)
+            Expect(status).To(Equal(http.StatusNoContent))
+
+            datapoints := fakeSignalFx.GetIngestedDatapoints()
+            Expect(datapoints).To(HaveLen(1))
+            Expect(datapoints[0].GetMetric()).To(Equal("system.cpu.user"))
+            Expect(datapoints[0].GetTimestamp()).To(Equal(int64(1493049198000)))
+            Expect(datapoints[0].GetValue().GetDoubleValue()).To(Equal(0.6))
+            dimensions := ProtoDimensionsToMap(datapoints[0].GetDimensions())
+            Expect(dimensions["bosh_id"]).To(Equal("cd14da4b-b764-4e45-b6c3-142a8a058f4a"))
+            Expect(dimensions["host"]).To(Equal("10.0.10.10"))
+            Expect(dimensions["job"]).To(Equal("consul_server"))
+        })
+
+        It("reports the datapoints that failed in a batch", func() {
+            status, response := put("?details", `[
+                {"metric": "system.cpu.user", "timestamp": 1493049198123, "value": "0.6", "tags": {"deployment": "cf-1"}},
+                {"metric": "system.cpu.sys", "timestamp": 1493049198, "value": "lots", "tags": {"deployment": "cf-1"}}
+            ]`)
+            Expect(status).To(Equal(http.StatusBadRequest))
+            Expect(response["success"]).To(BeNumerically("==", 1))
+            Expect(response["failed"]).To(BeNumerically("==", 1))
+            errors := response["errors"].([]interface{})
+            Expect(errors).To(HaveLen(1))
+            Expect(errors[0]).To(HaveKeyWithValue("error", `invalid value "lots"`))
+            Expect(errors[0]).To(HaveKeyWithValue("datapoint", HaveKeyWithValue("metric", "system.cpu.sys")))
+
+            datapoints := fakeSignalFx.GetIngestedDatapoints()
+            Expect(datapoints).To(HaveLen(1))
+            Expect(datapoints[0].GetTimestamp()).To(Equal(int64(1493049198123)))
+
+            Expect(selfMetrics()).To(HaveKeyWithValue("tsdb.lines_received", int64(2)))
+            Expect(selfMetrics()).To(HaveKeyWithValue("tsdb.lines_malformed.invalid_value", int64(1)))
+        })
+
+        It("only counts the datapoints with summary", func() {
+            status, response := put("?summary", `[
+                {"metric": "system.cpu.user", "timestamp": 1493049198, "value": 0.6, "tags": {"deployment": "cf-1"}},
+                {"metric": "system.cpu.sys", "timestamp": 1493049198, "value": 0.2, "tags": {"deployment": "cf-1"}}
+            ]`)
+            Expect(status).To(Equal(http.StatusOK))
+            Expect(response).To(Equal(map[string]interface{}{"success": 2.0, "failed": 0.0}))
+            Expect(fakeSignalFx.GetIngestedDatapoints()).To(HaveLen(2))
+        })
+
+        It("rejects bodies that aren't datapoints", func() {
+            status, _ := put("", `{"metric": "system.cpu.user",`)
+            Expect(status).To(Equal(http.StatusBadRequest))
+            Expect(selfMetrics()).To(HaveKeyWithValue("tsdb.lines_malformed.invalid_json", int64(1)))
+
+            resp, err := http.Get(fmt.Sprintf("http://localhost:%d/api/put", httpPort))
+            Expect(err).NotTo(HaveOccurred())
+            resp.Body.Close()
+            Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+
+            fakeSignalFx.EnsureNoDatapoints()
+        })
+    })
+
+    Context("when TLS is configured", func() {
+        var certDir string
+        var serverCert *TestCert
+        var clientCert *TestCert
+
+        BeforeEach(func() {
+            var err error
+            certDir, err = ioutil.TempDir("", "tsdb-certs")
+            Expect(err).NotTo(HaveOccurred())
+            serverCert, err = NewTestCert(certDir, "server")
+            Expect(err).NotTo(HaveOccurred())
+            clientCert, err = NewTestCert(certDir, "client")
+            Expect(err).NotTo(HaveOccurred())
+
+            filterConfig.TSDBListenAddress = "127.0.0.1"
+            filterConfig.TSDBTLSCertFile = serverCert.CertFile
+            filterConfig.TSDBTLSKeyFile = serverCert.KeyFile
+        })
+
+        AfterEach(func() {
+            os.RemoveAll(certDir)
+        })
+
+        sendTLSLine := func(line string, certs ...tls.Certificate) {
+            client, err := tls.Dial("tcp", "127.0.0.1:" + strconv.Itoa(port), &tls.Config{
+                RootCAs: serverCert.Pool,
+                Certificates: certs,
+            })
+            if err != nil {
+                return
+            }
+            defer client.Close()
+            fmt.Fprint(client, line + "\n")
+            // Wait for the server to close the connection after the line
+            // is read, or to reject the client cert
+            client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+            client.Read(make([]byte, 1))
+        }
+
+        It("only accepts TLS connections", func() {
+            sendTSDBLine("put system.cpu.plaintext 1493049198 0.6 deployment=cf-1")
+            sendTLSLine("put system.cpu.user 1493049198 0.6 deployment=cf-1")
+
+            datapoints := fakeSignalFx.GetIngestedDatapoints()
+            Expect(datapoints).To(HaveLen(1))
+            Expect(datapoints[0].GetMetric()).To(Equal("system.cpu.user"))
+            Expect(selfMetrics()).To(HaveKeyWithValue("tsdb.lines_received", int64(1)))
+        })
+
+        It("serves /api/put over HTTPS", func() {
+            client := &http.Client{Transport: &http.Transport{
+                TLSClientConfig: &tls.Config{RootCAs: serverCert.Pool},
+            }}
+            resp, err := client.Post(fmt.Sprintf("https://127.0.0.1:%d/api/put", httpPort), "application/json",
+                strings.NewReader(`{"metric": "system.cpu.user", "timestamp": 1493049198, "value": 0.6, "tags": {"deployment": "cf-1"}}`))
+            Expect(err).NotTo(HaveOccurred())
+            resp.Body.Close()
+            Expect(resp.StatusCode).To(Equal(http.StatusNoContent))
+
+            Expect(fakeSignalFx.GetIngestedDatapoints()).To(HaveLen(1))
+        })
+
+        Context("with a client CA", func() {
+            BeforeEach(func() {
+                filterConfig.TSDBTLSClientCAFile = clientCert.CertFile
+            })
+
+            It("requires a client cert signed by it", func() {
+                sendTLSLine("put system.cpu.anonymous 1493049198 0.6 deployment=cf-1")
+                sendTLSLine("put system.cpu.server 1493049198 0.6 deployment=cf-1", serverCert.Cert)
+                sendTLSLine("put system.cpu.user 1493049198 0.6 deployment=cf-1", clientCert.Cert)
+
+                datapoints := fakeSignalFx.GetIngestedDatapoints()
+                Expect(datapoints).To(HaveLen(1))
+                Expect(datapoints[0].GetMetric()).To(Equal("system.cpu.user"))
+            })
+        })
+    })
+
+    It("fails to start if the TLS cert can't be loaded", func() {
+        config := &metrics.Config{
+            TSDBPort: port + 2000,
+            TSDBTLSCertFile: "/nonexistent/server.crt",
+            TSDBTLSKeyFile: "/nonexistent/server.key",
+        }
+        server := metrics.NewTSDBServer(config, sfxClient, nil, newMetricFilter(config, nil), metrics.NewDatapointRewriter(config))
+        Expect(server.Run(context.Background())).To(MatchError(ContainSubstring("no such file")))
+    })
+
+    Context("when its context is canceled", func() {
+        BeforeEach(func() {
+            flushInterval = 60
+            enrichers = nil
+        })
+
+        It("closes the connections and sends the datapoints that are still buffered", func() {
+            sendTSDBLine("put system.cpu.user 1493049198 0.6 deployment=cf-1 id=vm-1")
+            sendTSDBLine("put system.cpu.sys 1493049198 0.2 deployment=cf-1 id=vm-1")
+            Eventually(selfMetrics).Should(HaveKeyWithValue("tsdb.lines_received", int64(2)))
+
+            Expect(stopTSDBServer()).To(Succeed())
+
+            datapoints := fakeSignalFx.GetIngestedDatapoints()
+            Expect(datapoints).To(HaveLen(2))
+
+            conn.SetReadDeadline(time.Now().Add(time.Second))
+            _, err := conn.Read(make([]byte, 1))
+            Expect(err).To(Equal(io.EOF))
+
+            _, err = net.Dial("tcp", "localhost:" + strconv.Itoa(port))
+            Expect(err).To(HaveOccurred())
+        })
+    })
+
+    Context("when deployments are filtered", func() {
+        BeforeEach(func() {
+            filterConfig.DeploymentsToInclude = []string{"cf-1f83d62c70fa873ce366"}
+        })
+
+        It("drops lines before looking up their VMs", func() {
+            fakeBosh.AddVM("p-metrics-d9889b7d6988533733d6", "84d86321-8040-464f-be37-2389135e16bc", "10.0.5.5")
+            fakeBosh.AddVM("cf-1f83d62c70fa873ce366", "cd14da4b-b764-4e45-b6c3-142a8a058f4a", "10.0.10.10")
+
+            sendTSDBLine("put system.disk.ephemeral.percent 1493049192 2 deployment=p-metrics-d9889b7d6988533733d6 id=84d86321-8040-464f-be37-2389135e16bc index=0 job=opentsdb-metrics role=unknown")
+            sendTSDBLine("put system.cpu.user 1493049198 0.6 deployment=cf-1f83d62c70fa873ce366 id=cd14da4b-b764-4e45-b6c3-142a8a058f4a index=0 job=consul_server role=unknown")
+
+            datapoints := fakeSignalFx.GetIngestedDatapoints()
+            Expect(datapoints).To(HaveLen(1))
+            Expect(ProtoDimensionsToMap(datapoints[0].GetDimensions())["host"]).To(Equal("10.0.10.10"))
+
+            selfMetric := func(collector sfxclient.Collector, metric string) int64 {
+                for _, dp := range collector.Datapoints() {
+                    if dp.Metric == metric {
+                        return dp.Value.(datapoint.IntValue).Int()
+                    }
+                }
+                return -1
+            }
+            Expect(selfMetric(tsdbServer, "tsdb.lines_filtered")).To(Equal(int64(1)))
+            Expect(selfMetric(bosh, "bosh.vm_cache_refreshes")).To(Equal(int64(1)))
+        })
+    })
+
+    Context("when a CSV enricher runs after the BOSH one", func() {
+        var csvPath string
+
+        BeforeEach(func() {
+            f, err := ioutil.TempFile("", "enrichment")
+            Expect(err).NotTo(HaveOccurred())
+            fmt.Fprint(f, "host,availability_zone,role\n10.0.5.5,us-east-1a,metrics\n")
+            f.Close()
+            csvPath = f.Name()
+
+            enrichers, err = metrics.NewEnricherChain([]string{"bosh_vm", "csv"}, metrics.EnricherSources{
+                BoshMetadata: bosh,
+                CSVFile: csvPath,
+            })
+            Expect(err).NotTo(HaveOccurred())
+        })
+
+        AfterEach(func() {
+            os.Remove(csvPath)
+        })
+
+        It("matches on the host set by the BOSH enricher", func() {
+            fakeBosh.AddVM("p-metrics-d9889b7d6988533733d6", "84d86321-8040-464f-be37-2389135e16bc", "10.0.5.5")
+
+            sendTSDBLine("put system.cpu.user 1493049198 0.6 deployment=p-metrics-d9889b7d6988533733d6 id=84d86321-8040-464f-be37-2389135e16bc index=0 job=opentsdb-metrics role=unknown")
+
+            datapoints := fakeSignalFx.GetIngestedDatapoints()
+            Expect(datapoints).To(HaveLen(1))
+            dimensions := ProtoDimensionsToMap(datapoints[0].GetDimensions())
+            Expect(dimensions["host"]).To(Equal("10.0.5.5"))
+            Expect(dimensions["availability_zone"]).To(Equal("us-east-1a"))
+        })
+
+        // The line sets role=unknown, which the CSV file replaces, so the
+        // line's own value can't be used to drop it before it's enriched
+        Context("and a rule includes a column from the CSV file", func() {
+            BeforeEach(func() {
+                filterConfig.MetricRules = []metrics.MetricRule{
+                    {Action: "include", Dimensions: map[string]string{"role": "metrics"}},
+                    {Action: "exclude", Metric: "system.*"},
+                }
+            })
+
+            It("keeps lines for hosts in that column", func() {
+                fakeBosh.AddVM("p-metrics-d9889b7d6988533733d6", "84d86321-8040-464f-be37-2389135e16bc", "10.0.5.5")
+
+                sendTSDBLine("put system.cpu.user 1493049198 0.6 deployment=p-metrics-d9889b7d6988533733d6 id=84d86321-8040-464f-be37-2389135e16bc index=0 job=opentsdb-metrics role=unknown")
+
+                datapoints := fakeSignalFx.GetIngestedDatapoints()
+                Expect(datapoints).To(HaveLen(1))
+                Expect(datapoints[0].GetMetric()).To(Equal("system.cpu.user"))
+                dimensions := ProtoDimensionsToMap(datapoints[0].GetDimensions())
+                Expect(dimensions["role"]).To(Equal("metrics"))
+            })
+        })
+    })
+
+    Context("when rewriting dimensions", func() {
+        BeforeEach(func() {
+            filterConfig.ExtraDimensions = []string{"foundation=prod-east"}
+            filterConfig.DimensionsToRename = []string{"host=ip"}
+            filterConfig.DimensionsToDrop = []string{"bosh_id", "role"}
+        })
+
+        It("rewrites them after the BOSH enricher sets the host", func() {
+            fakeBosh.AddVM("cf-1f83d62c70fa873ce366", "cd14da4b-b764-4e45-b6c3-142a8a058f4a", "10.0.10.10")
+
+            sendTSDBLine("put system.cpu.user 1493049198 0.6 deployment=cf-1f83d62c70fa873ce366 id=cd14da4b-b764-4e45-b6c3-142a8a058f4a index=0 job=consul_server role=unknown")
+
+            datapoints := fakeSignalFx.GetIngestedDatapoints()
+            Expect(datapoints).To(HaveLen(1))
+            Expect(ProtoDimensionsToMap(datapoints[0].GetDimensions())).To(Equal(map[string]string{
+                "deployment": "cf-1f83d62c70fa873ce366",
+                "index": "0",
+                "job": "consul_server",
+                "ip": "10.0.10.10",
+                "metric_source": "cloudfoundry",
+                "foundation": "prod-east",
+            }))
+        })
+    })
+
     It("uses the BOSH metadata fetcher to add host dimension", func() {
         fakeBosh.AddVM("p-metrics-d9889b7d6988533733d6", "84d86321-8040-464f-be37-2389135e16bc", "10.0.5.5")
         fakeBosh.AddVM("cf-1f83d62c70fa873ce366", "cd14da4b-b764-4e45-b6c3-142a8a058f4a", "10.0.10.10")
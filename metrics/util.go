@@ -1,11 +1,10 @@
 package metrics
 
 import (
+	"context"
 	"log"
 	"os"
 
-	"golang.org/x/net/context"
-
 	"github.com/signalfx/golib/v3/datapoint"
 )
 
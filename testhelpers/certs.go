@@ -0,0 +1,76 @@
+package testhelpers
+
+import (
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/pem"
+    "io/ioutil"
+    "math/big"
+    "net"
+    "path/filepath"
+    "time"
+)
+
+// A self-signed cert for localhost that can be used by both servers and
+// clients, and as the CA that verifies itself
+type TestCert struct {
+    CertFile string
+    KeyFile  string
+    Cert     tls.Certificate
+    Pool     *x509.CertPool
+}
+
+// Writes the cert and key as PEM files in dir
+func NewTestCert(dir string, commonName string) (*TestCert, error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+
+    template := &x509.Certificate{
+        SerialNumber:          big.NewInt(time.Now().UnixNano()),
+        Subject:               pkix.Name{CommonName: commonName},
+        NotBefore:             time.Now().Add(-time.Hour),
+        NotAfter:              time.Now().Add(time.Hour),
+        IsCA:                  true,
+        BasicConstraintsValid: true,
+        KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+        DNSNames:              []string{"localhost"},
+        IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        return nil, err
+    }
+    keyDER, err := x509.MarshalECPrivateKey(key)
+    if err != nil {
+        return nil, err
+    }
+
+    certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+    keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+    testCert := &TestCert{
+        CertFile: filepath.Join(dir, commonName+".crt"),
+        KeyFile:  filepath.Join(dir, commonName+".key"),
+        Pool:     x509.NewCertPool(),
+    }
+    if err := ioutil.WriteFile(testCert.CertFile, certPEM, 0600); err != nil {
+        return nil, err
+    }
+    if err := ioutil.WriteFile(testCert.KeyFile, keyPEM, 0600); err != nil {
+        return nil, err
+    }
+
+    testCert.Cert, err = tls.X509KeyPair(certPEM, keyPEM)
+    if err != nil {
+        return nil, err
+    }
+    testCert.Pool.AppendCertsFromPEM(certPEM)
+    return testCert, nil
+}
@@ -1,10 +1,15 @@
 package testhelpers
 
 import (
+    "encoding/json"
     "fmt"
     "net/http"
     "net/http/httptest"
     "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
 )
 
 
@@ -35,15 +40,137 @@ const infoJSON = `
 
 type FakeCloudController struct {
     server     *httptest.Server
+    lock       sync.Mutex
     AppReqCounts  map[string]int
+    responseDelay time.Duration
+    // Returned for every app lookup if set, to simulate an outage
+    errorStatus   int
+    // Returned for every list request if set
+    listErrorStatus int
+    missingApps   map[string]bool
+    // v3 metadata of apps, spaces and orgs by guid
+    labels        map[string]map[string]string
+    annotations   map[string]map[string]string
+    v3Unavailable bool
+
+    // Entities served from the list endpoints, in the order they were added
+    apps          []fakeEntity
+    spaces        []fakeEntity
+    orgs          []fakeEntity
+    stacks        []fakeEntity
+    ListReqCounts map[string]int
+}
+
+type fakeEntity struct {
+    guid   string
+    fields map[string]string
 }
 
 func NewFakeCloudController() *FakeCloudController {
     return &FakeCloudController{
         AppReqCounts: make(map[string]int),
+        ListReqCounts: make(map[string]int),
+        missingApps: make(map[string]bool),
+        labels: make(map[string]map[string]string),
+        annotations: make(map[string]map[string]string),
+    }
+}
+
+// Makes app lookups fail with the given HTTP status, or work again if 0
+func (f *FakeCloudController) SetErrorStatus(status int) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.errorStatus = status
+}
+
+// Makes the list endpoints fail with the given HTTP status, or work again if 0,
+// while app lookups keep working
+func (f *FakeCloudController) SetListErrorStatus(status int) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.listErrorStatus = status
+}
+
+// Makes the v3 API available or not, as on CF foundations before it was added
+func (f *FakeCloudController) SetV3Available(available bool) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.v3Unavailable = !available
+}
+
+// Makes lookups of the app return a 404, as if it was deleted
+func (f *FakeCloudController) SetAppMissing(guid string) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.missingApps[guid] = true
+}
+
+// Adds an app that will be returned from the `/v2/apps` list endpoint
+func (f *FakeCloudController) AddApp(guid, name, spaceGUID string) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.apps = append(f.apps, fakeEntity{guid, map[string]string{
+        "name": name,
+        "space_guid": spaceGUID,
+        "state": "STARTED",
+    }})
+}
+
+// Changes a field of an app added with AddApp, e.g. its "name" or "state"
+func (f *FakeCloudController) SetAppField(guid, key, value string) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    for _, app := range f.apps {
+        if app.guid == guid {
+            app.fields[key] = value
+        }
     }
 }
 
+// Sets the v3 metadata labels and annotations of an app, space or org
+func (f *FakeCloudController) SetLabels(guid string, labels, annotations map[string]string) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.labels[guid] = labels
+    f.annotations[guid] = annotations
+}
+
+// Adds a space that will be returned from the `/v2/spaces` list endpoint
+func (f *FakeCloudController) AddSpace(guid, name, orgGUID string) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.spaces = append(f.spaces, fakeEntity{guid, map[string]string{
+        "name": name,
+        "organization_guid": orgGUID,
+    }})
+}
+
+// Adds an org that will be returned from the `/v2/organizations` list endpoint
+func (f *FakeCloudController) AddOrg(guid, name string) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.orgs = append(f.orgs, fakeEntity{guid, map[string]string{
+        "name": name,
+    }})
+}
+
+// Adds a stack that will be returned from the `/v2/stacks` list endpoint
+func (f *FakeCloudController) AddStack(guid, name string) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.stacks = append(f.stacks, fakeEntity{guid, map[string]string{
+        "name": name,
+    }})
+}
+
+// Returns how many pages have been requested from a list endpoint, e.g.
+// "/v2/apps"
+func (f *FakeCloudController) ListRequestCount(path string) int {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    return f.ListReqCounts[path]
+}
+
 func (f *FakeCloudController) Start() {
     f.server = httptest.NewUnstartedServer(f)
     f.server.Start()
@@ -57,20 +184,96 @@ func (f *FakeCloudController) URL() string {
     return f.server.URL
 }
 
+// Simulates a slow Cloud Controller
+func (f *FakeCloudController) SetResponseDelay(delay time.Duration) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.responseDelay = delay
+}
+
+func (f *FakeCloudController) AppRequestCount(guid string) int {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    return f.AppReqCounts[guid]
+}
+
 // Returns the app name as "app-<guid>" based on the guid passed in the path.
 // This is meant to fake the `/v2/apps/<guid>` path, as well as the `/v2/info` path.
+// The `/v2/apps`, `/v2/spaces`, `/v2/organizations` and `/v2/stacks` list
+// endpoints return whatever was added with AddApp, AddSpace, AddOrg and
+// AddStack, as do the v3 ones.  Apps looked up from `/v3/apps` with the
+// `guids` param are treated like `/v2/apps/<guid>`.
 func (f *FakeCloudController) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
     defer r.Body.Close()
 
     appPathRegexp := regexp.MustCompile(`^/v2/apps/([\w-]+)$`)
+    v3PathRegexp := regexp.MustCompile(`^/v3/(apps|spaces|organizations)/([\w-]+)$`)
 
-    if r.URL.Path == "/v2/info" {
+    f.lock.Lock()
+    v3Unavailable := f.v3Unavailable
+    f.lock.Unlock()
+
+    if r.URL.Path == "/" {
+        f.serveRoot(rw, r, v3Unavailable)
+    } else if v3Unavailable && strings.HasPrefix(r.URL.Path, "/v3/") {
+        rw.WriteHeader(http.StatusNotFound)
+        rw.Write([]byte(`{"code": 10000, "description": "Unknown request", "error_code": "CF-NotFound"}`))
+    } else if r.URL.Path == "/v3/apps" && r.URL.Query().Get("guids") != "" {
+        f.serveV3AppLookup(rw, r)
+    } else if r.URL.Path == "/v2/info" {
         rw.Write([]byte(infoJSON))
+    } else if r.URL.Path == "/v2/apps" {
+        f.serveList(rw, r, &f.apps)
+    } else if r.URL.Path == "/v2/spaces" {
+        f.serveList(rw, r, &f.spaces)
+    } else if r.URL.Path == "/v2/organizations" {
+        f.serveList(rw, r, &f.orgs)
+    } else if r.URL.Path == "/v2/stacks" {
+        f.serveList(rw, r, &f.stacks)
+    } else if r.URL.Path == "/v3/apps" {
+        f.serveV3List(rw, r, &f.apps)
+    } else if r.URL.Path == "/v3/spaces" {
+        f.serveV3List(rw, r, &f.spaces)
+    } else if r.URL.Path == "/v3/organizations" {
+        f.serveV3List(rw, r, &f.orgs)
+    } else if v3PathRegexp.MatchString(r.URL.Path) {
+        guid := v3PathRegexp.FindStringSubmatch(r.URL.Path)[2]
+
+        f.lock.Lock()
+        f.ListReqCounts[r.URL.Path] += 1
+        body, _ := json.Marshal(f.v3ResourceByGUID(guid))
+        f.lock.Unlock()
+
+        rw.Write(body)
     } else if appPathRegexp.MatchString(r.URL.Path) {
         groups := appPathRegexp.FindStringSubmatch(r.URL.Path)
         guid := groups[1]
 
+        f.lock.Lock()
         f.AppReqCounts[guid] += 1
+        delay := f.responseDelay
+        errorStatus := f.errorStatus
+        missing := f.missingApps[guid]
+        added := f.appWithSpace(guid)
+        f.lock.Unlock()
+
+        time.Sleep(delay)
+
+        if errorStatus != 0 {
+            rw.WriteHeader(errorStatus)
+            rw.Write([]byte(`{"code": 10001, "description": "Server error", "error_code": "CF-ServerError"}`))
+            return
+        }
+        if missing {
+            rw.WriteHeader(http.StatusNotFound)
+            rw.Write([]byte(`{"code": 100004, "description": "The app could not be found", "error_code": "CF-AppNotFound"}`))
+            return
+        }
+        if added != nil {
+            body, _ := json.Marshal(added)
+            rw.Write(body)
+            return
+        }
 
         // Extremely stripped down version of what CC actually returns
         rw.Write([]byte(fmt.Sprintf(`
@@ -104,3 +307,347 @@ func (f *FakeCloudController) ServeHTTP(rw http.ResponseWriter, r *http.Request)
     }
 }
 
+// Returns the app added with AddApp with its space and org inlined, like the
+// CC does with `inline-relations-depth=2`, or nil if it wasn't added.  The
+// lock must be held.
+func (f *FakeCloudController) appWithSpace(guid string) map[string]interface{} {
+    app := findEntity(f.apps, guid)
+    if app == nil {
+        return nil
+    }
+    resource := app.resource()
+    entity := resource["entity"].(map[string]interface{})
+
+    if space := findEntity(f.spaces, app.fields["space_guid"]); space != nil {
+        spaceResource := space.resource()
+        if org := findEntity(f.orgs, space.fields["organization_guid"]); org != nil {
+            spaceResource["entity"].(map[string]interface{})["organization"] = org.resource()
+        }
+        entity["space"] = spaceResource
+    }
+    return resource
+}
+
+func (e fakeEntity) resource() map[string]interface{} {
+    entity := map[string]interface{}{}
+    for k, v := range e.fields {
+        entity[k] = v
+    }
+    return map[string]interface{}{
+        "metadata": map[string]interface{}{"guid": e.guid},
+        "entity": entity,
+    }
+}
+
+// Serves one page of a list endpoint, honoring the `page` and
+// `results-per-page` params the same way the CC does
+func (f *FakeCloudController) serveList(rw http.ResponseWriter, r *http.Request, list *[]fakeEntity) {
+    f.lock.Lock()
+    f.ListReqCounts[r.URL.Path] += 1
+    delay := f.responseDelay
+    errorStatus := f.listErrorStatus
+    entities := *list
+    f.lock.Unlock()
+
+    time.Sleep(delay)
+
+    if errorStatus != 0 {
+        rw.WriteHeader(errorStatus)
+        rw.Write([]byte(`{"code": 10001, "description": "Server error", "error_code": "CF-ServerError"}`))
+        return
+    }
+
+    perPage, err := strconv.Atoi(r.URL.Query().Get("results-per-page"))
+    if err != nil || perPage <= 0 {
+        perPage = 50
+    }
+    page, err := strconv.Atoi(r.URL.Query().Get("page"))
+    if err != nil || page <= 0 {
+        page = 1
+    }
+
+    totalPages := (len(entities) + perPage - 1) / perPage
+    start := (page - 1) * perPage
+    end := start + perPage
+    if start > len(entities) {
+        start = len(entities)
+    }
+    if end > len(entities) {
+        end = len(entities)
+    }
+
+    var nextURL interface{}
+    if page < totalPages {
+        nextURL = fmt.Sprintf("%s?page=%d&results-per-page=%d", r.URL.Path, page+1, perPage)
+    }
+
+    f.lock.Lock()
+    resources := []interface{}{}
+    for _, e := range entities[start:end] {
+        resources = append(resources, e.resource())
+    }
+    f.lock.Unlock()
+
+    body, _ := json.Marshal(map[string]interface{}{
+        "total_results": len(entities),
+        "total_pages": totalPages,
+        "next_url": nextURL,
+        "resources": resources,
+    })
+    rw.Write(body)
+}
+
+func (f *FakeCloudController) serveRoot(rw http.ResponseWriter, r *http.Request, v3Unavailable bool) {
+    link := func(path string) map[string]string {
+        return map[string]string{"href": "http://" + r.Host + path}
+    }
+    links := map[string]interface{}{
+        "self": link(""),
+        "cloud_controller_v2": link("/v2"),
+        "cloud_controller_v3": link("/v3"),
+    }
+    if v3Unavailable {
+        links["cloud_controller_v3"] = nil
+    }
+    body, _ := json.Marshal(map[string]interface{}{"links": links})
+    rw.Write(body)
+}
+
+func findEntity(entities []fakeEntity, guid string) *fakeEntity {
+    for i := range entities {
+        if entities[i].guid == guid {
+            return &entities[i]
+        }
+    }
+    return nil
+}
+
+func (f *FakeCloudController) v3Metadata(guid string) map[string]interface{} {
+    labels := f.labels[guid]
+    if labels == nil {
+        labels = map[string]string{}
+    }
+    annotations := f.annotations[guid]
+    if annotations == nil {
+        annotations = map[string]string{}
+    }
+    return map[string]interface{}{
+        "labels": labels,
+        "annotations": annotations,
+    }
+}
+
+func v3Relationship(guid string) map[string]interface{} {
+    return map[string]interface{}{
+        "data": map[string]string{"guid": guid},
+    }
+}
+
+// Returns the v3 resource of an app, space or org by guid, with only the guid
+// and metadata if it wasn't added.  The lock must be held.
+func (f *FakeCloudController) v3ResourceByGUID(guid string) map[string]interface{} {
+    if app := findEntity(f.apps, guid); app != nil {
+        return f.v3App(*app)
+    }
+    if space := findEntity(f.spaces, guid); space != nil {
+        return f.v3Space(*space)
+    }
+    if org := findEntity(f.orgs, guid); org != nil {
+        return f.v3Org(*org)
+    }
+    return map[string]interface{}{
+        "guid": guid,
+        "metadata": f.v3Metadata(guid),
+    }
+}
+
+// The lock must be held
+func (f *FakeCloudController) v3App(app fakeEntity) map[string]interface{} {
+    buildpacks := []string{}
+    if buildpack := app.fields["buildpack"]; buildpack != "" {
+        buildpacks = append(buildpacks, buildpack)
+    }
+    stack := ""
+    if s := findEntity(f.stacks, app.fields["stack_guid"]); s != nil {
+        stack = s.fields["name"]
+    }
+    return map[string]interface{}{
+        "guid": app.guid,
+        "name": app.fields["name"],
+        "state": app.fields["state"],
+        "lifecycle": map[string]interface{}{
+            "type": "buildpack",
+            "data": map[string]interface{}{
+                "buildpacks": buildpacks,
+                "stack": stack,
+            },
+        },
+        "relationships": map[string]interface{}{
+            "space": v3Relationship(app.fields["space_guid"]),
+        },
+        "metadata": f.v3Metadata(app.guid),
+    }
+}
+
+// The lock must be held
+func (f *FakeCloudController) v3Space(space fakeEntity) map[string]interface{} {
+    return map[string]interface{}{
+        "guid": space.guid,
+        "name": space.fields["name"],
+        "relationships": map[string]interface{}{
+            "organization": v3Relationship(space.fields["organization_guid"]),
+        },
+        "metadata": f.v3Metadata(space.guid),
+    }
+}
+
+// The lock must be held
+func (f *FakeCloudController) v3Org(org fakeEntity) map[string]interface{} {
+    return map[string]interface{}{
+        "guid": org.guid,
+        "name": org.fields["name"],
+        "metadata": f.v3Metadata(org.guid),
+    }
+}
+
+// Returns the spaces and orgs of the apps for `include=space.organization`.
+// The lock must be held.
+func (f *FakeCloudController) v3Included(apps []fakeEntity) map[string]interface{} {
+    spaces := []interface{}{}
+    orgs := []interface{}{}
+    seen := map[string]bool{}
+    for _, app := range apps {
+        space := findEntity(f.spaces, app.fields["space_guid"])
+        if space == nil || seen[space.guid] {
+            continue
+        }
+        seen[space.guid] = true
+        spaces = append(spaces, f.v3Space(*space))
+
+        org := findEntity(f.orgs, space.fields["organization_guid"])
+        if org == nil || seen[org.guid] {
+            continue
+        }
+        seen[org.guid] = true
+        orgs = append(orgs, f.v3Org(*org))
+    }
+    return map[string]interface{}{
+        "spaces": spaces,
+        "organizations": orgs,
+    }
+}
+
+// Serves one page of a v3 list endpoint, honoring the `page`, `per_page` and
+// `include` params
+func (f *FakeCloudController) serveV3List(rw http.ResponseWriter, r *http.Request, list *[]fakeEntity) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.ListReqCounts[r.URL.Path] += 1
+    entities := *list
+
+    perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+    if err != nil || perPage <= 0 {
+        perPage = 50
+    }
+    page, err := strconv.Atoi(r.URL.Query().Get("page"))
+    if err != nil || page <= 0 {
+        page = 1
+    }
+
+    start := (page - 1) * perPage
+    end := start + perPage
+    if start > len(entities) {
+        start = len(entities)
+    }
+    if end > len(entities) {
+        end = len(entities)
+    }
+
+    var next interface{}
+    if end < len(entities) {
+        query := r.URL.Query()
+        query.Set("page", strconv.Itoa(page+1))
+        query.Set("per_page", strconv.Itoa(perPage))
+        next = map[string]string{
+            "href": fmt.Sprintf("http://%s%s?%s", r.Host, r.URL.Path, query.Encode()),
+        }
+    }
+
+    resources := []interface{}{}
+    for _, e := range entities[start:end] {
+        resources = append(resources, f.v3ResourceByGUID(e.guid))
+    }
+
+    response := map[string]interface{}{
+        "pagination": map[string]interface{}{
+            "total_results": len(entities),
+            "next": next,
+        },
+        "resources": resources,
+    }
+    if r.URL.Query().Get("include") == "space.organization" {
+        response["included"] = f.v3Included(entities[start:end])
+    }
+    body, _ := json.Marshal(response)
+    rw.Write(body)
+}
+
+// Serves `/v3/apps?guids=<guid>`, which returns no apps if the app is
+// missing, and a made up one in myspace and myorg if it wasn't added
+func (f *FakeCloudController) serveV3AppLookup(rw http.ResponseWriter, r *http.Request) {
+    guid := r.URL.Query().Get("guids")
+
+    f.lock.Lock()
+    f.AppReqCounts[guid] += 1
+    f.ListReqCounts[r.URL.Path] += 1
+    delay := f.responseDelay
+    errorStatus := f.errorStatus
+    f.lock.Unlock()
+
+    time.Sleep(delay)
+
+    if errorStatus != 0 {
+        rw.WriteHeader(errorStatus)
+        rw.Write([]byte(`{"errors": [{"code": 10001, "title": "CF-ServerError", "detail": "Server error"}]}`))
+        return
+    }
+
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    var apps []fakeEntity
+    if added := findEntity(f.apps, guid); added != nil {
+        apps = append(apps, *added)
+    } else if !f.missingApps[guid] {
+        apps = append(apps, fakeEntity{guid, map[string]string{
+            "name": "app-" + guid,
+            "space_guid": "25afdd92-2acc-49f7-9d5b-4206af993286",
+            "state": "STARTED",
+        }})
+    }
+
+    resources := []interface{}{}
+    for _, app := range apps {
+        resources = append(resources, f.v3App(app))
+    }
+    included := f.v3Included(apps)
+    if len(apps) > 0 && findEntity(f.spaces, apps[0].fields["space_guid"]) == nil {
+        included["spaces"] = []interface{}{f.v3Space(fakeEntity{"25afdd92-2acc-49f7-9d5b-4206af993286", map[string]string{
+            "name": "myspace",
+            "organization_guid": "0175d8fd-e76b-4ca6-914d-7b3d2a4536b2",
+        }})}
+        included["organizations"] = []interface{}{f.v3Org(fakeEntity{"0175d8fd-e76b-4ca6-914d-7b3d2a4536b2", map[string]string{
+            "name": "myorg",
+        }})}
+    }
+
+    body, _ := json.Marshal(map[string]interface{}{
+        "pagination": map[string]interface{}{
+            "total_results": len(resources),
+            "next": nil,
+        },
+        "resources": resources,
+        "included": included,
+    })
+    rw.Write(body)
+}
@@ -4,6 +4,7 @@ import (
     "log"
     "net/http"
     "net/http/httptest"
+    "strings"
     "sync"
     "time"
 
@@ -18,6 +19,10 @@ type FakeFirehose struct {
 
     lastAuthorization string
     requested         bool
+    requestCount      int
+
+    // Connections made so far for each subscription id
+    subscribers map[string]int
 
     events       []events.Envelope
     closeMessage []byte
@@ -28,6 +33,7 @@ type FakeFirehose struct {
 func NewFakeFirehose() *FakeFirehose {
     return &FakeFirehose{
         closeMessage: websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+        subscribers:  make(map[string]int),
     }
 }
 
@@ -57,6 +63,12 @@ func (f *FakeFirehose) Requested() bool {
     return f.requested
 }
 
+func (f *FakeFirehose) RequestCount() int {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    return f.requestCount
+}
+
 func (f *FakeFirehose) AddEvent(event events.Envelope) {
     f.lock.Lock()
     defer f.lock.Unlock()
@@ -70,6 +82,14 @@ func (f *FakeFirehose) SetCloseMessage(message []byte) {
     copy(f.closeMessage, message)
 }
 
+// Unlike the real Firehose, which splits the events between connections with
+// the same subscription id, every connection is sent all of the events
+func (f *FakeFirehose) SubscriberCount(subscriptionID string) int {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    return f.subscribers[subscriptionID]
+}
+
 func (f *FakeFirehose) KeepConnectionAlive() {
     f.wg.Add(1)
 }
@@ -83,13 +103,17 @@ func (f *FakeFirehose) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 
     f.lastAuthorization = r.Header.Get("Authorization")
     f.requested = true
+    f.requestCount++
 
     if f.lastAuthorization == "bad" {
-        log.Printf("Bad token passed to firehose: %s", f.lastAuthorization)
+        f.lock.Unlock()
+        log.Printf("Bad token passed to firehose: %s", r.Header.Get("Authorization"))
         rw.WriteHeader(403)
         r.Body.Close()
         return
     }
+
+    f.subscribers[strings.TrimPrefix(r.URL.Path, "/firehose/")]++
     f.lock.Unlock()
 
     upgrader := websocket.Upgrader{
@@ -1,10 +1,14 @@
 package testhelpers
 
 import (
+    "compress/gzip"
+    "encoding/json"
     "io"
     "io/ioutil"
     "net/http"
     "net/http/httptest"
+    "strings"
+    "sync"
 
     sfxproto "github.com/signalfx/com_signalfx_metrics_protobuf"
     "github.com/gogo/protobuf/proto"
@@ -15,11 +19,26 @@ import (
 type FakeSignalFx struct {
     server           *httptest.Server
     ReceivedContents chan []byte
+    // Updates sent to the `/v2/dimension/<key>/<value>/_/update` endpoint
+    DimensionUpdates chan DimensionUpdate
+    lock             sync.Mutex
+    dimensionStatus  int
+}
+
+// Properties that are removed, i.e. set to null, are empty strings
+type DimensionUpdate struct {
+    Path             string
+    Token            string
+    Key              string
+    Value            string
+    CustomProperties map[string]string `json:"customProperties"`
+    Tags             []string          `json:"tags"`
 }
 
 func NewFakeSignalFx() *FakeSignalFx {
     return &FakeSignalFx{
         ReceivedContents: make(chan []byte, 100),
+        DimensionUpdates: make(chan DimensionUpdate, 100),
     }
 }
 
@@ -40,8 +59,45 @@ func (f *FakeSignalFx) URL() string {
 }
 
 func (f *FakeSignalFx) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
-    contents, _ := ioutil.ReadAll(r.Body)
     defer r.Body.Close()
+
+    if strings.HasPrefix(r.URL.Path, "/v2/dimension/") {
+        var update DimensionUpdate
+        parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v2/dimension/"), "/")
+        if r.Method != "PATCH" || len(parts) != 4 || parts[2] != "_" || parts[3] != "update" ||
+            json.NewDecoder(r.Body).Decode(&update) != nil {
+            rw.WriteHeader(http.StatusBadRequest)
+            return
+        }
+        update.Key = parts[0]
+        update.Value = parts[1]
+        f.lock.Lock()
+        status := f.dimensionStatus
+        f.lock.Unlock()
+        if status != 0 {
+            rw.WriteHeader(status)
+            return
+        }
+
+        update.Path = r.URL.Path
+        update.Token = r.Header.Get("X-SF-Token")
+        f.DimensionUpdates <- update
+        return
+    }
+
+    // The sink compresses larger payloads
+    var body io.Reader = r.Body
+    if r.Header.Get("Content-Encoding") == "gzip" {
+        gzipReader, err := gzip.NewReader(r.Body)
+        if err != nil {
+            rw.WriteHeader(http.StatusBadRequest)
+            return
+        }
+        defer gzipReader.Close()
+        body = gzipReader
+    }
+
+    contents, _ := ioutil.ReadAll(body)
     rw.WriteHeader(http.StatusOK)
     io.WriteString(rw, "\"OK\"")
 
@@ -64,3 +120,16 @@ func (f *FakeSignalFx) GetIngestedDatapoints() []*sfxproto.DataPoint {
 func (f *FakeSignalFx) EnsureNoDatapoints() {
     Consistently(f.ReceivedContents, 4).ShouldNot(Receive())
 }
+
+// Makes dimension updates fail with the given HTTP status, or work again if 0
+func (f *FakeSignalFx) SetDimensionUpdateStatus(status int) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.dimensionStatus = status
+}
+
+func (f *FakeSignalFx) GetDimensionUpdate() DimensionUpdate {
+    var update DimensionUpdate
+    Eventually(f.DimensionUpdates, 5).Should(Receive(&update))
+    return update
+}
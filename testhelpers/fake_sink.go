@@ -0,0 +1,58 @@
+package testhelpers
+
+import (
+    "context"
+    "errors"
+    "sync"
+
+    "github.com/signalfx/golib/v3/datapoint"
+)
+
+// An in-memory SignalFxClient that can be told to fail, for testing what
+// happens to datapoints when the ingest endpoint is down.
+type FakeSink struct {
+    lock     sync.Mutex
+    failing  bool
+    // Returned instead of the default error while failing, if set
+    err      error
+    received []*datapoint.Datapoint
+}
+
+func NewFakeSink() *FakeSink {
+    return &FakeSink{}
+}
+
+func (f *FakeSink) SetFailing(failing bool) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.failing = failing
+    f.err = nil
+}
+
+// Fails with the given error, or stops failing if it is nil
+func (f *FakeSink) FailWith(err error) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.failing = err != nil
+    f.err = err
+}
+
+func (f *FakeSink) AddDatapoints(ctx context.Context, dps []*datapoint.Datapoint) error {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    if f.failing {
+        if f.err != nil {
+            return f.err
+        }
+        return errors.New("fake sink is down")
+    }
+    f.received = append(f.received, dps...)
+    return nil
+}
+
+func (f *FakeSink) Received() []*datapoint.Datapoint {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    return append([]*datapoint.Datapoint(nil), f.received...)
+}
@@ -0,0 +1,33 @@
+package testhelpers
+
+import (
+    "context"
+    "sync"
+)
+
+// Satisfied by the metrics.Component types
+type runner interface {
+    Run(ctx context.Context) error
+}
+
+// Runs the component in the background until the returned func is called,
+// which cancels its context and returns what Run returned, e.g.
+//
+//   defer RunInBackground(nozzle)()
+func RunInBackground(component runner) (stop func() error) {
+    ctx, cancel := context.WithCancel(context.Background())
+    errs := make(chan error, 1)
+    go func() {
+        errs <- component.Run(ctx)
+    }()
+
+    var once sync.Once
+    var err error
+    return func() error {
+        once.Do(func() {
+            cancel()
+            err = <-errs
+        })
+        return err
+    }
+}